@@ -16,10 +16,9 @@
 package cmd
 
 import (
-	"encoding/csv"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"os"
 	"strings"
 	"time"
 
@@ -42,7 +41,8 @@ var addFlags struct {
 	url        string
 	importFile string
 	dryRun     bool
-	parent     uint64
+	partial    bool
+	parent     string
 }
 
 // addCmd represents the add command
@@ -75,8 +75,9 @@ func init() {
 	addCmd.Flags().IntVarP(&addFlags.priority, "priority", "p", -1, "The priority of this task, how important it is.")
 	addCmd.Flags().StringVarP(&addFlags.url, "url", "u", "", "Any URL resource associated with this tasks, such as an article.")
 	addCmd.Flags().StringVarP(&addFlags.importFile, "from-file", "f", "", "Import tasks from a file. Can be csv.")
+	addCmd.Flags().BoolVar(&addFlags.partial, "partial", false, "Add the tasks that are valid, even if others aren't.")
 	addCmd.Flags().BoolVar(&addFlags.dryRun, "dry-run", false, "Go through the steps but do nothing.")
-	addCmd.Flags().Uint64VarP(&addFlags.parent, "parent", "P", 0, "Specify the parent task of this task.")
+	addCmd.Flags().StringVarP(&addFlags.parent, "parent", "P", "", "Specify the parent task of this task, by GUID, @ID such as @3, or name.")
 }
 
 // add is the running function for the `add` command.
@@ -87,8 +88,8 @@ func init() {
 // From CLI takes all of the given parameters and autocompletes as best it can
 // based on them. It will fill in parent/children relationships, assign UUID,
 // and eventually guess priority and size.
-// It also operates on failfast, meaning that it will stop immediately if
-// anything goes wrong.
+// It also operates on failfast, meaning that nothing is added if anything goes
+// wrong, unless --partial is given.
 func add(cmd *cobra.Command, args []string) error {
 	var err error
 	var tasks []models.Task
@@ -107,16 +108,32 @@ func add(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	// TODO: Only submit if all tasks are valid
-	for _, task := range tasks {
-		//	fmt.Printf("%d, %s, %d\n", task.Guid, task.Name, task.Size)
-		err := db.CreateTask(task)
-		if err != nil {
+	if addFlags.importFile != "" {
+		if err = snapshotBefore(db, "import"); err != nil {
 			return err
 		}
 	}
 
-	return nil
+	var errs []error
+	if addFlags.partial {
+		errs = storage.CreateTasksPartial(db, tasks)
+	} else {
+		errs = db.CreateTasks(tasks)
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+	}
+
+	if addFlags.partial {
+		return fmt.Errorf("Added %d of %d tasks", len(tasks)-len(errs), len(tasks))
+	}
+
+	return fmt.Errorf("No tasks were added")
 }
 
 // validate checks to make sure there aren't any contradictions or out of bound
@@ -148,33 +165,13 @@ func validate(cmd *cobra.Command, args []string) error {
 // file that looks exactly like the CSV database file, and creates Task objects.
 // TODO: Divine file type, use appropriate storage helpers
 func tasksFromFile() ([]models.Task, error) {
-	var err error
-	var result []models.Task
-
-	f, err := ioutil.ReadFile(addFlags.importFile)
+	f, err := os.Open(addFlags.importFile)
 	if err != nil {
 		return []models.Task{}, err
 	}
-	input := string(f)
+	defer f.Close()
 
-	records, err := csv.NewReader(strings.NewReader(input)).ReadAll()
-	if err != nil {
-		return []models.Task{}, err
-	}
-
-	for i, record := range records {
-		if i == 0 {
-			continue
-		}
-
-		newTask, err := storage.TaskFromCsv(record)
-		if err != nil {
-			return []models.Task{}, err
-		}
-		result = append(result, newTask)
-	}
-
-	return result, nil
+	return storage.ReadCsvTasks(f)
 }
 
 func tasksFromCmd(cmd *cobra.Command, args []string) ([]models.Task, error) {
@@ -193,6 +190,13 @@ func tasksFromCmd(cmd *cobra.Command, args []string) ([]models.Task, error) {
 		}
 	}
 
+	var parent uint64
+	if addFlags.parent != "" {
+		if parent, err = resolver.Resolve(addFlags.parent); err != nil {
+			return []models.Task{}, err
+		}
+	}
+
 	result[0] = models.Task{
 		Name:     addFlags.name,
 		Size:     uint32(addFlags.size),
@@ -201,7 +205,7 @@ func tasksFromCmd(cmd *cobra.Command, args []string) ([]models.Task, error) {
 		Due:      addFlags.due_p,
 		Priority: uint32(addFlags.priority),
 		Url:      addFlags.url,
-		Parent:   addFlags.parent,
+		Parent:   parent,
 	}
 
 	return result, nil
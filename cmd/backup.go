@@ -0,0 +1,202 @@
+// Tasker - A pluggable task server for keeping track of all those To-Do's
+// Copyright (C) 2019 Ryan Murphy <ryan@oatmealrais.in>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/oatmealraisin/tasker/pkg/storage"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var backupFlags struct {
+	list bool
+}
+
+// backupCmd saves a snapshot of every task and the data of plugins
+var backupCmd = &cobra.Command{
+	Use:   "backup",
+	Short: "Save a snapshot of your tasks",
+	Long: `Save a snapshot of every task, along with the data plugins keep in
+PluginDataDir, as a compressed file in BackupDir. Only the newest BackupKeep
+snapshots are kept.
+
+tasker also saves a snapshot by itself before changing many tasks at once, such
+as 'add --from-file', 'storage migrate' and 'restore', unless AutoBackup is off.
+Those are named after the command, and the newest BackupKeep are kept for each
+command, apart from the ones saved with 'backup'.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := cmd.RunE(cmd, args); err != nil {
+			log.Fatal(err.Error())
+		}
+	},
+	RunE: backup,
+}
+
+// restoreCmd puts a snapshot back
+var restoreCmd = &cobra.Command{
+	Use:   "restore <snapshot>",
+	Short: "Replace your tasks with a snapshot",
+	Long: `Replace every task with the ones in a snapshot saved by 'backup', and put
+the data of plugins back. The snapshot can be a file, or the name of one in
+BackupDir, as listed by 'backup --list'.
+
+A snapshot of the tasks as they are now is saved first. The history isn't
+rewound, so 'undo' leaves the restored tasks alone.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := cmd.RunE(cmd, args); err != nil {
+			log.Fatal(err.Error())
+		}
+	},
+	RunE: restore,
+}
+
+func init() {
+	TaskerCmd.AddCommand(backupCmd)
+	TaskerCmd.AddCommand(restoreCmd)
+
+	backupCmd.Flags().BoolVarP(&backupFlags.list, "list", "l", false, "List the saved snapshots instead.")
+}
+
+func backup(cmd *cobra.Command, args []string) error {
+	if backupFlags.list {
+		snapshots, err := storage.Snapshots(backupDir())
+		if err != nil {
+			return err
+		}
+
+		for _, snapshot := range snapshots {
+			fmt.Println(filepath.Base(snapshot))
+		}
+
+		return nil
+	}
+
+	filename, err := storage.SaveSnapshot(backupDir(), db, pluginDataDirs(), "", viper.GetInt("BackupKeep"))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Saved %d tasks to %s\n", len(db.GetAllTasks()), filename)
+
+	return nil
+}
+
+func restore(cmd *cobra.Command, args []string) error {
+	filename := args[0]
+	if _, err := os.Stat(filename); os.IsNotExist(err) && filepath.Base(filename) == filename {
+		filename = filepath.Join(backupDir(), filename)
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// The history only records changes made through it, and a restore isn't
+	// one we want to undo task by task
+	target := db
+	if history != nil {
+		target = history.Unwrap()
+	}
+
+	if err := snapshotBefore(target, "restore"); err != nil {
+		return err
+	}
+
+	dirs := []storage.SnapshotDir{pluginRestoreDir()}
+	if err := storage.RestoreSnapshot(f, target, dirs); err != nil {
+		return err
+	}
+
+	fmt.Printf("Restored %d tasks from %s\n", len(target.GetAllTasks()), filename)
+
+	return nil
+}
+
+// snapshotBefore saves a snapshot of s before a command changes many Tasks at
+// once, unless AutoBackup is off. The command shouldn't go ahead if it fails.
+func snapshotBefore(s storage.Storage, reason string) error {
+	if !viper.GetBool("AutoBackup") {
+		return nil
+	}
+
+	filename, err := storage.SaveSnapshot(backupDir(), s, pluginDataDirs(), reason, viper.GetInt("BackupKeep"))
+	if err != nil {
+		return fmt.Errorf("Could not save a snapshot first, set AutoBackup to false to go ahead anyway: %s", err.Error())
+	}
+
+	fmt.Fprintf(os.Stderr, "Saved a snapshot to %s\n", filename)
+
+	return nil
+}
+
+func backupDir() string {
+	return os.ExpandEnv(viper.GetString("BackupDir"))
+}
+
+func pluginDataDir() string {
+	return os.ExpandEnv(viper.GetString("PluginDataDir"))
+}
+
+func pluginDir() string {
+	return filepath.Clean(os.ExpandEnv(viper.GetString("PluginDir")))
+}
+
+// pluginDataDirs lists the directories plugins keep their data in, which are
+// the ones in PluginDataDir other than PluginDir itself.
+func pluginDataDirs() []storage.SnapshotDir {
+	dir := pluginDataDir()
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	pluginDir := pluginDir()
+
+	var result []storage.SnapshotDir
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if !entry.IsDir() || path == pluginDir {
+			continue
+		}
+
+		result = append(result, storage.SnapshotDir{Name: "plugins/" + entry.Name(), Path: path})
+	}
+
+	return result
+}
+
+// pluginRestoreDir puts the directories pluginDataDirs saved back in
+// PluginDataDir, one per plugin. Nothing else is restored there, so a
+// snapshot can't replace the config or add a plugin to PluginDir.
+func pluginRestoreDir() storage.SnapshotDir {
+	return storage.SnapshotDir{
+		Name:    "plugins",
+		Path:    pluginDataDir(),
+		Each:    true,
+		Exclude: []string{pluginDir()},
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"strconv"
 
 	"github.com/golang/protobuf/ptypes"
 	"github.com/spf13/cobra"
@@ -20,14 +19,13 @@ var finishFlags struct {
 
 // addCmd represents the add command
 var finishCmd = &cobra.Command{
-	Use:   "finish",
-	Short: "A brief description of your command",
-	Long: `A longer description that spans multiple lines and likely contains examples
-and usage of using your command. For example:
-
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`,
+	Use:   "finish <task>",
+	Short: "Mark a task as finished",
+	Long: `Mark a task as finished, and with --remove, take it off the list too.
+
+The task can be given by its GUID, by the @ID it was listed with, such as @3, or
+by the start of its name. A bare number is always a GUID, so 'tasker finish 3'
+finishes the task with GUID 3, not the third one listed.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		if err := cmd.RunE(cmd, args); err != nil {
 			log.Fatal(err.Error())
@@ -110,11 +108,12 @@ func validateFinish(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("Need to have something to finish!")
 	}
 
-	if uuid, err := strconv.ParseUint(args[0], 10, 64); err == nil {
-		finishFlags.uuid = uuid
-	} else {
+	uuid, err := resolver.Resolve(args[0])
+	if err != nil {
 		return err
 	}
 
+	finishFlags.uuid = uuid
+
 	return nil
 }
@@ -4,10 +4,10 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"strconv"
 	"time"
 
 	"github.com/oatmealraisin/tasker/pkg/models"
+	"github.com/oatmealraisin/tasker/pkg/storage"
 	"github.com/spf13/cobra"
 )
 
@@ -19,12 +19,14 @@ var getFlags struct {
 	alsoRelatives bool
 
 	getAll          bool
+	task            string
 	uuid            uint64
 	tags            []string
 	tagsOpt         []string
 	includeFinished bool
 	includeRemoved  bool
 	dueBefore       string
+	tDueBefore      time.Time
 	createdAfter    string
 	tCreatedAfter   time.Time
 	url             bool
@@ -35,12 +37,12 @@ var getFlags struct {
 var getCmd = &cobra.Command{
 	Use:   "get",
 	Short: "Retrieve specific information about specific tasks",
-	Long: `A longer description that spans multiple lines and likely contains examples
-and usage of using your command. For example:
+	Long: `List the tasks that match the filters, or with 'get <task>' or --uuid, a
+single task. Listing tasks hands out new @IDs.
 
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`,
+A single task can be given by its GUID, by the @ID it was listed with, such as
+@3, or by the start of its name. A bare number is always a GUID, so 'tasker get
+3' gets the task with GUID 3, not the third one listed.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		if err := cmd.RunE(cmd, args); err != nil {
 			log.Fatal(err.Error())
@@ -58,7 +60,7 @@ func init() {
 	//getCmd.Flags().StringVarP(&name, "name", "n", "", "Get tasks with a similar name")
 	getCmd.Flags().StringSliceVarP(&getFlags.tags, "tag", "t", []string{}, "Get tasks from a tag. Can be invoked more than once to specify multiple tags.")
 	getCmd.Flags().StringSliceVar(&getFlags.tagsOpt, "has-tag", []string{}, "Get tasks from a tag. Can be invoked more than once to specify multiple tags.")
-	getCmd.Flags().Uint64VarP(&getFlags.uuid, "uuid", "u", 0, "Get tasks with matching uuid. Will only return one task.")
+	getCmd.Flags().StringVarP(&getFlags.task, "uuid", "u", "", "Get the task with this GUID, @ID such as @3, or name. Will only return one task.")
 	getCmd.Flags().BoolVar(&getFlags.includeFinished, "finished", false, "Also give tasks that have been finished.")
 	getCmd.Flags().BoolVar(&getFlags.includeRemoved, "removed", false, "Also give tasks that have been removed.")
 	getCmd.Flags().BoolVar(&getFlags.url, "url", false, "Print the URL associated with the task.")
@@ -68,25 +70,25 @@ func init() {
 }
 
 func get(cmd *cobra.Command, args []string) error {
+	var err error
 	var tasks []uint64
 
-	if err := validateGet(cmd, args); err != nil {
+	if err = validateGet(cmd, args); err != nil {
 		return err
 	}
 
-	if getFlags.getAll {
-		allTasks := db.GetAllTasks()
-		tasks = allTasks[:0]
-
-		for _, u := range allTasks {
-			if task, err := db.GetTask(u); err == nil {
-				if !task.Removed && task.Added.Seconds < time.Now().Unix() {
-					tasks = append(tasks, u)
-				}
-			} else {
-				fmt.Fprintf(os.Stderr, err.Error())
-			}
-		}
+	query := storage.Query{
+		CreatedAfter: getFlags.tCreatedAfter,
+		DueBefore:    getFlags.tDueBefore,
+	}
+
+	notFinished, notRemoved := false, false
+	if !getFlags.includeFinished {
+		query.Finished = &notFinished
+	}
+
+	if !getFlags.includeRemoved {
+		query.Removed = &notRemoved
 	}
 
 	if getFlags.uuid != 0 {
@@ -96,8 +98,23 @@ func get(cmd *cobra.Command, args []string) error {
 		}
 
 		tasks = []uint64{getFlags.uuid}
-	} else if cmd.Flag("tag").Changed {
-		tasks = db.GetByTags(getFlags.tags)
+	} else if getFlags.getAll || cmd.Flag("tag").Changed {
+		selection := query
+
+		if getFlags.getAll {
+			selection.Removed = &notRemoved
+			selection.CreatedBefore = time.Now()
+		} else {
+			selection.Tags = getFlags.tags
+		}
+
+		if tasks, err = storage.Find(db, selection); err != nil {
+			return err
+		}
+
+		if err = resolver.Renumber(); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		}
 	}
 
 	if getFlags.alsoChildren {
@@ -115,22 +132,11 @@ func get(cmd *cobra.Command, args []string) error {
 		tasks = children
 	}
 
-	filterList := models.FilterList{}
-
-	if !getFlags.includeFinished {
-		filterList = append(filterList, models.IsNotFinishedFilter())
+	// Only the Tasks found by the storage have been filtered already
+	if getFlags.uuid != 0 || getFlags.alsoChildren {
+		tasks = models.FilterList{query.Filter()}.Apply(tasks, db.GetTask)
 	}
 
-	if !getFlags.includeRemoved {
-		filterList = append(filterList, models.IsNotRemovedFilter())
-	}
-
-	if getFlags.createdAfter != "" {
-		filterList = append(filterList, models.CreatedAfter(getFlags.tCreatedAfter))
-	}
-
-	tasks = filterList.Apply(tasks, db.GetTask)
-
 	if getFlags.url {
 		for _, uuid := range tasks {
 			task, err := db.GetTask(uuid)
@@ -166,10 +172,14 @@ func validateGet(cmd *cobra.Command, args []string) error {
 	var err error
 
 	if cmd.Flag("uuid").Changed {
-		if len(getFlags.createdAfter)+len(getFlags.tags)+len(args)+len(getFlags.tagsOpt) != 0 || cmd.Flag("include-finished").Changed {
+		if len(getFlags.createdAfter)+len(getFlags.tags)+len(args)+len(getFlags.tagsOpt) != 0 || cmd.Flag("finished").Changed {
 			return fmt.Errorf("Cannot specify multiple filters if UUID is given.\n")
 		}
 
+		if getFlags.uuid, err = resolver.Resolve(getFlags.task); err != nil {
+			return err
+		}
+
 		getFlags.includeFinished = true
 	}
 
@@ -180,6 +190,13 @@ func validateGet(cmd *cobra.Command, args []string) error {
 		}
 	}
 
+	if getFlags.dueBefore != "" {
+		getFlags.tDueBefore, err = time.ParseInLocation("2006-01-02", getFlags.dueBefore, time.Now().Location())
+		if err != nil {
+			return err
+		}
+	}
+
 	if len(args) == 1 {
 		if args[0] == "all" {
 			if len(getFlags.tags)+len(getFlags.tagsOpt) != 0 {
@@ -187,8 +204,11 @@ func validateGet(cmd *cobra.Command, args []string) error {
 			}
 
 			getFlags.getAll = true
-		} else if uuid, err := strconv.ParseUint(args[0], 10, 64); err == nil {
-			getFlags.uuid = uuid
+		} else {
+			if getFlags.uuid, err = resolver.Resolve(args[0]); err != nil {
+				return err
+			}
+
 			getFlags.includeFinished = true
 		}
 	}
@@ -0,0 +1,134 @@
+// Tasker - A pluggable task server for keeping track of all those To-Do's
+// Copyright (C) 2019 Ryan Murphy <ryan@oatmealrais.in>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oatmealraisin/tasker/pkg/storage"
+	"github.com/spf13/cobra"
+)
+
+// logCmd shows the recorded changes to a single Task
+var logCmd = &cobra.Command{
+	Use:   "log <task>",
+	Short: "Show how a task changed over time",
+	Long: `Show every recorded change to a task: when it was created, edited, finished,
+removed or deleted, and how its fields changed each time. The task can be given
+by its GUID, by the @ID it was listed with, such as @3, or by the start of its
+name. A bare number is always a GUID. Deleted tasks can still be looked up by
+GUID.
+
+Changes are only recorded while the History setting is on, which it is by
+default.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := cmd.RunE(cmd, args); err != nil {
+			log.Fatal(err.Error())
+		}
+	},
+	RunE: taskLog,
+}
+
+func init() {
+	TaskerCmd.AddCommand(logCmd)
+}
+
+func taskLog(cmd *cobra.Command, args []string) error {
+	if history == nil {
+		return fmt.Errorf("History is turned off, set History to true in your config to record it")
+	}
+
+	guid, err := logGuid(args[0])
+	if err != nil {
+		return err
+	}
+
+	entries, err := history.History(guid)
+	if err != nil {
+		return err
+	}
+
+	if len(entries) == 0 {
+		fmt.Printf("No history for task #%d\n", guid)
+		return nil
+	}
+
+	for _, entry := range entries {
+		fmt.Printf("%s  %s\n", entry.Time.Local().Format("2006-01-02 15:04"), historyOpNames[entry.Op])
+
+		for _, change := range entry.Changes {
+			from, to := logValue(change.Field, change.Old), logValue(change.Field, change.New)
+
+			switch entry.Op {
+			case storage.HistoryCreate:
+				fmt.Printf("    %-9s %s\n", change.Field, to)
+			case storage.HistoryDelete:
+				fmt.Printf("    %-9s %s\n", change.Field, from)
+			default:
+				fmt.Printf("    %-9s %s -> %s\n", change.Field, from, to)
+			}
+		}
+	}
+
+	return nil
+}
+
+// logGuid returns the GUID of the Task arg names. Deleted Tasks only live on in
+// the history, so a GUID the Resolver doesn't know, with or without a #, is
+// taken as it is.
+func logGuid(arg string) (uint64, error) {
+	guid, err := resolver.Resolve(arg)
+	if err == nil {
+		return guid, nil
+	}
+
+	if guid, perr := strconv.ParseUint(strings.TrimPrefix(arg, "#"), 10, 64); perr == nil && guid != 0 {
+		return guid, nil
+	}
+
+	return 0, err
+}
+
+var historyOpNames = map[string]string{
+	storage.HistoryCreate: "created",
+	storage.HistoryEdit:   "edited",
+	storage.HistoryFinish: "finished",
+	storage.HistoryRemove: "removed",
+	storage.HistoryDelete: "deleted",
+	storage.HistoryUndo:   "undone",
+}
+
+// logValue formats a recorded value of a field for people to read.
+func logValue(field, value string) string {
+	if value == "" {
+		return "(none)"
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.Local().Format("2006-01-02 15:04")
+	}
+
+	if field == "parent" {
+		return "#" + value
+	}
+
+	return value
+}
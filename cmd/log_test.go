@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/oatmealraisin/tasker/pkg/models"
+	"github.com/oatmealraisin/tasker/pkg/storage"
+	"github.com/spf13/viper"
+)
+
+func TestLogGuidOfDeletedTask(t *testing.T) {
+	dir := t.TempDir()
+	viper.Set("WorkingDir", dir)
+
+	history = storage.NewHistoryStorage(storage.NewJsonStorage(filepath.Join(dir, "tasklist.json")), filepath.Join(dir, "history.jsonl"))
+	resolver = storage.NewResolver(history, filepath.Join(dir, "working-ids"))
+	defer func() { history, resolver = nil, nil }()
+
+	if err := history.CreateTask(models.Task{Name: "deleted"}); err != nil {
+		t.Fatal(err)
+	}
+	guid := history.GetByName("deleted")[0]
+
+	if err := history.DeleteTask(guid); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, arg := range []string{fmt.Sprintf("#%d", guid), fmt.Sprint(guid)} {
+		result, err := logGuid(arg)
+		if err != nil || result != guid {
+			t.Fatalf("logGuid(%s) = %d, %v, expected %d", arg, result, err, guid)
+		}
+
+		entries, err := history.History(result)
+		if err != nil || len(entries) != 2 {
+			t.Errorf("History(%d) = %v, %v, expected the create and the delete", result, entries, err)
+		}
+	}
+
+	if _, err := logGuid("deleted"); err == nil {
+		t.Error("logGuid found the deleted Task by name")
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"os"
 	"path/filepath"
 
+	"github.com/oatmealraisin/tasker/pkg/models"
 	"github.com/oatmealraisin/tasker/pkg/plugins"
 	"github.com/oatmealraisin/tasker/pkg/storage"
 	"github.com/spf13/cobra"
@@ -32,6 +33,9 @@ var (
 	cfg        string
 	noPlugins  bool
 	db         storage.Storage
+	events     *storage.EventStorage
+	history    *storage.HistoryStorage
+	resolver   *storage.Resolver
 	termWidth  int
 	termHeight int
 )
@@ -62,6 +66,17 @@ func initConfig() {
 	viper.SetDefault("Delimiter", "|")
 	viper.SetDefault("EditCmd", "vi")
 	viper.SetDefault("PluginDir", "$XDG_CONFIG_HOME/tasker/autoload")
+	viper.SetDefault("PostgresHost", "localhost")
+	viper.SetDefault("PostgresPort", 5432)
+	viper.SetDefault("PostgresDatabase", "tasker")
+	viper.SetDefault("PostgresSSLMode", "disable")
+	viper.SetDefault("History", true)
+	viper.SetDefault("BackupDir", "$XDG_DATA_HOME/tasker/backups")
+	viper.SetDefault("BackupKeep", 10)
+	viper.SetDefault("AutoBackup", true)
+	viper.SetDefault("PluginDataDir", "$XDG_CONFIG_HOME/tasker")
+	viper.SetDefault("EncryptionKey", "")
+	viper.SetDefault("EncryptionKeyFile", "")
 
 	viper.SetEnvPrefix("tasker")
 	// This means that any config variable can be set using the corresponding
@@ -93,19 +108,25 @@ func initConfig() {
 		}
 	}
 
-	switch viper.GetString("StorageType") {
-	case "csv":
-		db = storage.NewCsvStorage(filepath.Join(viper.GetString("WorkingDir"), "tasklist.csv"))
-		break
-	case "sqlite":
-		panic("sqlite not implemented")
-	case "postgres":
-		panic("postgres not implemented")
-	default:
-		fmt.Fprintf(os.Stderr, "Unknown database type: %s", viper.GetString("StorageType"))
+	var err error
+	db, err = storage.Open(viper.GetString("StorageType"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
 	}
 
-	var err error
+	// Under the history, so undoing a change is published too
+	events = storage.NewEventStorage(db)
+	db = events
+
+	if viper.GetBool("History") {
+		history = storage.NewHistoryStorage(db, filepath.Join(viper.GetString("WorkingDir"), "history.jsonl"))
+		db = history
+	}
+
+	resolver = storage.NewResolver(db, filepath.Join(viper.GetString("WorkingDir"), "working-ids"))
+	models.TaskId = resolver.Id
+
 	termWidth, termHeight, err = terminal.GetSize(int(os.Stdout.Fd()))
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
@@ -125,6 +146,14 @@ func initConfig() {
 			if viewPlug, ok := plug.(plugins.TaskViewer); ok {
 				viewPlug.SetGetFunc(db.GetTask)
 			}
+
+			if resolvePlug, ok := plug.(plugins.TaskResolver); ok {
+				resolvePlug.SetResolveFunc(resolver.Resolve)
+			}
+
+			if watchPlug, ok := plug.(plugins.TaskWatcher); ok {
+				events.Subscribe(watchPlug.TaskChanged)
+			}
 		}
 	}
 }
@@ -19,9 +19,10 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"sort"
+	"time"
 
 	"github.com/oatmealraisin/tasker/pkg/models"
+	"github.com/oatmealraisin/tasker/pkg/storage"
 	"github.com/spf13/cobra"
 )
 
@@ -56,54 +57,62 @@ func init() {
 
 // status is the main function for the `tasker status` command. First we get the
 // tasklist we're using for context (All by default, but could be within a list
-// of tags). Then, we filter by IsNotFinished, IsNotRemoved. Finally, we sort
-// by their score and print the first 10.
+// of tags), narrowed down by the storage to what is unfinished, not removed,
+// active and sized, sorted by score. Finally, we print the first 10 that
+// aren't blocked by other tasks.
 func status(cmd *cobra.Command, args []string) error {
 	var err error
 	if err = statusValidate(cmd, args); err != nil {
 		return err
 	}
 
-	tasks := []uint64{}
+	notFinished, notRemoved, unsized := false, false, uint32(0)
 
-	if len(statusFlags.tags) > 0 {
-		tasks = db.GetByTags(statusFlags.tags)
-	} else {
-		tasks = db.GetAllTasks()
-	}
+	// CreatedBefore is strict, and tasks added this instant are active too
+	createdBefore := time.Now().Add(time.Nanosecond)
 
-	if len(tasks) == 0 {
-		fmt.Printf("It doesn't look like you have anything to do!\n")
-		return nil
+	tasks, err := storage.TopByScore(db, 0, storage.Query{
+		Tags:          statusFlags.tags,
+		Finished:      &notFinished,
+		Removed:       &notRemoved,
+		CreatedBefore: createdBefore,
+		SizeIsNot:     &unsized,
+	})
+	if err != nil {
+		return err
 	}
 
-	filterList := models.FilterList{
-		models.IsNotFinishedFilter(),
-		models.IsNotRemovedFilter(),
-		models.IsActiveFilter(),
-		models.SizeIsNot(0),
-		models.NoUnfinishedPrereqs(),
-	}
+	// Prerequisites are other Tasks, so the storage can't check them. Only
+	// look at as many as we need.
+	prereqs := models.NoUnfinishedPrereqs()
+	result := []uint64{}
 
-	tasks = filterList.Apply(tasks, db.GetTask)
+	for _, uuid := range tasks {
+		if len(result) >= statusFlags.numShow {
+			break
+		}
 
-	sort.Slice(tasks, func(i, j int) bool {
-		a, err := db.GetTask(tasks[i])
+		task, err := db.GetTask(uuid)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error sorting task %d: %s\n", tasks[i], err.Error())
-			return false
+			fmt.Fprintf(os.Stderr, "Could not get task %d\n", uuid)
+			continue
 		}
 
-		b, err := db.GetTask(tasks[j])
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error sorting task %d: %s\n", tasks[j], err.Error())
-			return true
+		if prereqs.Apply(task, db.GetTask) {
+			result = append(result, uuid)
 		}
+	}
 
-		return a.Score() > b.Score()
-	})
+	if len(result) == 0 {
+		fmt.Printf("It doesn't look like you have anything to do!\n")
+		return nil
+	}
+
+	if err = resolver.Renumber(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+	}
 
-	models.PrintTasks(tasks[:statusFlags.numShow], db.GetTask)
+	models.PrintTasks(result, db.GetTask)
 
 	return nil
 }
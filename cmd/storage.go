@@ -0,0 +1,101 @@
+// Tasker - A pluggable task server for keeping track of all those To-Do's
+// Copyright (C) 2019 Ryan Murphy <ryan@oatmealrais.in>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package cmd
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/oatmealraisin/tasker/pkg/storage"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var storageMigrateFlags struct {
+	from string
+}
+
+// storageCmd groups the commands that manage the storage backend itself. It
+// has nothing to run by itself, so cobra prints its help.
+var storageCmd = &cobra.Command{
+	Use:   "storage",
+	Short: "Manage where tasker keeps its Tasks",
+}
+
+var storageMigrateCmd = &cobra.Command{
+	Use:   "migrate <storage type>",
+	Short: "Copy every Task to another storage backend",
+	Long: `Copy every Task from the configured storage backend, or the one given
+with --from, to another one, such as csv, json, yaml, proto, git, bolt, sqlite
+or postgres. Tasks keep their GUIDs, parents, subtasks and dependencies, and the
+copy is checked once it is done. The new storage must be empty.
+
+Afterwards, set StorageType in your config to start using the new storage.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := cmd.RunE(cmd, args); err != nil {
+			log.Fatal(err.Error())
+		}
+	},
+	RunE: storageMigrate,
+}
+
+func init() {
+	TaskerCmd.AddCommand(storageCmd)
+	storageCmd.AddCommand(storageMigrateCmd)
+
+	storageMigrateCmd.Flags().StringVar(&storageMigrateFlags.from, "from", "", "Storage type to copy from. Defaults to StorageType.")
+}
+
+// storageMigrate copies every Task from one storage backend to another.
+func storageMigrate(cmd *cobra.Command, args []string) error {
+	from := db
+	fromType := viper.GetString("StorageType")
+
+	if storageMigrateFlags.from != "" && storageMigrateFlags.from != fromType {
+		var err error
+
+		fromType = storageMigrateFlags.from
+		if from, err = storage.Open(fromType); err != nil {
+			return err
+		}
+	}
+
+	toType := args[0]
+	if toType == fromType {
+		return fmt.Errorf("Cannot migrate %s storage to itself", toType)
+	}
+
+	to, err := storage.Open(toType)
+	if err != nil {
+		return err
+	}
+
+	if err = snapshotBefore(from, "migrate"); err != nil {
+		return err
+	}
+
+	if err = storage.Migrate(from, to); err != nil {
+		return err
+	}
+
+	fmt.Printf("Copied %d Tasks from %s to %s storage.\n", len(from.GetAllTasks()), fromType, toType)
+	if fromType == viper.GetString("StorageType") {
+		fmt.Printf("Set StorageType to %s in your config to use it.\n", toType)
+	}
+
+	return nil
+}
@@ -0,0 +1,105 @@
+// Tasker - A pluggable task server for keeping track of all those To-Do's
+// Copyright (C) 2019 Ryan Murphy <ryan@oatmealrais.in>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/oatmealraisin/tasker/pkg/storage"
+	"github.com/spf13/cobra"
+)
+
+var undoFlags struct {
+	dryRun bool
+}
+
+// undoCmd reverts the last changes recorded in the history
+var undoCmd = &cobra.Command{
+	Use:   "undo [n]",
+	Short: "Revert the last changes to your tasks",
+	Long: `Revert the last n changes, or just the last one, that were made while the
+History setting was on. A change is everything a single command did, so undoing
+an import with 'add --from-file' removes every task it added, and undoing
+'finish -R' brings the task back unfinished.
+
+Tasks that were changed since, outside of tasker, are left alone, and undo
+stops there.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := cmd.RunE(cmd, args); err != nil {
+			log.Fatal(err.Error())
+		}
+	},
+	RunE: undo,
+}
+
+func init() {
+	TaskerCmd.AddCommand(undoCmd)
+
+	undoCmd.Flags().BoolVar(&undoFlags.dryRun, "dry-run", false, "Show what would be reverted, but do nothing.")
+}
+
+func undo(cmd *cobra.Command, args []string) error {
+	if history == nil {
+		return fmt.Errorf("History is turned off, set History to true in your config to be able to undo")
+	}
+
+	n := 1
+	if len(args) == 1 {
+		var err error
+		if n, err = strconv.Atoi(args[0]); err != nil || n < 1 {
+			return fmt.Errorf("'%s' is not a number of changes", args[0])
+		}
+	}
+
+	entries, err := history.Undo(n, undoFlags.dryRun)
+
+	verb := "Undid"
+	if undoFlags.dryRun {
+		verb = "Would undo"
+	}
+
+	for _, entry := range entries {
+		fmt.Printf("%s %s of task #%d%s\n", verb, entry.Op, entry.Guid, undoTaskName(entry))
+
+		for _, change := range entry.Changes {
+			fmt.Printf("    %-9s %s -> %s\n", change.Field, logValue(change.Field, change.New), logValue(change.Field, change.Old))
+		}
+	}
+
+	return err
+}
+
+// undoTaskName finds the name of the Task an entry was about, for printing.
+func undoTaskName(entry storage.HistoryEntry) string {
+	for _, change := range entry.Changes {
+		if change.Field == "name" {
+			if change.New != "" {
+				return fmt.Sprintf(" (%s)", change.New)
+			}
+
+			return fmt.Sprintf(" (%s)", change.Old)
+		}
+	}
+
+	if task, err := db.GetTask(entry.Guid); err == nil {
+		return fmt.Sprintf(" (%s)", task.Name)
+	}
+
+	return ""
+}
@@ -45,6 +45,10 @@ var (
 	longTagLen  int = 20
 
 	removeTag *regexp.Regexp = regexp.MustCompile("[^|]*(\\|\\.\\.\\.)?$")
+
+	// TaskId gives the short working ID shown before the name of a Task, if
+	// it has one. It is set by whoever hands out working IDs.
+	TaskId func(guid uint64) (int, bool)
 )
 
 // getTermWidth is a utility function for understanding where we will be forced
@@ -142,8 +146,14 @@ func (task Task) stringify() map[string]string {
 		result["url"] = "(+)"
 	}
 
+	if TaskId != nil {
+		if id, ok := TaskId(task.Guid); ok {
+			result["name"] = fmt.Sprintf("@%d %s", id, result["name"])
+		}
+	}
+
 	if viper.GetBool("debug") {
-		result["name"] = fmt.Sprintf("%d %s", task.Guid, result["name"])
+		result["name"] = fmt.Sprintf("#%d %s", task.Guid, result["name"])
 	}
 
 	result["tags"] = strings.Join(task.Tags, "|")
@@ -159,7 +169,7 @@ func (task Task) stringify() map[string]string {
 func printColumns(w io.Writer) {
 	defer fmt.Fprintln(w, "")
 	p := func(s string) {
-		fmt.Fprintf(w, fmt.Sprintf("%s\t", s))
+		fmt.Fprintf(w, "%s\t", s)
 	}
 
 	termWidth := getTermWidth()
@@ -120,7 +120,7 @@ func (tt *TaskTree) _print(prefix []rune, w *terminal.Writer, get func(uuid uint
 	task, err := get(tt.key)
 	if err != nil {
 		// TODO: Log
-		fmt.Println("Could not get task %d: %s\n", tt.key, err.Error())
+		fmt.Printf("Could not get task %d: %s\n", tt.key, err.Error())
 		return
 	}
 
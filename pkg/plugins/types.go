@@ -86,6 +86,20 @@ type TaskViewer interface {
 	SetGetFunc(get storage.GetFunc)
 }
 
+/* A TaskWatcher is told about every change to a Task while tasker runs, made
+by tasker itself or by another plugin, once it has been stored. TaskChanged is
+called in the goroutine that made the change, so it should return quickly. */
+type TaskWatcher interface {
+	TaskChanged(event storage.Event)
+}
+
+/* A TaskResolver takes Tasks on its own command line. SetResolveFunc gives it
+the same parsing of GUIDs, @working IDs and name prefixes as tasker's own
+commands, see storage.Resolver. */
+type TaskResolver interface {
+	SetResolveFunc(resolve storage.ResolveFunc)
+}
+
 /* A TaskManager plugin has the ability to arbitrarily add, remove, and modify
 Tasks async of the main Tasker objective. */
 type TaskManager interface {
@@ -0,0 +1,633 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/oatmealraisin/tasker/pkg/models"
+	bolt "go.etcd.io/bbolt"
+)
+
+const boltFormatVersion = 1
+
+var (
+	boltTasks = []byte("tasks")
+	boltTags  = []byte("tags")
+	boltNames = []byte("names")
+	boltMeta  = []byte("meta")
+
+	boltVersionKey = []byte("version")
+	boltGuidKey    = []byte("guid")
+)
+
+// boltTimeout is how long to wait for another process to let go of the
+// database, like the busy timeout of the SQLite Storage.
+const boltTimeout = 5 * time.Second
+
+// boltIdle is how long the database is kept open after a call, in case
+// another one follows, as it does when listing Tasks one GetTask at a time.
+// boltHold is how long a process that keeps calling may keep it open, before
+// it closes it so other processes get a turn. bbolt tries for the lock every
+// 50ms, so it is left closed for boltYield.
+const (
+	boltIdle  = 10 * time.Millisecond
+	boltHold  = 500 * time.Millisecond
+	boltYield = 60 * time.Millisecond
+)
+
+// BoltStorage keeps Tasks in a bbolt database, a single file of B+trees that
+// is read in place, so reading one Task doesn't read the whole list. It has
+// four buckets:
+//
+//	tasks  GUID -> Task, as a protobuf message
+//	tags   tag 0 GUID -> nothing, for each tag of each Task
+//	names  name 0 GUID -> nothing, for each Task
+//	meta   "version" and "guid", the last GUID handed out
+//
+// GUIDs are 8 bytes big endian, so Tasks are in GUID order. Every change is a
+// transaction of its own.
+//
+// Only one process can have the database open at a time, and opening it maps
+// the file and reads its freelist, so it is kept open from one call to the
+// next, and closed once it has been idle for boltIdle. Other processes wait
+// for up to boltTimeout. A process that keeps it busy, such as a plugin
+// watching the list, lets go of it every boltHold.
+//
+// Since the indexes keep names and tags as they are, the Bolt Storage can't
+// be encrypted.
+type BoltStorage struct {
+	filename string
+
+	mu    sync.Mutex
+	db    *bolt.DB
+	users int
+	// opened is when db was opened, and yielded when it was last closed
+	// to give other processes a turn. closed is signalled whenever db is
+	// closed. idle closes db once no call has used it for boltIdle.
+	opened  time.Time
+	yielded time.Time
+	closed  *sync.Cond
+	idle    *time.Timer
+}
+
+func NewBoltStorage(filename string) Storage {
+	var err error
+
+	err = setupStorageDir()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not create storage directory: %s\n", err.Error())
+		return nil
+	}
+
+	sealer, err := newSealer()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening Bolt Storage: %s\n", err.Error())
+		return nil
+	} else if sealer != nil {
+		fmt.Fprintf(os.Stderr, "Error opening Bolt Storage: it can't be encrypted, unset EncryptionKey and EncryptionKeyFile or use another StorageType\n")
+		return nil
+	}
+
+	result := &BoltStorage{filename: filename}
+	result.closed = sync.NewCond(&result.mu)
+
+	if err = result.update(result.setup); err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening Bolt Storage: %s\n", err.Error())
+		return nil
+	}
+
+	return result
+}
+
+// setup creates the buckets, and checks the format version of an existing
+// database.
+func (s *BoltStorage) setup(tx *bolt.Tx) error {
+	for _, name := range [][]byte{boltTasks, boltTags, boltNames, boltMeta} {
+		if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+			return err
+		}
+	}
+
+	meta := tx.Bucket(boltMeta)
+
+	if b := meta.Get(boltVersionKey); b != nil {
+		if version := decodeGuid(b); version > boltFormatVersion {
+			return fmt.Errorf("Bolt Storage has format version %d, this tasker only reads up to %d", version, boltFormatVersion)
+		}
+
+		return nil
+	}
+
+	return meta.Put(boltVersionKey, encodeGuid(boltFormatVersion))
+}
+
+// open opens the database, unless it is open already. Every open must be
+// matched by a close.
+func (s *BoltStorage) open() (*bolt.DB, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.idle != nil {
+		s.idle.Stop()
+		s.idle = nil
+	}
+
+	if s.db != nil && s.users == 0 && time.Since(s.opened) > boltHold {
+		s.yield()
+	}
+
+	for s.db != nil && time.Since(s.opened) > boltHold {
+		s.closed.Wait()
+	}
+
+	for s.db == nil && time.Since(s.yielded) < boltYield {
+		s.mu.Unlock()
+		time.Sleep(boltYield - time.Since(s.yielded))
+		s.mu.Lock()
+	}
+
+	if s.db == nil {
+		db, err := bolt.Open(s.filename, 0644, &bolt.Options{Timeout: boltTimeout})
+		if err != nil {
+			return nil, fmt.Errorf("Could not open %s: %s", s.filename, err.Error())
+		}
+
+		s.db = db
+		s.opened = time.Now()
+	}
+
+	s.users++
+
+	return s.db, nil
+}
+
+// close lets go of the database. Once no call in this process is using it,
+// it is closed after boltIdle, or right away if it has been open for longer
+// than boltHold.
+func (s *BoltStorage) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.users--
+	if s.users > 0 {
+		return
+	}
+
+	if time.Since(s.opened) > boltHold {
+		s.yield()
+		return
+	}
+
+	var idle *time.Timer
+	idle = time.AfterFunc(boltIdle, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		// Unless a call took it again since
+		if s.idle == idle {
+			s.idle = nil
+			s.release()
+		}
+	})
+	s.idle = idle
+}
+
+// yield closes the database to give other processes a turn. It must be called
+// with s.mu held, and no call using the database.
+func (s *BoltStorage) yield() {
+	s.yielded = time.Now()
+	s.release()
+}
+
+// release closes the database. It must be called with s.mu held, and no call
+// using the database.
+func (s *BoltStorage) release() {
+	s.db.Close()
+	s.db = nil
+	s.closed.Broadcast()
+}
+
+func (s *BoltStorage) view(fn func(tx *bolt.Tx) error) error {
+	db, err := s.open()
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	return db.View(fn)
+}
+
+func (s *BoltStorage) update(fn func(tx *bolt.Tx) error) error {
+	db, err := s.open()
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	return db.Update(fn)
+}
+
+func (s *BoltStorage) CreateTask(t models.Task) error {
+	_, err := s.CreateTaskStored(t)
+	return err
+}
+
+func (s *BoltStorage) CreateTaskStored(t models.Task) (models.Task, error) {
+	var result models.Task
+
+	err := s.update(func(tx *bolt.Tx) error {
+		var err error
+		result, err = s.createTask(tx, t)
+		return err
+	})
+	if err != nil {
+		return t, err
+	}
+
+	return result, nil
+}
+
+func (s *BoltStorage) CreateTasks(t []models.Task) []error {
+	_, errs := s.CreateTasksStored(t)
+	return errs
+}
+
+// CreateTasksStored creates all of the given Tasks in a single transaction. If
+// any of them fails, none of them are created.
+func (s *BoltStorage) CreateTasksStored(t []models.Task) ([]models.Task, []error) {
+	var result []models.Task
+
+	err := s.update(func(tx *bolt.Tx) error {
+		for i, task := range t {
+			stored, err := s.createTask(tx, task)
+			if err != nil {
+				return fmt.Errorf("Task %d (%s): %s", i, task.Name, err.Error())
+			}
+
+			result = append(result, stored)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, []error{err}
+	}
+
+	return result, nil
+}
+
+func (s *BoltStorage) createTask(tx *bolt.Tx, t models.Task) (models.Task, error) {
+	meta := tx.Bucket(boltMeta)
+	last := decodeGuid(meta.Get(boltGuidKey))
+
+	if t.Guid != 0 {
+		if task, err := s.getTask(tx, t.Guid); err == nil {
+			return t, fmt.Errorf("Task with GUID %d already exists:\n\t%s\n", t.Guid, task.Name)
+		}
+	} else {
+		t.Guid = last + 1
+	}
+
+	// Keep the sequence past it, see guidAllocator
+	if t.Guid > last {
+		if err := meta.Put(boltGuidKey, encodeGuid(t.Guid)); err != nil {
+			return t, fmt.Errorf("BoltStorage.CreateTask: %s", err.Error())
+		}
+	}
+
+	if t.Added == nil {
+		t.Added = ptypes.TimestampNow()
+	}
+
+	if t.Parent != 0 {
+		p, err := s.getTask(tx, t.Parent)
+		if err != nil {
+			return t, fmt.Errorf("Could not add Parent %d: %s", t.Parent, err.Error())
+		}
+
+		if !containsGuid(p.Subtasks, t.Guid) {
+			old_p := p
+
+			p.Subtasks = append(p.Subtasks[:len(p.Subtasks):len(p.Subtasks)], t.Guid)
+
+			if err := s.editTask(tx, old_p, p); err != nil {
+				return t, err
+			}
+		}
+	}
+
+	return t, s.putTask(tx, t)
+}
+
+// putTask writes t and adds it to the indexes.
+func (s *BoltStorage) putTask(tx *bolt.Tx, t models.Task) error {
+	b, err := proto.Marshal(&t)
+	if err != nil {
+		return fmt.Errorf("Could not encode Task %d: %s", t.Guid, err.Error())
+	}
+
+	if err := tx.Bucket(boltTasks).Put(encodeGuid(t.Guid), b); err != nil {
+		return fmt.Errorf("BoltStorage.putTask: %s", err.Error())
+	}
+
+	if err := tx.Bucket(boltNames).Put(boltIndexKey(t.Name, t.Guid), nil); err != nil {
+		return fmt.Errorf("BoltStorage.putTask: %s", err.Error())
+	}
+
+	for _, tag := range t.Tags {
+		if err := tx.Bucket(boltTags).Put(boltIndexKey(tag, t.Guid), nil); err != nil {
+			return fmt.Errorf("BoltStorage.putTask: %s", err.Error())
+		}
+	}
+
+	return nil
+}
+
+// removeTask deletes t and takes it out of the indexes.
+func (s *BoltStorage) removeTask(tx *bolt.Tx, t models.Task) error {
+	if err := tx.Bucket(boltTasks).Delete(encodeGuid(t.Guid)); err != nil {
+		return fmt.Errorf("BoltStorage.removeTask: %s", err.Error())
+	}
+
+	if err := tx.Bucket(boltNames).Delete(boltIndexKey(t.Name, t.Guid)); err != nil {
+		return fmt.Errorf("BoltStorage.removeTask: %s", err.Error())
+	}
+
+	for _, tag := range t.Tags {
+		if err := tx.Bucket(boltTags).Delete(boltIndexKey(tag, t.Guid)); err != nil {
+			return fmt.Errorf("BoltStorage.removeTask: %s", err.Error())
+		}
+	}
+
+	return nil
+}
+
+func (s *BoltStorage) GetTask(guid uint64) (models.Task, error) {
+	if guid == 0 {
+		return models.Task{}, getZeroGuidError{}
+	}
+
+	var result models.Task
+
+	err := s.view(func(tx *bolt.Tx) error {
+		var err error
+		result, err = s.getTask(tx, guid)
+		return err
+	})
+
+	return result, err
+}
+
+func (s *BoltStorage) getTask(tx *bolt.Tx, guid uint64) (models.Task, error) {
+	var result models.Task
+
+	b := tx.Bucket(boltTasks).Get(encodeGuid(guid))
+	if b == nil {
+		return result, fmt.Errorf("BoltStorage.GetTask: guid not found %d", guid)
+	}
+
+	if err := proto.Unmarshal(b, &result); err != nil {
+		return models.Task{}, fmt.Errorf("BoltStorage.GetTask: could not decode Task %d: %s", guid, err.Error())
+	}
+
+	return result, nil
+}
+
+func (s *BoltStorage) GetByTag(tag string) []uint64 {
+	result := []uint64{}
+
+	s.viewOrWarn("GetByTag", func(tx *bolt.Tx) error {
+		result = append(result, boltIndexGuids(tx.Bucket(boltTags), tag)...)
+		return nil
+	})
+
+	return result
+}
+
+func (s *BoltStorage) GetByTags(tags []string) []uint64 {
+	result := []uint64{}
+
+	s.viewOrWarn("GetByTags", func(tx *bolt.Tx) error {
+		for _, tag := range tags {
+			guids := boltIndexGuids(tx.Bucket(boltTags), tag)
+			if len(guids) == 0 {
+				fmt.Fprintf(os.Stderr, "Could not find tasks with tag '%s'\n", tag)
+			}
+
+			result = append(result, guids...)
+		}
+
+		return nil
+	})
+
+	return result
+}
+
+func (s *BoltStorage) GetByName(name string) []uint64 {
+	var result []uint64
+
+	s.viewOrWarn("GetByName", func(tx *bolt.Tx) error {
+		result = boltIndexGuids(tx.Bucket(boltNames), name)
+		return nil
+	})
+
+	return result
+}
+
+func (s *BoltStorage) GetAllTasks() []uint64 {
+	result := []uint64{}
+
+	s.viewOrWarn("GetAllTasks", func(tx *bolt.Tx) error {
+		return tx.Bucket(boltTasks).ForEach(func(k, _ []byte) error {
+			result = append(result, decodeGuid(k))
+			return nil
+		})
+	})
+
+	return result
+}
+
+func (s *BoltStorage) GetAllTags() []string {
+	result := []string{}
+
+	s.viewOrWarn("GetAllTags", func(tx *bolt.Tx) error {
+		seen := map[string]bool{}
+
+		return tx.Bucket(boltTags).ForEach(func(k, _ []byte) error {
+			tag, _ := splitBoltIndexKey(k)
+			if !seen[tag] {
+				seen[tag] = true
+				result = append(result, tag)
+			}
+
+			return nil
+		})
+	})
+
+	return result
+}
+
+// viewOrWarn runs fn for the methods of Storage that can't return an error,
+// and prints the error instead.
+func (s *BoltStorage) viewOrWarn(method string, fn func(tx *bolt.Tx) error) {
+	if err := s.view(fn); err != nil {
+		fmt.Fprintf(os.Stderr, "BoltStorage.%s: %s\n", method, err.Error())
+	}
+}
+
+func (s *BoltStorage) EditTask(oldTask, newTask models.Task) error {
+	return s.update(func(tx *bolt.Tx) error {
+		return s.editTask(tx, oldTask, newTask)
+	})
+}
+
+func (s *BoltStorage) editTask(tx *bolt.Tx, oldTask, newTask models.Task) error {
+	if oldTask.Guid != newTask.Guid {
+		return fmt.Errorf("Cannot change the GUID of a Task.")
+	}
+
+	// The indexes have what is stored, which may differ from the caller's
+	// copy in fields the Storage fills in
+	current, err := s.getTask(tx, oldTask.Guid)
+	if err != nil {
+		return fmt.Errorf("BoltStorage.EditTask: Guid %d not found.", oldTask.Guid)
+	}
+
+	if oldTask.Revision != current.Revision {
+		return ConflictError{Guid: oldTask.Guid, Revision: oldTask.Revision, Current: current.Revision}
+	}
+
+	if !proto.Equal(current.Added, newTask.Added) {
+		return fmt.Errorf("Cannot change the add date of a Task")
+	}
+
+	newTask.Revision = current.Revision + 1
+
+	if err := s.removeTask(tx, current); err != nil {
+		return err
+	}
+
+	return s.putTask(tx, newTask)
+}
+
+// DeleteTask deletes a Task, and takes it off the subtasks and dependencies
+// of other Tasks, in a single transaction.
+func (s *BoltStorage) DeleteTask(guid uint64) error {
+	_, err := s.DeleteTaskUnlinked(guid)
+	return err
+}
+
+func (s *BoltStorage) DeleteTaskUnlinked(guid uint64) ([]models.Task, error) {
+	var unlinked []models.Task
+
+	err := s.update(func(tx *bolt.Tx) error {
+		task, err := s.getTask(tx, guid)
+		if err != nil {
+			return fmt.Errorf("BoltStorage.DeleteTask: Guid %d not found.", guid)
+		}
+
+		if err := s.removeTask(tx, task); err != nil {
+			return err
+		}
+
+		referrers, err := s.referrers(tx, guid)
+		if err != nil {
+			return err
+		}
+
+		for _, ref := range referrers {
+			edited := ref
+			edited.Subtasks = withoutGuid(ref.Subtasks, guid)
+			edited.Dependencies = withoutGuid(ref.Dependencies, guid)
+
+			if err := s.editTask(tx, ref, edited); err != nil {
+				return err
+			}
+		}
+
+		unlinked = referrers
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return unlinked, nil
+}
+
+// referrers returns the Tasks that have guid as a subtask or a dependency.
+func (s *BoltStorage) referrers(tx *bolt.Tx, guid uint64) ([]models.Task, error) {
+	var result []models.Task
+
+	err := tx.Bucket(boltTasks).ForEach(func(k, v []byte) error {
+		var task models.Task
+		if err := proto.Unmarshal(v, &task); err != nil {
+			return fmt.Errorf("BoltStorage.DeleteTask: could not decode Task %d: %s", decodeGuid(k), err.Error())
+		}
+
+		if containsGuid(task.Subtasks, guid) || containsGuid(task.Dependencies, guid) {
+			result = append(result, task)
+		}
+
+		return nil
+	})
+
+	return result, err
+}
+
+func encodeGuid(guid uint64) []byte {
+	result := make([]byte, 8)
+	binary.BigEndian.PutUint64(result, guid)
+
+	return result
+}
+
+func decodeGuid(b []byte) uint64 {
+	if len(b) != 8 {
+		return 0
+	}
+
+	return binary.BigEndian.Uint64(b)
+}
+
+// boltIndexKey is the key of a Task in the tag or name index. The 0 keeps
+// the key from being empty, which bbolt doesn't allow, for Tasks without a
+// name.
+func boltIndexKey(value string, guid uint64) []byte {
+	result := make([]byte, 0, len(value)+9)
+	result = append(result, value...)
+	result = append(result, 0)
+
+	return append(result, encodeGuid(guid)...)
+}
+
+func splitBoltIndexKey(k []byte) (string, uint64) {
+	if len(k) < 9 {
+		return "", 0
+	}
+
+	return string(k[:len(k)-9]), decodeGuid(k[len(k)-8:])
+}
+
+// boltIndexGuids returns the GUIDs under value in an index, in order.
+func boltIndexGuids(index *bolt.Bucket, value string) []uint64 {
+	var result []uint64
+
+	prefix := append([]byte(value), 0)
+
+	c := index.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		// Longer values can start with this one, and a 0
+		if len(k) == len(prefix)+8 {
+			result = append(result, decodeGuid(k[len(prefix):]))
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,42 @@
+package storage_test
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/oatmealraisin/tasker/pkg/models"
+	"github.com/oatmealraisin/tasker/pkg/storage"
+	"github.com/spf13/viper"
+)
+
+// BenchmarkBoltStorageList lists 10,000 Tasks the way tasker get does, one
+// GetTask per Task.
+func BenchmarkBoltStorageList(b *testing.B) {
+	dir := b.TempDir()
+	viper.Set("WorkingDir", dir)
+
+	s := storage.NewBoltStorage(filepath.Join(dir, "tasklist.bolt"))
+	if s == nil {
+		b.Fatal("Could not open the Bolt Storage")
+	}
+
+	tasks := make([]models.Task, 10000)
+	for i := range tasks {
+		tasks[i] = models.Task{Name: fmt.Sprintf("task %d", i), Tags: []string{"bench"}}
+	}
+
+	if errs := s.CreateTasks(tasks); len(errs) > 0 {
+		b.Fatal(errs)
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		for _, guid := range s.GetAllTasks() {
+			if _, err := s.GetTask(guid); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
@@ -3,7 +3,11 @@ package storage
 import (
 	"fmt"
 	"os"
+	"sort"
+	"sync"
 
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
 	"github.com/oatmealraisin/tasker/pkg/models"
 )
 
@@ -13,26 +17,63 @@ func (e getZeroGuidError) Error() string {
 	return "GUID 0 is reserved, cannot get"
 }
 
+// IsZeroGuidError reports whether err is the error a Storage returns when
+// asked for GUID 0.
+func IsZeroGuidError(err error) bool {
+	_, ok := err.(getZeroGuidError)
+	return ok
+}
+
+// bufferStorage keeps Tasks in memory, indexed by GUID, tag, name, due date,
+// priority and score. It is safe to use from several goroutines: the exported
+// methods take mu themselves, while the unexported ones expect the caller to
+// hold it, so that embedding types can make several changes at once.
 type bufferStorage struct {
+	mu sync.RWMutex
+
 	buffer_guid   map[uint64]*models.Task
 	buffer_tag    map[string][]uint64
 	buffer_name   map[string][]uint64
-	sort_priority []*models.Task
+	sort_due      *taskIndex
+	sort_priority *taskIndex
+	sort_score    *scoreIndex
 	queue         []models.Task
+
+	// guids outlives reset, so GUIDs of deleted Tasks stay used
+	guids *guidAllocator
+
+	// refresh is set by embedding types whose Tasks can be changed by
+	// other processes, to catch up with them before reading, see rlock.
+	refresh func()
 }
 
 func newBufferStorage() *bufferStorage {
-	return &bufferStorage{
-		buffer_guid:   map[uint64]*models.Task{},
-		buffer_tag:    map[string][]uint64{},
-		buffer_name:   map[string][]uint64{},
-		sort_priority: []*models.Task{},
-		queue:         []models.Task{},
-	}
+	result := &bufferStorage{guids: &guidAllocator{}}
+	result.reset()
+
+	return result
+}
+
+// reset empties the buffers. Embedding types reset them rather than replacing
+// them, so that nobody is left holding the lock of an old bufferStorage.
+func (b *bufferStorage) reset() {
+	b.buffer_guid = map[uint64]*models.Task{}
+	b.buffer_tag = map[string][]uint64{}
+	b.buffer_name = map[string][]uint64{}
+	b.queue = []models.Task{}
+
+	b.sort_due = newTaskIndex(b.buffer_guid, hasDueDate, dueBefore)
+	b.sort_priority = newTaskIndex(b.buffer_guid, nil, morePriority)
+	b.sort_score = newScoreIndex(b.buffer_guid)
 }
 
 func (b *bufferStorage) updateBuffers(p_t *models.Task) {
 	b.buffer_guid[p_t.Guid] = p_t
+	b.guids.observe(p_t.Guid)
+
+	b.sort_due.insert(p_t)
+	b.sort_priority.insert(p_t)
+	b.sort_score.dirty = true
 
 	b.buffer_name[p_t.Name] = append(b.buffer_name[p_t.Name], p_t.Guid)
 
@@ -41,18 +82,194 @@ func (b *bufferStorage) updateBuffers(p_t *models.Task) {
 	}
 }
 
+// createTask fills in the GUID and add date of a new Task, links it to its
+// parent and adds it to the buffers. It returns the Task as it was buffered.
+func (b *bufferStorage) createTask(t models.Task) (models.Task, error) {
+	if t.Guid != 0 {
+		if task, ok := b.buffer_guid[t.Guid]; ok {
+			return t, fmt.Errorf("Task with GUID %d already exists:\n\t%s\n", t.Guid, task.Name)
+		}
+	} else {
+		t.Guid = b.guids.next()
+	}
+
+	if t.Added == nil {
+		t.Added = ptypes.TimestampNow()
+	}
+
+	if t.Parent != 0 {
+		p, err := b.getTask(t.Parent)
+		if err != nil {
+			return t, fmt.Errorf("Could not add Parent %d: %s", t.Parent, err.Error())
+		}
+
+		if !containsGuid(p.Subtasks, t.Guid) {
+			old_p := p
+
+			p.Subtasks = append(p.Subtasks[:len(p.Subtasks):len(p.Subtasks)], t.Guid)
+
+			if err := b.editTask(old_p, p); err != nil {
+				return t, err
+			}
+		}
+	}
+
+	b.updateBuffers(&t)
+
+	return t, nil
+}
+
+// putTask buffers t as it is, replacing any Task with the same GUID.
+func (b *bufferStorage) putTask(t models.Task) {
+	if _, ok := b.buffer_guid[t.Guid]; ok {
+		b.unbuffer(t.Guid)
+	}
+
+	b.updateBuffers(&t)
+}
+
+// rlock takes the read lock on the buffers, once they have caught up with any
+// changes made by other processes.
+func (b *bufferStorage) rlock() {
+	if b.refresh != nil {
+		b.refresh()
+	}
+
+	b.mu.RLock()
+}
+
+func (b *bufferStorage) GetTask(guid uint64) (models.Task, error) {
+	b.rlock()
+	defer b.mu.RUnlock()
+
+	return b.getTask(guid)
+}
+
+func (b *bufferStorage) getTask(guid uint64) (models.Task, error) {
+	if guid == 0 {
+		return models.Task{}, getZeroGuidError{}
+	}
+
+	if task, ok := b.buffer_guid[guid]; ok {
+		return *task, nil
+	}
+
+	return models.Task{}, fmt.Errorf("bufferStorage.GetTask: guid not found %d", guid)
+}
+
+func (b *bufferStorage) GetByTag(tag string) []uint64 {
+	b.rlock()
+	defer b.mu.RUnlock()
+
+	return b.getByTag(tag)
+}
+
+func (b *bufferStorage) getByTag(tag string) []uint64 {
+	return append([]uint64{}, b.buffer_tag[tag]...)
+}
+
+func (b *bufferStorage) GetByName(name string) []uint64 {
+	b.rlock()
+	defer b.mu.RUnlock()
+
+	if len(b.buffer_name[name]) == 0 {
+		return nil
+	}
+
+	return append([]uint64{}, b.buffer_name[name]...)
+}
+
+func (b *bufferStorage) GetAllTasks() []uint64 {
+	b.rlock()
+	defer b.mu.RUnlock()
+
+	return b.getAllTasks()
+}
+
+func (b *bufferStorage) getAllTasks() []uint64 {
+	result := make([]uint64, 0, len(b.buffer_guid))
+	for k := range b.buffer_guid {
+		result = append(result, k)
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+
+	return result
+}
+
+// sortedTasks returns every buffered Task, ordered by GUID.
+func (b *bufferStorage) sortedTasks() []models.Task {
+	result := make([]models.Task, 0, len(b.buffer_guid))
+	for _, guid := range b.getAllTasks() {
+		result = append(result, *b.buffer_guid[guid])
+	}
+
+	return result
+}
+
 func (b *bufferStorage) DeleteTask(guid uint64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, err := b.deleteTask(guid)
+	return err
+}
+
+// deleteTask deletes a Task, and takes it off the subtasks and dependencies of
+// the other buffered Tasks, which are at their next revision after that, like
+// the SQL Storages do. It returns those Tasks as they were before.
+func (b *bufferStorage) deleteTask(guid uint64) ([]models.Task, error) {
 	if _, ok := b.buffer_guid[guid]; !ok {
-		return fmt.Errorf("bufferStorage.DeleteTask: Guid %d not found.", guid)
+		return nil, fmt.Errorf("bufferStorage.DeleteTask: Guid %d not found.", guid)
+	}
+
+	b.unbuffer(guid)
+
+	var unlinked []models.Task
+	for _, ref := range b.referrers(guid) {
+		task := *b.buffer_guid[ref]
+
+		edited := task
+		edited.Subtasks = withoutGuid(task.Subtasks, guid)
+		edited.Dependencies = withoutGuid(task.Dependencies, guid)
+
+		// Can't fail, we have the current revision
+		b.editTask(task, edited)
+		unlinked = append(unlinked, task)
+	}
+
+	return unlinked, nil
+}
+
+// unbuffer takes a Task out of the buffers, and leaves the Tasks that refer to
+// it as they are.
+func (b *bufferStorage) unbuffer(guid uint64) {
+	task, ok := b.buffer_guid[guid]
+	if !ok {
+		return
 	}
-	task, _ := b.buffer_guid[guid]
+
+	b.sort_due.remove(task)
+	b.sort_priority.remove(task)
+	b.sort_score.dirty = true
 
 	delete(b.buffer_guid, guid)
 
 	b.removeTaskFromTagBuffer(*task)
 	b.removeTaskFromNameBuffer(*task)
+}
 
-	return nil
+// referrers returns the buffered Tasks that have guid as a subtask or a
+// dependency, ordered by GUID.
+func (b *bufferStorage) referrers(guid uint64) []uint64 {
+	var result []uint64
+	for _, task := range b.sortedTasks() {
+		if containsGuid(task.Subtasks, guid) || containsGuid(task.Dependencies, guid) {
+			result = append(result, task.Guid)
+		}
+	}
+
+	return result
 }
 
 func (b *bufferStorage) removeTaskFromTagBuffer(task models.Task) {
@@ -69,6 +286,22 @@ func (b *bufferStorage) removeTaskFromNameBuffer(task models.Task) {
 	}
 }
 
+// withoutGuid returns a copy of l without u, in the same order.
+func withoutGuid(l []uint64, u uint64) []uint64 {
+	if !containsGuid(l, u) {
+		return l
+	}
+
+	result := make([]uint64, 0, len(l)-1)
+	for _, guid := range l {
+		if guid != u {
+			result = append(result, guid)
+		}
+	}
+
+	return result
+}
+
 func removeUuid(l []uint64, u uint64) []uint64 {
 	for i, uuid := range l {
 		if u == uuid {
@@ -81,18 +314,29 @@ func removeUuid(l []uint64, u uint64) []uint64 {
 }
 
 func (b *bufferStorage) GetAllTags() []string {
-	result := make([]string, len(b.buffer_tag))
+	b.rlock()
+	defer b.mu.RUnlock()
+
+	return b.getAllTags()
+}
+
+func (b *bufferStorage) getAllTags() []string {
+	result := make([]string, 0, len(b.buffer_tag))
 
-	i := 0
-	for k := range b.buffer_tag {
-		result[i] = k
-		i++
+	for k, guids := range b.buffer_tag {
+		// Tags stay in the buffer after their last Task is gone
+		if len(guids) > 0 {
+			result = append(result, k)
+		}
 	}
 
 	return result
 }
 
 func (b *bufferStorage) GetByTags(tags []string) []uint64 {
+	b.rlock()
+	defer b.mu.RUnlock()
+
 	result := []uint64{}
 	for _, tag := range tags {
 		if tasks, ok := b.buffer_tag[tag]; ok {
@@ -106,16 +350,39 @@ func (b *bufferStorage) GetByTags(tags []string) []uint64 {
 }
 
 func (b *bufferStorage) EditTask(oldTask, newTask models.Task) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.editTask(oldTask, newTask)
+}
+
+func (b *bufferStorage) editTask(oldTask, newTask models.Task) error {
 	if oldTask.Guid != newTask.Guid {
 		return fmt.Errorf("Cannot change the GUID of a Task.")
 	}
 
-	if oldTask.Added != newTask.Added {
+	current, ok := b.buffer_guid[oldTask.Guid]
+	if !ok {
+		return fmt.Errorf("bufferStorage.EditTask: Guid %d not found.", oldTask.Guid)
+	}
+
+	if oldTask.Revision != current.Revision {
+		return ConflictError{Guid: oldTask.Guid, Revision: oldTask.Revision, Current: current.Revision}
+	}
+
+	// The buffers are indexed by what we have, which may differ from the
+	// caller's copy in fields the Storage fills in
+	oldTask = *current
+
+	if !proto.Equal(oldTask.Added, newTask.Added) {
 		return fmt.Errorf("Cannot change the add date of a Task")
 	}
 
+	newTask.Revision = current.Revision + 1
+
 	if oldTask.Name != newTask.Name {
 		b.removeTaskFromNameBuffer(oldTask)
+		b.buffer_name[newTask.Name] = append(b.buffer_name[newTask.Name], newTask.Guid)
 	}
 
 	tagList := make(map[string]bool)
@@ -135,7 +402,14 @@ func (b *bufferStorage) EditTask(oldTask, newTask models.Task) error {
 		b.buffer_tag[tag] = removeUuid(b.buffer_tag[tag], oldTask.Guid)
 	}
 
+	b.sort_due.remove(current)
+	b.sort_priority.remove(current)
+
 	b.buffer_guid[oldTask.Guid] = &newTask
 
+	b.sort_due.insert(&newTask)
+	b.sort_priority.insert(&newTask)
+	b.sort_score.dirty = true
+
 	return nil
 }
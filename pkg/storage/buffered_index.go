@@ -0,0 +1,181 @@
+package storage
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/oatmealraisin/tasker/pkg/models"
+)
+
+// scoreTTL is how long scores are reused for. Scores depend on the time, so
+// the score index goes stale even if no Task changes.
+const scoreTTL = time.Minute
+
+// taskIndex keeps the GUIDs of the buffered Tasks that include lets in sorted
+// by less, which must order any two different Tasks, usually by falling back
+// on their GUIDs.
+type taskIndex struct {
+	guids   []uint64
+	tasks   map[uint64]*models.Task
+	include func(t *models.Task) bool
+	less    func(a, b *models.Task) bool
+}
+
+func newTaskIndex(tasks map[uint64]*models.Task, include func(*models.Task) bool, less func(a, b *models.Task) bool) *taskIndex {
+	return &taskIndex{
+		guids:   []uint64{},
+		tasks:   tasks,
+		include: include,
+		less:    less,
+	}
+}
+
+// search returns where t is, or would be, in the index. The index must still
+// point at the same version of t.
+func (x *taskIndex) search(t *models.Task) (int, bool) {
+	if x.include != nil && !x.include(t) {
+		return 0, false
+	}
+
+	return sort.Search(len(x.guids), func(i int) bool {
+		return !x.less(x.tasks[x.guids[i]], t)
+	}), true
+}
+
+func (x *taskIndex) insert(t *models.Task) {
+	i, ok := x.search(t)
+	if !ok {
+		return
+	}
+
+	x.guids = append(x.guids, 0)
+	copy(x.guids[i+1:], x.guids[i:])
+	x.guids[i] = t.Guid
+}
+
+// remove must be called before t is replaced in the buffers.
+func (x *taskIndex) remove(t *models.Task) {
+	i, ok := x.search(t)
+	if !ok || i >= len(x.guids) || x.guids[i] != t.Guid {
+		return
+	}
+
+	x.guids = append(x.guids[:i], x.guids[i+1:]...)
+}
+
+func hasDueDate(t *models.Task) bool {
+	_, err := ptypes.Timestamp(t.Due)
+	return err == nil
+}
+
+// dueBefore orders Tasks by due date, soonest first.
+func dueBefore(a, b *models.Task) bool {
+	aDue, _ := ptypes.Timestamp(a.Due)
+	bDue, _ := ptypes.Timestamp(b.Due)
+
+	if !aDue.Equal(bDue) {
+		return aDue.Before(bDue)
+	}
+
+	return a.Guid < b.Guid
+}
+
+// morePriority orders Tasks by priority, highest first.
+func morePriority(a, b *models.Task) bool {
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+
+	return a.Guid < b.Guid
+}
+
+// scoreIndex keeps the GUIDs of buffered Tasks sorted by score, highest first.
+// Rather than being kept up to date, it is rebuilt when it is used after a
+// change, or once scoreTTL has passed. That happens under a read lock of the
+// buffers, so it has a lock of its own.
+type scoreIndex struct {
+	mu     sync.Mutex
+	guids  []uint64
+	tasks  map[uint64]*models.Task
+	scored time.Time
+	dirty  bool
+}
+
+func newScoreIndex(tasks map[uint64]*models.Task) *scoreIndex {
+	return &scoreIndex{tasks: tasks, dirty: true}
+}
+
+// sorted returns the GUIDs by score. The result must not be changed.
+func (x *scoreIndex) sorted() []uint64 {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if !x.dirty && time.Since(x.scored) < scoreTTL {
+		return x.guids
+	}
+
+	scores := make(map[uint64]float64, len(x.tasks))
+	x.guids = make([]uint64, 0, len(x.tasks))
+
+	for guid, task := range x.tasks {
+		scores[guid] = task.Score()
+		x.guids = append(x.guids, guid)
+	}
+
+	sort.Slice(x.guids, func(i, j int) bool {
+		a, b := x.guids[i], x.guids[j]
+		if scores[a] != scores[b] {
+			return scores[a] > scores[b]
+		}
+
+		return a < b
+	})
+
+	x.scored = time.Now()
+	x.dirty = false
+
+	return x.guids
+}
+
+// NextDue returns up to n Tasks matching q with the soonest due dates. Tasks
+// without a due date are left out. If n is 0, it returns all of them.
+func (b *bufferStorage) NextDue(n int, q Query) ([]uint64, error) {
+	b.rlock()
+	defer b.mu.RUnlock()
+
+	return b.firstMatching(b.sort_due.guids, n, q), nil
+}
+
+// TopByPriority returns up to n Tasks matching q with the highest priority.
+func (b *bufferStorage) TopByPriority(n int, q Query) ([]uint64, error) {
+	b.rlock()
+	defer b.mu.RUnlock()
+
+	return b.firstMatching(b.sort_priority.guids, n, q), nil
+}
+
+// TopByScore returns up to n Tasks matching q with the highest score.
+func (b *bufferStorage) TopByScore(n int, q Query) ([]uint64, error) {
+	b.rlock()
+	defer b.mu.RUnlock()
+
+	return b.firstMatching(b.sort_score.sorted(), n, q), nil
+}
+
+func (b *bufferStorage) firstMatching(guids []uint64, n int, q Query) []uint64 {
+	result := []uint64{}
+
+	for _, guid := range guids {
+		if n > 0 && len(result) >= n {
+			break
+		}
+
+		if q.Matches(*b.buffer_guid[guid]) {
+			result = append(result, guid)
+		}
+	}
+
+	return result
+}
@@ -1,22 +1,43 @@
 package storage
 
 import (
+	"bytes"
 	"encoding/csv"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/golang/protobuf/ptypes"
+	tspb "github.com/golang/protobuf/ptypes/timestamp"
 	"github.com/oatmealraisin/tasker/pkg/models"
 	"github.com/oatmealraisin/tasker/pkg/util"
 )
 
 type CsvStorage struct {
 	*bufferStorage
-	f *os.File
+	// f is the version of the storage file the buffers and index were read
+	// from, decrypted into memory if the file is encrypted, see sealer.
+	f      csvSource
+	file   *lockedFile
+	sealer *sealer
+	// unsealed is set when the storage file or journal isn't encrypted yet,
+	// but should be, so the next change rewrites them.
+	unsealed bool
+
+	// layout is how the columns of the storage file are laid out, read from
+	// its header
+	layout *csvLayout
+	// index finds the Tasks that didn't fit in the buffers, see csv_index.go
+	index *csvIndex
+
+	// Changes are appended to the journal instead of rewriting the whole
+	// storage file, see csv_journal.go
+	journal *csvJournal
 }
 
 func NewCsvStorage(filename string) Storage {
@@ -27,21 +48,272 @@ func NewCsvStorage(filename string) Storage {
 		return nil
 	}
 
-	newDb, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	file, err := openLockedFile(filename)
+	if err != nil {
+		return nil
+	}
+
+	sealer, err := newSealer()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening CSV Storage: %s\n", err.Error())
+		return nil
+	}
+
+	journal, err := openCsvJournal(filename+".journal", sealer)
 	if err != nil {
 		return nil
 	}
 
 	result := new(CsvStorage)
 	result.bufferStorage = newBufferStorage()
-	result.f = newDb
+	result.guids = newGuidAllocator(filename + ".guid")
+	result.file = file
+	result.file.release = result.closeSource
+	result.sealer = sealer
+	result.journal = journal
+	result.refresh = result.catchUp
+
+	if err = result.file.RLock(); err != nil {
+		return nil
+	}
+	defer result.file.Unlock()
 
-	result.loadTasks(10000)
+	if err = result.reload(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading CSV Storage: %s\n", err.Error())
+		return nil
+	}
 
 	return result
 }
 
+// reload throws away the buffers and reads the storage file and its journal
+// again. It must be called with the write lock on the buffers held.
+func (c *CsvStorage) reload() error {
+	newDb, err := c.file.Open()
+	if err != nil {
+		return err
+	}
+
+	source, sealed, err := c.source(newDb)
+	if err != nil {
+		return err
+	}
+
+	c.closeSource()
+
+	c.reset()
+	c.index = newCsvIndex()
+	c.f = source
+
+	if err = c.loadTasks(csvBufferSize); err != nil {
+		return err
+	}
+
+	for guid := range c.index.entries {
+		c.guids.observe(guid)
+	}
+
+	if err = c.journal.replay(c.bufferStorage); err != nil {
+		return err
+	}
+
+	// The journal has the latest version of these, if they still exist
+	for guid := range c.journal.guids {
+		c.index.remove(guid)
+	}
+
+	c.unsealed = c.journal.unsealed || (c.sealer != nil && !sealed && c.file.loaded.Size() > 0)
+
+	return nil
+}
+
+// closeSource closes the version of the storage file that was read, before
+// reload opens the next one, or writeAll replaces it.
+func (c *CsvStorage) closeSource() {
+	if c.f != nil {
+		c.f.Close()
+		c.f = nil
+	}
+}
+
+// csvSource is what CsvStorage reads Tasks from: either the storage file
+// itself, or its decrypted content.
+type csvSource interface {
+	io.Reader
+	io.ReaderAt
+	io.Closer
+}
+
+type csvPlaintext struct {
+	*bytes.Reader
+}
+
+func (csvPlaintext) Close() error {
+	return nil
+}
+
+// source decrypts the storage file f into memory if it is encrypted, and
+// reports whether it was. Otherwise Tasks are read from f as they are needed.
+func (c *CsvStorage) source(f *os.File) (csvSource, bool, error) {
+	magic := make([]byte, len(sealedFileMagic))
+	if n, _ := f.ReadAt(magic, 0); string(magic[:n]) != sealedFileMagic {
+		return f, false, nil
+	}
+	defer f.Close()
+
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, true, err
+	}
+
+	if b, err = c.sealer.openFile(b); err != nil {
+		return nil, true, err
+	}
+
+	return csvPlaintext{bytes.NewReader(b)}, true, nil
+}
+
+// begin takes the write locks on the buffers and the storage file, and
+// catches up with any changes another process made since we last read it. The
+// caller must call c.end when it is done.
+func (c *CsvStorage) begin() error {
+	c.mu.Lock()
+
+	if err := c.file.Lock(); err != nil {
+		c.mu.Unlock()
+		return err
+	}
+
+	if c.file.Changed() || c.journal.Changed() {
+		if err := c.reload(); err != nil {
+			c.end()
+			return err
+		}
+	}
+
+	// A torn entry at the end of the journal would swallow the next one, and
+	// once there is a key, nothing should stay unencrypted
+	if c.journal.corrupt || c.unsealed {
+		if err := c.compact(); err != nil {
+			c.end()
+			return err
+		}
+	}
+
+	if err := c.guids.load(); err != nil {
+		c.end()
+		return err
+	}
+
+	return nil
+}
+
+func (c *CsvStorage) end() {
+	c.file.Unlock()
+	c.mu.Unlock()
+}
+
+// catchUp reloads the buffers if another process wrote the storage file or
+// its journal since we last read them. If it can't, the buffers are kept as
+// they are.
+func (c *CsvStorage) catchUp() {
+	c.mu.RLock()
+	changed := c.file.Changed() || c.journal.Changed()
+	c.mu.RUnlock()
+
+	if !changed {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err := c.file.RLock()
+	if err == nil {
+		if c.file.Changed() || c.journal.Changed() {
+			err = c.reload()
+		}
+
+		c.file.Unlock()
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "CsvStorage: could not read the changes of another process: %s\n", err.Error())
+	}
+}
+
+// record appends changes to the journal, folding the journal back into the
+// storage file once it gets long. It must be called with the write lock held.
+//
+// The changes are saved once they are in the journal, so if folding it fails,
+// that is only a warning, and it is tried again with the next change.
+func (c *CsvStorage) record(entries ...csvJournalEntry) error {
+	if err := c.guids.save(); err != nil {
+		return err
+	}
+
+	if err := c.journal.append(entries...); err != nil {
+		return err
+	}
+
+	if c.journal.entries >= csvJournalCompactAfter {
+		if err := c.compact(); err != nil {
+			fmt.Fprintf(os.Stderr, "CsvStorage: the changes are saved in the journal, but could not fold it into the storage file: %s\n", err.Error())
+		}
+	}
+
+	return nil
+}
+
+// compact rewrites the storage file with everything in the journal, then
+// empties the journal. If we crash in between, replaying the journal again is
+// harmless.
+func (c *CsvStorage) compact() error {
+	if err := c.writeAll(); err != nil {
+		// writeAll may have closed the file the index points into, and
+		// left the old version in place
+		if rerr := c.reload(); rerr != nil {
+			fmt.Fprintf(os.Stderr, "Error reading CSV Storage: %s\n", rerr.Error())
+		}
+
+		return err
+	}
+
+	if err := c.journal.truncate(); err != nil {
+		return err
+	}
+
+	// The index points into the file we just replaced
+	return c.reload()
+}
+
+// buffer moves a Task that is only in the index into the buffers, so it can be
+// changed. It must be called with the write lock held.
+func (c *CsvStorage) buffer(guid uint64) error {
+	if _, ok := c.index.entries[guid]; !ok {
+		return nil
+	}
+
+	task, err := c.getTaskFromFile(guid)
+	if err != nil {
+		return err
+	}
+
+	c.index.remove(guid)
+	c.queue = append(c.queue, task)
+	c.updateBuffers(&c.queue[len(c.queue)-1])
+
+	return nil
+}
+
 func (c *CsvStorage) GetTask(guid uint64) (models.Task, error) {
+	c.rlock()
+	defer c.mu.RUnlock()
+
+	return c.getTask(guid)
+}
+
+func (c *CsvStorage) getTask(guid uint64) (models.Task, error) {
 	if guid == 0 {
 		return models.Task{}, getZeroGuidError{}
 	}
@@ -54,79 +326,230 @@ func (c *CsvStorage) GetTask(guid uint64) (models.Task, error) {
 }
 
 func (c *CsvStorage) GetByTag(tag string) []uint64 {
-	panic("not implemented")
+	c.rlock()
+	defer c.mu.RUnlock()
+
+	return c.getByTag(tag)
+}
+
+func (c *CsvStorage) getByTag(tag string) []uint64 {
+	return append(c.bufferStorage.getByTag(tag), c.index.tags[tag]...)
+}
+
+func (c *CsvStorage) GetByTags(tags []string) []uint64 {
+	c.rlock()
+	defer c.mu.RUnlock()
+
+	result := []uint64{}
+	for _, tag := range tags {
+		if tasks := c.getByTag(tag); len(tasks) > 0 {
+			result = append(result, tasks...)
+		} else {
+			fmt.Fprintf(os.Stderr, "Could not find tasks with tag '%s'\n", tag)
+		}
+	}
+
+	return result
 }
 
 func (s *CsvStorage) GetByName(name string) []uint64 {
-	result := make([]uint64, len(s.buffer_name[name]))
+	s.rlock()
+	defer s.mu.RUnlock()
+
+	result := make([]uint64, 0, len(s.buffer_name[name])+len(s.index.names[name]))
+	result = append(result, s.buffer_name[name]...)
+	result = append(result, s.index.names[name]...)
+
 	if len(result) == 0 {
 		return nil
 	}
 
-	for i, uuid := range s.buffer_name[name] {
-		result[i] = uuid
+	return result
+}
+
+func (c *CsvStorage) GetAllTags() []string {
+	c.rlock()
+	defer c.mu.RUnlock()
+
+	result := c.getAllTags()
+	for tag, guids := range c.index.tags {
+		if _, ok := c.buffer_tag[tag]; !ok && len(guids) > 0 {
+			result = append(result, tag)
+		}
 	}
 
 	return result
 }
 
 func (c *CsvStorage) GetAllTasks() []uint64 {
-	// NOTE: For now, we load everything into memory
-	var result []uint64
-	var uuid uint64
+	c.rlock()
+	defer c.mu.RUnlock()
+
+	return c.getAllTasks()
+}
+
+func (c *CsvStorage) getAllTasks() []uint64 {
+	result := make([]uint64, 0, len(c.buffer_guid)+len(c.index.entries))
+	for guid := range c.buffer_guid {
+		result = append(result, guid)
+	}
+
+	for guid := range c.index.entries {
+		result = append(result, guid)
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+
+	return result
+}
+
+// indexed reports whether some Tasks are only in the index, in which case the
+// buffer's indexes can't rank them.
+func (c *CsvStorage) indexed() bool {
+	c.rlock()
+	defer c.mu.RUnlock()
+
+	return len(c.index.entries) > 0
+}
 
-	_, err := c.f.Seek(0, 0)
+// NextDue uses the buffer's indexes when every Task is buffered, see Ranker.
+func (c *CsvStorage) NextDue(n int, q Query) ([]uint64, error) {
+	if c.indexed() {
+		return rankTasks(c, n, q, hasDueDate, dueBefore)
+	}
+
+	return c.bufferStorage.NextDue(n, q)
+}
+
+func (c *CsvStorage) TopByPriority(n int, q Query) ([]uint64, error) {
+	if c.indexed() {
+		return rankTasks(c, n, q, nil, morePriority)
+	}
+
+	return c.bufferStorage.TopByPriority(n, q)
+}
+
+func (c *CsvStorage) TopByScore(n int, q Query) ([]uint64, error) {
+	if c.indexed() {
+		return rankTasks(c, n, q, nil, nil)
+	}
+
+	return c.bufferStorage.TopByScore(n, q)
+}
+
+func (c *CsvStorage) CreateTask(t models.Task) error {
+	_, err := c.CreateTaskStored(t)
+	return err
+}
+
+func (c *CsvStorage) CreateTaskStored(t models.Task) (models.Task, error) {
+	if err := c.begin(); err != nil {
+		return t, fmt.Errorf("CsvStorage.CreateTask: %s", err.Error())
+	}
+	defer c.end()
+
+	entries, err := c.createTask(t)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error resetting task file: %s\n", err.Error())
+		return t, err
 	}
 
-	r := csv.NewReader(c.f)
+	if err := c.record(entries...); err != nil {
+		return t, fmt.Errorf("CsvStorage.CreateTask: %s", err.Error())
+	}
 
-	for {
-		record, err := r.Read()
-		if err == io.EOF {
-			return result
-		}
+	return entries[len(entries)-1].task, nil
+}
+
+func (c *CsvStorage) CreateTasks(t []models.Task) []error {
+	_, errs := c.CreateTasksStored(t)
+	return errs
+}
+
+// CreateTasksStored creates all of the given Tasks, in a single journal batch.
+// If any of them fails, none of them are created.
+func (c *CsvStorage) CreateTasksStored(t []models.Task) ([]models.Task, []error) {
+	if err := c.begin(); err != nil {
+		return nil, []error{fmt.Errorf("CsvStorage.CreateTasks: %s", err.Error())}
+	}
+	defer c.end()
+
+	var created []models.Task
+	var result []error
+	var entries []csvJournalEntry
 
-		uuid, err = strconv.ParseUint(record[0], 10, 64)
+	for i, task := range t {
+		e, err := c.createTask(task)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Invalid UUID: %s", record[0])
+			result = append(result, fmt.Errorf("Task %d (%s): %s", i, task.Name, err.Error()))
+			continue
 		}
 
-		result = append(result, uuid)
+		entries = append(entries, e...)
+		created = append(created, e[len(e)-1].task)
 	}
 
-	return result
+	if len(result) > 0 {
+		// Nothing was written yet, so the file and journal still have
+		// everything as it was before
+		if err := c.reload(); err != nil {
+			result = append(result, fmt.Errorf("CsvStorage.CreateTasks: %s", err.Error()))
+		}
+
+		return nil, result
+	}
+
+	if err := c.record(entries...); err != nil {
+		// Keep the buffers in line with whatever made it to disk
+		c.reload()
+		return nil, []error{fmt.Errorf("CsvStorage.CreateTasks: %s", err.Error())}
+	}
+
+	return created, nil
 }
 
-func (c *CsvStorage) CreateTask(t models.Task) error {
-	if task, err := c.GetTask(t.Guid); err == nil {
-		return fmt.Errorf("Task with GUID %d already exists:\n\t%s\n", t.Guid, task.Name)
-	} else {
-		if _, ok := err.(getZeroGuidError); !ok {
-			return err
+// createTask adds a Task to the buffers, and returns the journal entries that
+// save it, the one for the new Task last. It must be called with the write
+// lock held.
+func (c *CsvStorage) createTask(t models.Task) ([]csvJournalEntry, error) {
+	if t.Guid != 0 {
+		// Tasks keep their GUID when they are imported or migrated
+		if task, err := c.getTask(t.Guid); err == nil {
+			return nil, fmt.Errorf("Task with GUID %d already exists:\n\t%s\n", t.Guid, task.Name)
 		}
-
-		t.Guid = c.getNextGuid()
+	} else {
+		t.Guid = c.guids.next()
 	}
 
 	if t.Added == nil {
 		t.Added = ptypes.TimestampNow()
 	}
 
+	var result []csvJournalEntry
+
 	if t.Parent != 0 {
-		p, err := c.GetTask(t.Parent)
+		if err := c.buffer(t.Parent); err != nil {
+			return nil, fmt.Errorf("Could not add Parent %d: %s", t.Parent, err.Error())
+		}
+
+		p, err := c.getTask(t.Parent)
 		if err != nil {
-			return fmt.Errorf("Could not add Parent %d: %s", t.Parent, err.Error())
+			return nil, fmt.Errorf("Could not add Parent %d: %s", t.Parent, err.Error())
 		}
 
-		old_p := p
+		if !containsGuid(p.Subtasks, t.Guid) {
+			old_p := p
 
-		p.Subtasks = append(p.Subtasks, t.Guid)
+			p.Subtasks = append(p.Subtasks[:len(p.Subtasks):len(p.Subtasks)], t.Guid)
 
-		err = c.bufferStorage.EditTask(old_p, p)
-		if err != nil {
-			return err
+			err = c.editTask(old_p, p)
+			if err != nil {
+				return nil, err
+			}
+
+			// With the revision it was stored with
+			p, _ = c.getTask(p.Guid)
+
+			result = append(result, csvJournalEntry{csvJournalEdit, p})
 		}
 	}
 
@@ -136,56 +559,108 @@ func (c *CsvStorage) CreateTask(t models.Task) error {
 
 	c.updateBuffers(p_t)
 
-	if err := c.writeAll(); err != nil {
-		return fmt.Errorf("CsvStorage.CreateTask: %s", err.Error())
-	}
-
-	return nil
-}
-
-func (c *CsvStorage) CreateTasks(t []models.Task) []error {
-	panic("not implemented")
+	return append(result, csvJournalEntry{csvJournalCreate, t}), nil
 }
 
 func (s *CsvStorage) EditTask(oldTask, newTask models.Task) error {
-	err := s.bufferStorage.EditTask(oldTask, newTask)
+	if err := s.begin(); err != nil {
+		return fmt.Errorf("CsvStorage.EditTask: %s", err.Error())
+	}
+	defer s.end()
+
+	if err := s.buffer(oldTask.Guid); err != nil {
+		return fmt.Errorf("CsvStorage.EditTask: %s", err.Error())
+	}
+
+	err := s.editTask(oldTask, newTask)
 	if err != nil {
 		return err
 	}
 
-	return s.writeAll()
+	// With the revision it was stored with
+	newTask, _ = s.getTask(newTask.Guid)
+
+	return s.record(csvJournalEntry{csvJournalEdit, newTask})
 }
 
-// TODO: This is terrible
-func (c *CsvStorage) getNextGuid() uint64 {
-	keys := make([]uint64, 0, len(c.buffer_guid))
-	for k := range c.buffer_guid {
-		keys = append(keys, k)
+func (s *CsvStorage) DeleteTask(guid uint64) error {
+	_, err := s.DeleteTaskUnlinked(guid)
+	return err
+}
+
+func (s *CsvStorage) DeleteTaskUnlinked(guid uint64) ([]models.Task, error) {
+	if err := s.begin(); err != nil {
+		return nil, fmt.Errorf("CsvStorage.DeleteTask: %s", err.Error())
 	}
+	defer s.end()
 
-	models.UuidSort(keys)
+	// The Tasks that refer to it are edited along with it
+	for _, g := range append(s.index.referrers(guid), guid) {
+		if err := s.buffer(g); err != nil {
+			return nil, fmt.Errorf("CsvStorage.DeleteTask: %s", err.Error())
+		}
+	}
 
-	return keys[len(keys)-1] + 1
+	unlinked, err := s.deleteTask(guid)
+	if err != nil {
+		return nil, err
+	}
+
+	// The delete goes first, so the edits of the Tasks that referred to it
+	// are replayed after it took it off them
+	entries := []csvJournalEntry{{csvJournalDelete, models.Task{Guid: guid}}}
+	for _, ref := range unlinked {
+		task, _ := s.getTask(ref.Guid)
+		entries = append(entries, csvJournalEntry{csvJournalEdit, task})
+	}
+
+	if err := s.record(entries...); err != nil {
+		return nil, err
+	}
+
+	return unlinked, nil
 }
 
-func (s *CsvStorage) loadTasks(num int) {
+// loadTasks reads the header of the storage file, if it has one, and then up
+// to num Tasks into the buffers. The Tasks after that are only indexed.
+func (s *CsvStorage) loadTasks(num int) error {
 	s.queue = []models.Task{}
+	s.layout = csvLegacyLayout
 
 	r := csv.NewReader(s.f)
+	r.FieldsPerRecord = -1
+
+	for line := 0; ; line++ {
+		offset := r.InputOffset()
 
-	for i := 0; i < num; i++ {
 		record, err := r.Read()
-		if err != nil {
-			if err != io.EOF {
-				fmt.Fprintf(os.Stderr, "Error reading CSV Storage: %s", err.Error())
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			// Carrying on would drop every Task after this one the next time
+			// we compact
+			return fmt.Errorf("Error reading CSV Storage: %s", err.Error())
+		}
+
+		if line == 0 && isCsvHeader(record) {
+			if s.layout, err = csvLayoutFromHeader(record); err != nil {
+				return err
 			}
 
-			return
+			continue
 		}
 
-		newTask, err := TaskFromCsv(record)
+		// Records past the buffers are decoded too, so one that can't be
+		// is skipped the same way wherever it is, instead of breaking the
+		// next compaction
+		newTask, err := s.layout.decode(record)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error extracting task from CSV record: %s", err.Error())
+			fmt.Fprintf(os.Stderr, "Error extracting task from CSV record: %s\n", err.Error())
+			continue
+		}
+
+		if len(s.queue) >= num {
+			s.index.indexTask(newTask, offset)
 			continue
 		}
 
@@ -195,184 +670,477 @@ func (s *CsvStorage) loadTasks(num int) {
 	}
 }
 
-// TODO: This is terrible
+// writeAll must be called with the write lock held. Only call it through
+// compact, or the journal would replay older changes on top of the new file.
 func (c *CsvStorage) writeAll() error {
+	keys := c.getAllTasks()
 
-	if err := c.f.Truncate(0); err != nil {
-		return fmt.Errorf("CsvStorage.writeAll: %s", err)
-	}
-	if _, err := c.f.Seek(0, 0); err != nil {
+	err := c.file.Write(func(w io.Writer) error {
+		if c.sealer == nil {
+			return c.writeCsv(w, keys)
+		}
+
+		var buf bytes.Buffer
+		if err := c.writeCsv(&buf, keys); err != nil {
+			return err
+		}
+
+		b, err := c.sealer.sealFile(buf.Bytes())
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(b)
+		return err
+	})
+	if err != nil {
 		return fmt.Errorf("CsvStorage.writeAll: %s", err)
 	}
 
-	keys := []uint64{}
-	for k, _ := range c.buffer_guid {
-		keys = append(keys, k)
-	}
+	return nil
+}
 
-	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+func (c *CsvStorage) writeCsv(w io.Writer, keys []uint64) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader()); err != nil {
+		return err
+	}
 
 	for _, k := range keys {
-		if _, err := c.f.WriteString(TaskToCSV(*c.buffer_guid[k])); err != nil {
-			return fmt.Errorf("CsvStorage.writeAll: %s", err)
+		// Tasks that aren't buffered are still in the file we have open, as
+		// it is only renamed over
+		task, err := c.getTask(k)
+		if err != nil {
+			return err
+		}
+
+		if err := cw.Write(taskToCsvRecord(task)); err != nil {
+			return err
 		}
 	}
 
-	return nil
+	cw.Flush()
+	return cw.Error()
 }
 
+// getTaskFromFile reads a Task that didn't fit in the buffers from the storage
+// file, using the index.
 func (s *CsvStorage) getTaskFromFile(guid uint64) (models.Task, error) {
-	// NOTE: For now, we load everything into memory, so if we don't have a guid
-	// in the buffer, it doesn't exist
-	return models.Task{}, fmt.Errorf("CSV Storage Error: guid not found %d\n", guid)
+	entry, ok := s.index.entries[guid]
+	if !ok {
+		return models.Task{}, fmt.Errorf("CSV Storage Error: guid not found %d\n", guid)
+	}
+
+	task, err := readCsvTaskAt(s.f, s.layout, entry.offset)
+	if err != nil {
+		return models.Task{}, fmt.Errorf("CSV Storage Error: could not read Task %d: %s\n", guid, err.Error())
+	}
+
+	if task.Guid != guid {
+		return models.Task{}, fmt.Errorf("CSV Storage Error: index is out of date, found Task %d instead of %d\n", task.Guid, guid)
+	}
+
+	return task, nil
 }
 
-func TaskToCSV(task models.Task) string {
-	var subtasks string
-	for _, guid := range task.Subtasks {
-		if subtasks == "" {
-			subtasks = strconv.FormatUint(guid, 10)
-		} else {
-			subtasks = strings.Join([]string{subtasks, strconv.FormatUint(guid, 10)}, "|")
+// csvFormatVersion is the version of the CSV Storage format that we write.
+// Version 1 files have no header row, and only the first 14 columns. Version 2
+// files have no revision column.
+const csvFormatVersion = 3
+
+// csvVersionPrefix marks the cell of the header row that holds the format
+// version. It comes after the column names and has no column of its own.
+const csvVersionPrefix = "version="
+
+// csvColumns are the columns of the current format, in the order we write
+// them. New columns must be added at the end.
+var csvColumns = []string{
+	"guid",
+	"name",
+	"size",
+	"added",
+	"finished",
+	"due",
+	"removed",
+	"repeats",
+	"tags",
+	"priority",
+	"url",
+	"parent",
+	"subtasks",
+	"dependencies",
+	"active",
+	"guid_previous",
+	"dependants",
+	"revision",
+}
+
+// csvLayout says where each column is in the records of a CSV file.
+type csvLayout struct {
+	version int
+	columns map[string]int
+	width   int
+}
+
+var (
+	csvLegacyLayout = newCsvLayout(1, csvColumns[:14])
+	// csvUnrevisedLayout is version 2, before Tasks had revisions, which
+	// journals may still have records in.
+	csvUnrevisedLayout = newCsvLayout(2, csvColumns[:17])
+	csvCurrentLayout   = newCsvLayout(csvFormatVersion, csvColumns)
+)
+
+func newCsvLayout(version int, columns []string) *csvLayout {
+	result := &csvLayout{
+		version: version,
+		columns: make(map[string]int, len(columns)),
+		width:   len(columns),
+	}
+
+	for i, name := range columns {
+		result.columns[name] = i
+	}
+
+	return result
+}
+
+// isCsvHeader tells a header row from a record, which always starts with a
+// GUID.
+func isCsvHeader(record []string) bool {
+	if len(record) == 0 {
+		return false
+	}
+
+	_, err := strconv.ParseUint(record[0], 10, 64)
+	return err != nil
+}
+
+// csvLayoutFromHeader maps the columns of a file by the names in its header,
+// so columns can be reordered, or missing if the file was written by hand.
+func csvLayoutFromHeader(header []string) (*csvLayout, error) {
+	version := csvFormatVersion
+	columns := []string{}
+
+	for _, cell := range header {
+		if strings.HasPrefix(cell, csvVersionPrefix) {
+			v, err := strconv.Atoi(strings.TrimPrefix(cell, csvVersionPrefix))
+			if err != nil {
+				return nil, fmt.Errorf("Invalid CSV format version: %s", cell)
+			}
+
+			version = v
+			continue
+		}
+
+		columns = append(columns, strings.TrimSpace(cell))
+	}
+
+	if version > csvFormatVersion {
+		return nil, fmt.Errorf("CSV file has format version %d, this tasker only reads up to %d", version, csvFormatVersion)
+	}
+
+	result := newCsvLayout(version, columns)
+	if _, ok := result.columns["guid"]; !ok {
+		return nil, fmt.Errorf("CSV header has no guid column: %s", header)
+	}
+
+	return result, nil
+}
+
+// isUnnamedCsvHeader reports whether a header row names none of our columns.
+func isUnnamedCsvHeader(header []string) bool {
+	for _, cell := range header {
+		if _, ok := csvCurrentLayout.columns[strings.TrimSpace(cell)]; ok {
+			return false
 		}
 	}
 
-	var depends string
-	for _, guid := range task.Dependencies {
-		if depends == "" {
-			depends = strconv.FormatUint(guid, 10)
+	return true
+}
+
+func csvHeader() []string {
+	return append(append([]string{}, csvColumns...), fmt.Sprintf("%s%d", csvVersionPrefix, csvFormatVersion))
+}
+
+func (l *csvLayout) get(record []string, column string) string {
+	if i, ok := l.columns[column]; ok && i < len(record) {
+		return record[i]
+	}
+
+	return ""
+}
+
+// ReadCsvTasks reads every Task from a CSV file, with or without a header row.
+// Without one, the columns are expected in the order we write them.
+func ReadCsvTasks(r io.Reader) ([]models.Task, error) {
+	result := []models.Task{}
+	layout := csvLegacyLayout
+
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+
+	for i := 0; ; i++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return result, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		if i == 0 && isCsvHeader(record) {
+			if layout, err = csvLayoutFromHeader(record); err != nil {
+				// Import files used to start with a header of any
+				// kind, which was skipped
+				if !isUnnamedCsvHeader(record) {
+					return nil, err
+				}
+
+				layout = nil
+			}
+
+			continue
+		}
+
+		var task models.Task
+		if layout != nil {
+			task, err = layout.decode(record)
 		} else {
-			depends = strings.Join([]string{depends, strconv.FormatUint(guid, 10)}, "|")
+			task, err = TaskFromCsv(record)
 		}
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %s", i+1, err.Error())
+		}
+
+		result = append(result, task)
 	}
+}
+
+// TaskToCSV returns the line for a Task in the current format, quoted as in
+// RFC 4180.
+func TaskToCSV(task models.Task) string {
+	var b strings.Builder
 
-	added := util.TimestampToString(task.Added)
-	finished := util.TimestampToString(task.Finished)
-	due := util.TimestampToString(task.Due)
+	w := csv.NewWriter(&b)
+	w.Write(taskToCsvRecord(task))
+	w.Flush()
 
-	result := fmt.Sprintf("%d,%s,%d,%s,%s,%s,%t,%t,%s,%d,%s,%d,%s,%s\n",
-		task.Guid,
+	return b.String()
+}
+
+func taskToCsvRecord(task models.Task) []string {
+	return []string{
+		strconv.FormatUint(task.Guid, 10),
 		task.Name,
-		task.Size,
-		added,
-		finished,
-		due,
-		task.Removed,
-		task.Repeats,
+		strconv.FormatUint(uint64(task.Size), 10),
+		csvTimestamp(task.Added),
+		csvTimestamp(task.Finished),
+		csvTimestamp(task.Due),
+		strconv.FormatBool(task.Removed),
+		strconv.FormatBool(task.Repeats),
 		strings.Join(task.Tags, "|"),
-		task.Priority,
+		strconv.FormatUint(uint64(task.Priority), 10),
 		task.Url,
-		task.Parent,
-		subtasks,
-		depends,
-	)
-
-	return result
+		strconv.FormatUint(task.Parent, 10),
+		csvGuidList(task.Subtasks),
+		csvGuidList(task.Dependencies),
+		csvTimestamp(task.Active),
+		strconv.FormatUint(uint64(task.GuidPrevious), 10),
+		csvGuidList(task.Dependants),
+		strconv.FormatUint(task.Revision, 10),
+	}
 }
 
+// TaskFromCsv reads a record without a header, in either the current or an
+// older layout.
 func TaskFromCsv(record []string) (models.Task, error) {
+	switch len(record) {
+	case csvLegacyLayout.width:
+		return csvLegacyLayout.decode(record)
+	case csvUnrevisedLayout.width:
+		return csvUnrevisedLayout.decode(record)
+	}
+
+	return csvCurrentLayout.decode(record)
+}
+
+func (l *csvLayout) decode(record []string) (models.Task, error) {
 	newTask := models.Task{}
 	var err error
 
-	if len(record) != 14 {
+	if len(record) != l.width {
 		return newTask, fmt.Errorf("CSV line doesn't have right number of columns.\n%s\n", record)
 	}
 
-	guid, err := strconv.Atoi(record[0])
+	guid, err := strconv.ParseUint(l.get(record, "guid"), 10, 64)
 	if err != nil {
 		return newTask, fmt.Errorf("TaskFromCSV: Could not extract guid: %s\n", err)
 	}
 
-	var size int
-	if record[2] != "" {
-		size, err = strconv.Atoi(record[2])
-		if err != nil {
-			return newTask, fmt.Errorf("TaskFromCSV: Could not extract size: %s\n", err)
-		}
+	size, err := parseCsvUint(l.get(record, "size"), 32)
+	if err != nil {
+		return newTask, fmt.Errorf("TaskFromCSV: Could not extract size: %s\n", err)
 	}
 
-	added := util.StringToTimestamp(record[3])
+	added := util.StringToTimestamp(l.get(record, "added"))
 	if added == nil {
-		return newTask, fmt.Errorf("Unable to parse timestamp: %s\n", record[3])
+		return newTask, fmt.Errorf("Unable to parse timestamp: %s\n", l.get(record, "added"))
 	}
 
-	finished := util.StringToTimestamp(record[4])
-	if record[4] != "" && finished == nil {
-		return newTask, fmt.Errorf("Unable to parse timestamp: %s\n", record[5])
+	finished, err := parseCsvTimestamp(l.get(record, "finished"))
+	if err != nil {
+		return newTask, err
 	}
 
-	due := util.StringToTimestamp(record[5])
-	if record[5] != "" && due == nil {
-		return newTask, fmt.Errorf("Unable to parse timestamp: %s\n", record[5])
+	due, err := parseCsvTimestamp(l.get(record, "due"))
+	if err != nil {
+		return newTask, err
 	}
 
-	removed, err := strconv.ParseBool(record[6])
+	active, err := parseCsvTimestamp(l.get(record, "active"))
 	if err != nil {
 		return newTask, err
 	}
 
-	repeats, err := strconv.ParseBool(record[7])
+	removed, err := parseCsvBool(l.get(record, "removed"))
 	if err != nil {
 		return newTask, err
 	}
 
-	var priority int
-	if record[9] != "" {
-		priority, err = strconv.Atoi(record[9])
-		if err != nil {
-			return newTask, fmt.Errorf("TaskFromCSV: Could not extract priority: %s\n", err)
-		}
+	repeats, err := parseCsvBool(l.get(record, "repeats"))
+	if err != nil {
+		return newTask, err
+	}
+
+	priority, err := parseCsvUint(l.get(record, "priority"), 32)
+	if err != nil {
+		return newTask, fmt.Errorf("TaskFromCSV: Could not extract priority: %s\n", err)
+	}
+
+	guidPrevious, err := parseCsvUint(l.get(record, "guid_previous"), 32)
+	if err != nil {
+		return newTask, fmt.Errorf("TaskFromCSV: Could not extract guid_previous: %s\n", err)
 	}
 
 	var parent uint64
-	if record[11] != "" {
-		if p, err := strconv.ParseUint(record[11], 10, 64); err == nil {
-			parent = uint64(p)
-		}
+	if p, err := parseCsvUint(l.get(record, "parent"), 64); err == nil {
+		parent = p
 	}
 
-	subtasks := []uint64{}
-	if record[12] != "" {
-		strSubTasks := strings.Split(record[12], "|")
-		for _, strSubTask := range strSubTasks {
-			subtask, err := strconv.Atoi(strSubTask)
-			if err != nil {
-				return newTask, fmt.Errorf("TaskFromCSV: Could not extract subtasks: %s\n", err)
-			}
+	subtasks, err := parseCsvGuidList(l.get(record, "subtasks"))
+	if err != nil {
+		return newTask, fmt.Errorf("TaskFromCSV: Could not extract subtasks: %s\n", err)
+	}
 
-			subtasks = append(subtasks, uint64(subtask))
-		}
+	depends, err := parseCsvGuidList(l.get(record, "dependencies"))
+	if err != nil {
+		return newTask, fmt.Errorf("TaskFromCSV: Could not extract dependencies: %s\n", err)
 	}
 
-	depends := []uint64{}
-	if record[13] != "" {
-		strDepends := strings.Split(record[13], "|")
-		for _, strDepend := range strDepends {
-			depend, err := strconv.Atoi(strDepend)
-			if err != nil {
-				return newTask, fmt.Errorf("TaskFromCSV: Could not extract dependencies: %s\n", err)
-			}
+	dependants, err := parseCsvGuidList(l.get(record, "dependants"))
+	if err != nil {
+		return newTask, fmt.Errorf("TaskFromCSV: Could not extract dependants: %s\n", err)
+	}
 
-			depends = append(depends, uint64(depend))
-		}
+	revision, err := parseCsvUint(l.get(record, "revision"), 64)
+	if err != nil {
+		return newTask, fmt.Errorf("TaskFromCSV: Could not extract revision: %s\n", err)
+	}
+
+	var tags []string
+	if t := l.get(record, "tags"); t != "" {
+		tags = strings.Split(t, "|")
 	}
 
 	newTask = models.Task{
-		Guid:         uint64(guid),
-		Name:         record[1],
+		Guid:         guid,
+		Name:         l.get(record, "name"),
 		Size:         uint32(size),
 		Added:        added,
+		Active:       active,
 		Finished:     finished,
 		Due:          due,
 		Removed:      removed,
 		Repeats:      repeats,
-		Tags:         strings.Split(record[8], "|"),
+		Tags:         tags,
 		Priority:     uint32(priority),
-		Url:          record[10],
+		Url:          l.get(record, "url"),
+		GuidPrevious: uint32(guidPrevious),
 		Parent:       parent,
 		Subtasks:     subtasks,
 		Dependencies: depends,
+		Dependants:   dependants,
+		Revision:     revision,
 	}
 
 	return newTask, nil
 }
+
+// csvTimestamp keeps the full time of a timestamp. Version 1 files only kept
+// the date, which we still read.
+func csvTimestamp(t *tspb.Timestamp) string {
+	if t == nil {
+		return ""
+	}
+
+	result, err := ptypes.Timestamp(t)
+	if err != nil {
+		return ""
+	}
+
+	return result.In(time.Now().Location()).Format(time.RFC3339Nano)
+}
+
+func parseCsvTimestamp(s string) (*tspb.Timestamp, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	if result := util.StringToTimestamp(s); result != nil {
+		return result, nil
+	}
+
+	return nil, fmt.Errorf("Unable to parse timestamp: %s\n", s)
+}
+
+func parseCsvBool(s string) (bool, error) {
+	if s == "" {
+		return false, nil
+	}
+
+	return strconv.ParseBool(s)
+}
+
+func parseCsvUint(s string, bitSize int) (uint64, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	return strconv.ParseUint(s, 10, bitSize)
+}
+
+func csvGuidList(guids []uint64) string {
+	result := make([]string, len(guids))
+	for i, guid := range guids {
+		result[i] = strconv.FormatUint(guid, 10)
+	}
+
+	return strings.Join(result, "|")
+}
+
+func parseCsvGuidList(s string) ([]uint64, error) {
+	result := []uint64{}
+	if s == "" {
+		return result, nil
+	}
+
+	for _, str := range strings.Split(s, "|") {
+		guid, err := strconv.ParseUint(str, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, guid)
+	}
+
+	return result, nil
+}
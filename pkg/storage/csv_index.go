@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"encoding/csv"
+	"io"
+	"math"
+
+	"github.com/oatmealraisin/tasker/pkg/models"
+)
+
+// csvBufferSize is how many Tasks CsvStorage keeps in memory. The rest are
+// only indexed, and read from the storage file when they are asked for.
+const csvBufferSize = 10000
+
+// csvIndexEntry is where a Task that isn't buffered starts in the storage
+// file, along with what we need to find it by name or tag, and the subtasks
+// and dependencies it refers to.
+type csvIndexEntry struct {
+	offset int64
+	name   string
+	tags   []string
+	links  []uint64
+}
+
+// csvIndex keeps track of the Tasks in the storage file that didn't fit in the
+// buffers.
+type csvIndex struct {
+	entries map[uint64]csvIndexEntry
+	names   map[string][]uint64
+	tags    map[string][]uint64
+}
+
+func newCsvIndex() *csvIndex {
+	return &csvIndex{
+		entries: map[uint64]csvIndexEntry{},
+		names:   map[string][]uint64{},
+		tags:    map[string][]uint64{},
+	}
+}
+
+func (i *csvIndex) add(guid uint64, entry csvIndexEntry) {
+	i.entries[guid] = entry
+	i.names[entry.name] = append(i.names[entry.name], guid)
+
+	for _, tag := range entry.tags {
+		i.tags[tag] = append(i.tags[tag], guid)
+	}
+}
+
+func (i *csvIndex) remove(guid uint64) {
+	entry, ok := i.entries[guid]
+	if !ok {
+		return
+	}
+
+	delete(i.entries, guid)
+	i.names[entry.name] = removeUuid(i.names[entry.name], guid)
+
+	for _, tag := range entry.tags {
+		i.tags[tag] = removeUuid(i.tags[tag], guid)
+	}
+}
+
+// indexTask adds a Task of the storage file, whose record starts at offset,
+// to the index.
+func (i *csvIndex) indexTask(task models.Task, offset int64) {
+	entry := csvIndexEntry{
+		offset: offset,
+		name:   task.Name,
+		tags:   task.Tags,
+		links:  append(append([]uint64{}, task.Subtasks...), task.Dependencies...),
+	}
+
+	i.add(task.Guid, entry)
+}
+
+// referrers returns the indexed Tasks that have guid as a subtask or a
+// dependency.
+func (i *csvIndex) referrers(guid uint64) []uint64 {
+	var result []uint64
+	for ref, entry := range i.entries {
+		if containsGuid(entry.links, guid) {
+			result = append(result, ref)
+		}
+	}
+
+	return result
+}
+
+// readCsvTaskAt reads the Task whose record starts at offset in f.
+func readCsvTaskAt(f io.ReaderAt, layout *csvLayout, offset int64) (models.Task, error) {
+	r := csv.NewReader(io.NewSectionReader(f, offset, math.MaxInt64-offset))
+	r.FieldsPerRecord = -1
+
+	record, err := r.Read()
+	if err != nil {
+		return models.Task{}, err
+	}
+
+	return layout.decode(record)
+}
@@ -0,0 +1,265 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/oatmealraisin/tasker/pkg/models"
+)
+
+const (
+	csvJournalCreate = "create"
+	csvJournalEdit   = "edit"
+	csvJournalDelete = "delete"
+	// csvJournalBatch is followed by the number of entries in the batch,
+	// which are only replayed if all of them made it to disk.
+	csvJournalBatch = "batch"
+
+	// csvJournalCompactAfter is how many changes the journal holds before
+	// they are folded back into the storage file.
+	csvJournalCompactAfter = 256
+)
+
+type csvJournalEntry struct {
+	op   string
+	task models.Task
+}
+
+// csvJournal is an append-only log of the changes made to a CsvStorage since
+// its file was last rewritten. Each record is an operation followed by the CSV
+// columns of the Task it applies to, or just the GUID for deletes. Replaying
+// an entry twice has the same effect as replaying it once.
+//
+// With an encryption key, every append is sealed on a line of its own, see
+// sealer.sealLine.
+type csvJournal struct {
+	f      *os.File
+	sealer *sealer
+	// salt is the one in the last encryption header of the journal, so we
+	// know whether our appends need a header of their own.
+	salt []byte
+
+	// loaded and size describe how much of the journal is reflected in our
+	// buffers, so we notice when another process appends to it.
+	loaded os.FileInfo
+	size   int64
+
+	entries int
+	// corrupt is set when the journal ends in an entry we can't read, most
+	// likely one that was being written when tasker crashed.
+	corrupt bool
+	// unsealed is set when there is a key, but the journal has entries that
+	// were written before there was.
+	unsealed bool
+	// guids records which Tasks were created (true) or deleted (false) by
+	// the journal, as they aren't in the storage file yet.
+	guids map[uint64]bool
+}
+
+func openCsvJournal(filename string, sealer *sealer) (*csvJournal, error) {
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open journal: %s", err.Error())
+	}
+
+	return &csvJournal{f: f, sealer: sealer, guids: map[uint64]bool{}}, nil
+}
+
+// replay applies every entry of the journal to b.
+func (j *csvJournal) replay(b *bufferStorage) error {
+	j.entries = 0
+	j.corrupt = false
+	j.guids = map[uint64]bool{}
+
+	if _, err := j.f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("Could not read journal: %s", err.Error())
+	}
+
+	content, err := ioutil.ReadAll(j.f)
+	if err != nil {
+		return fmt.Errorf("Could not read journal: %s", err.Error())
+	}
+
+	j.unsealed = j.sealer != nil && len(content) > 0 && !bytes.HasPrefix(content, []byte(sealedLinePrefix))
+
+	plain, salt, openErr := j.sealer.openLines(bytes.NewReader(content))
+	if openErr == errSealedNoKey || openErr == errSealedWrongKey {
+		return fmt.Errorf("Could not read journal: %s", openErr.Error())
+	}
+	j.salt = salt
+
+	r := csv.NewReader(bytes.NewReader(plain))
+	r.FieldsPerRecord = -1
+
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+
+		records := [][]string{record}
+		if err == nil && record[0] == csvJournalBatch {
+			records, err = readCsvJournalBatch(r, record)
+		}
+
+		for i := 0; err == nil && i < len(records); i++ {
+			err = j.apply(b, records[i])
+		}
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Ignoring the rest of the CSV Storage journal: %s\n", err.Error())
+			j.corrupt = true
+			break
+		}
+
+		j.entries += len(records)
+	}
+
+	if openErr != nil && !j.corrupt {
+		fmt.Fprintf(os.Stderr, "Ignoring part of the CSV Storage journal: %s\n", openErr.Error())
+		j.corrupt = true
+	}
+
+	if j.loaded, err = j.f.Stat(); err != nil {
+		return fmt.Errorf("Could not read journal: %s", err.Error())
+	}
+	j.size = j.loaded.Size()
+
+	return nil
+}
+
+// readCsvJournalBatch reads the entries of the batch started by header.
+func readCsvJournalBatch(r *csv.Reader, header []string) ([][]string, error) {
+	if len(header) != 2 {
+		return nil, fmt.Errorf("Journal batch doesn't have a size: %s", header)
+	}
+
+	n, err := strconv.Atoi(header[1])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid journal batch size: %s", header[1])
+	}
+
+	result := make([][]string, 0, n)
+	for i := 0; i < n; i++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			return nil, fmt.Errorf("Journal batch is missing %d entries", n-i)
+		} else if err != nil {
+			return nil, err
+		}
+
+		result = append(result, record)
+	}
+
+	return result, nil
+}
+
+func (j *csvJournal) apply(b *bufferStorage, record []string) error {
+	switch record[0] {
+	case csvJournalCreate, csvJournalEdit:
+		task, err := TaskFromCsv(record[1:])
+		if err != nil {
+			return err
+		}
+
+		b.putTask(task)
+		j.guids[task.Guid] = true
+	case csvJournalDelete:
+		if len(record) != 2 {
+			return fmt.Errorf("Journal delete doesn't have a GUID: %s", record)
+		}
+
+		guid, err := strconv.ParseUint(record[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("Invalid UUID: %s", record[1])
+		}
+
+		// The Task may already be gone, if this entry was replayed before
+		b.deleteTask(guid)
+		j.guids[guid] = false
+	default:
+		return fmt.Errorf("Unknown journal operation '%s'", record[0])
+	}
+
+	return nil
+}
+
+// append writes entries to the end of the journal and syncs them to disk.
+// Several entries are written as a batch, so they are replayed all together
+// or not at all.
+func (j *csvJournal) append(entries ...csvJournalEntry) error {
+	// Build everything first, so it goes out in a single write
+	var line strings.Builder
+	w := csv.NewWriter(&line)
+
+	if len(entries) > 1 {
+		w.Write([]string{csvJournalBatch, strconv.Itoa(len(entries))})
+	}
+
+	for _, entry := range entries {
+		record := []string{entry.op, strconv.FormatUint(entry.task.Guid, 10)}
+		if entry.op != csvJournalDelete {
+			record = append([]string{entry.op}, taskToCsvRecord(entry.task)...)
+		}
+
+		w.Write(record)
+	}
+
+	w.Flush()
+
+	b, salt, err := j.sealer.sealLine([]byte(line.String()), j.salt)
+	if err != nil {
+		return fmt.Errorf("Could not write journal: %s", err.Error())
+	}
+
+	n, err := j.f.Write(b)
+	j.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("Could not write journal: %s", err.Error())
+	}
+	j.salt = salt
+
+	if err := j.f.Sync(); err != nil {
+		return fmt.Errorf("Could not write journal: %s", err.Error())
+	}
+
+	for _, entry := range entries {
+		j.entries++
+		j.guids[entry.task.Guid] = entry.op != csvJournalDelete
+	}
+
+	return nil
+}
+
+// truncate empties the journal, once everything in it is in the storage file.
+func (j *csvJournal) truncate() error {
+	if err := j.f.Truncate(0); err != nil {
+		return fmt.Errorf("Could not truncate journal: %s", err.Error())
+	}
+
+	j.size = 0
+	j.entries = 0
+	j.corrupt = false
+	j.unsealed = false
+	j.salt = nil
+	j.guids = map[uint64]bool{}
+
+	return nil
+}
+
+// Changed reports whether another process has written to the journal since we
+// last read it.
+func (j *csvJournal) Changed() bool {
+	info, err := os.Stat(j.f.Name())
+	if err != nil || j.loaded == nil {
+		return true
+	}
+
+	return !os.SameFile(j.loaded, info) || info.Size() != j.size
+}
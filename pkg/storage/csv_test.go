@@ -0,0 +1,146 @@
+package storage_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/oatmealraisin/tasker/pkg/models"
+	"github.com/oatmealraisin/tasker/pkg/storage"
+	"github.com/spf13/viper"
+)
+
+func TestCsvStorageReadsVersion2(t *testing.T) {
+	dir := t.TempDir()
+	viper.Set("WorkingDir", dir)
+
+	filename := filepath.Join(dir, "tasklist.csv")
+	content := "guid,name,size,added,finished,due,removed,repeats,tags,priority,url,parent,subtasks,dependencies,active,guid_previous,dependants,version=2\n" +
+		"1,unrevised,1,2019-03-25T09:30:00Z,,,false,false,,0,,,,,,0,\n"
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := storage.NewCsvStorage(filename)
+	if s == nil {
+		t.Fatal("Could not open a version 2 CSV Storage")
+	}
+
+	task, err := s.GetTask(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if task.Name != "unrevised" || task.Revision != 0 {
+		t.Errorf("GetTask(1) = %s at revision %d, expected unrevised at revision 0", task.Name, task.Revision)
+	}
+
+	edited := task
+	edited.Name = "revised"
+	if err := s.EditTask(task, edited); err != nil {
+		t.Fatal(err)
+	}
+
+	if task, err = s.GetTask(1); err != nil || task.Revision != 1 {
+		t.Errorf("GetTask(1) after an edit = %v, %v, expected revision 1", task, err)
+	}
+}
+
+func TestCsvStorageSkipsBadRecords(t *testing.T) {
+	dir := t.TempDir()
+	viper.Set("WorkingDir", dir)
+
+	var b strings.Builder
+	b.WriteString("guid,name,size,added,finished,due,removed,repeats,tags,priority,url,parent,subtasks,dependencies,active,guid_previous,dependants,revision,version=3\n")
+
+	// One bad record among the buffered Tasks, and one among those that
+	// are only indexed
+	bad := map[uint64]bool{10: true, 10010: true}
+	for guid := uint64(1); guid <= 10020; guid++ {
+		if bad[guid] {
+			b.WriteString(strings.Replace(csvLine(guid), ",1,", ",big,", 1))
+		} else {
+			b.WriteString(csvLine(guid))
+		}
+	}
+
+	filename := filepath.Join(dir, "tasklist.csv")
+	if err := ioutil.WriteFile(filename, []byte(b.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := storage.NewCsvStorage(filename)
+	if s == nil {
+		t.Fatal("Could not open the CSV Storage")
+	}
+
+	guids := s.GetAllTasks()
+	if len(guids) != 10020-len(bad) {
+		t.Errorf("GetAllTasks has %d Tasks, expected %d", len(guids), 10020-len(bad))
+	}
+
+	for _, guid := range guids {
+		if bad[guid] {
+			t.Errorf("GetAllTasks has Task %d, whose record is bad", guid)
+		} else if _, err := s.GetTask(guid); err != nil {
+			t.Errorf("GetTask(%d): %s", guid, err.Error())
+		}
+	}
+}
+
+// TestCsvStorageCompactsWhileOpen checks that the storage file can be replaced
+// while both this process and another one have it open, which is what Windows
+// is picky about.
+func TestCsvStorageCompactsWhileOpen(t *testing.T) {
+	dir := t.TempDir()
+	viper.Set("WorkingDir", dir)
+
+	// Enough Tasks that some are only indexed, and read from the open file
+	var b strings.Builder
+	b.WriteString("guid,name,size,added,finished,due,removed,repeats,tags,priority,url,parent,subtasks,dependencies,active,guid_previous,dependants,revision,version=3\n")
+	for guid := uint64(1); guid <= 10020; guid++ {
+		b.WriteString(csvLine(guid))
+	}
+
+	filename := filepath.Join(dir, "tasklist.csv")
+	if err := ioutil.WriteFile(filename, []byte(b.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, other := storage.NewCsvStorage(filename), storage.NewCsvStorage(filename)
+	if s == nil || other == nil {
+		t.Fatal("Could not open the CSV Storage")
+	}
+
+	// More changes than the journal holds, so the storage file is replaced
+	tasks := make([]models.Task, 300)
+	for i := range tasks {
+		tasks[i] = models.Task{Name: "new"}
+	}
+
+	if errs := s.CreateTasks(tasks); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+
+	if info, err := os.Stat(filename + ".journal"); err != nil || info.Size() != 0 {
+		t.Errorf("Expected the journal to be folded into the storage file, found %v, %v", info, err)
+	}
+
+	for _, st := range []storage.Storage{s, other} {
+		if guids := st.GetAllTasks(); len(guids) != 10320 {
+			t.Errorf("GetAllTasks has %d Tasks, expected 10320", len(guids))
+		}
+
+		if _, err := st.GetTask(10015); err != nil {
+			t.Errorf("GetTask(10015): %s", err.Error())
+		}
+	}
+}
+
+// csvLine is the record of a Task with only a GUID, name and size.
+func csvLine(guid uint64) string {
+	return storage.TaskToCSV(models.Task{Guid: guid, Name: "task", Size: 1, Added: ptypes.TimestampNow()})
+}
@@ -0,0 +1,222 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/oatmealraisin/tasker/pkg/models"
+)
+
+// EventType is the kind of change an Event is about.
+type EventType string
+
+const (
+	EventCreated EventType = "created"
+	EventEdited  EventType = "edited"
+	// EventFinished is an edit that finished the Task.
+	EventFinished EventType = "finished"
+	EventDeleted  EventType = "deleted"
+)
+
+// Event is a change to a Task, as published by EventStorage.
+type Event struct {
+	Type EventType
+	Guid uint64
+
+	// Before and After are the Task as it was stored before and after the
+	// change. Creates have no Before, and deletes no After.
+	Before *models.Task
+	After  *models.Task
+}
+
+// Publisher is implemented by Storages that publish their changes, such as
+// EventStorage. Subscribe calls fn with every change from then on, and returns
+// a function that stops it.
+type Publisher interface {
+	Subscribe(fn func(Event)) (cancel func())
+}
+
+// Subscribe calls fn with every change made through s, or a Storage it wraps,
+// from then on. It returns a function that stops it.
+func Subscribe(s Storage, fn func(Event)) (func(), error) {
+	for _, layer := range layers(s) {
+		if p, ok := layer.(Publisher); ok {
+			return p.Subscribe(fn), nil
+		}
+	}
+
+	return nil, fmt.Errorf("Subscribe: the Storage doesn't publish its changes")
+}
+
+// EventStorage passes every change made through it on to the Storage it
+// wraps, and then publishes it to its subscribers, so they don't have to poll
+// for changes. Events are delivered in the goroutine that made the change,
+// once it is made, to one subscriber after another in the order they
+// subscribed. Subscribers may use the Storage themselves, but should be quick
+// about it.
+//
+// Only changes made through the EventStorage are published, not ones made to
+// the wrapped Storage directly or by other processes. Adding a subtask to its
+// parent is part of creating the subtask, and isn't published as an edit.
+// Tasks created without a GUID are only published if the wrapped Storage is a
+// Creator, so it is known which GUIDs they got.
+type EventStorage struct {
+	Storage
+
+	mu          sync.RWMutex
+	next        int
+	subscribers map[int]func(Event)
+}
+
+func NewEventStorage(s Storage) *EventStorage {
+	return &EventStorage{Storage: s, subscribers: map[int]func(Event){}}
+}
+
+func (e *EventStorage) Unwrap() Storage {
+	return e.Storage
+}
+
+func (e *EventStorage) Subscribe(fn func(Event)) func() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	id := e.next
+	e.next++
+	e.subscribers[id] = fn
+
+	return func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+
+		delete(e.subscribers, id)
+	}
+}
+
+// listening reports whether there are any subscribers, so changes nobody is
+// told about don't cost any extra reads.
+func (e *EventStorage) listening() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return len(e.subscribers) > 0
+}
+
+func (e *EventStorage) publish(event Event) {
+	e.mu.RLock()
+	ids := make([]int, 0, len(e.subscribers))
+	for id := range e.subscribers {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	subscribers := make([]func(Event), len(ids))
+	for i, id := range ids {
+		subscribers[i] = e.subscribers[id]
+	}
+	e.mu.RUnlock()
+
+	// Without the lock, so subscribers can subscribe and cancel
+	for _, fn := range subscribers {
+		fn(event)
+	}
+}
+
+func (e *EventStorage) CreateTask(t models.Task) error {
+	_, err := e.CreateTaskStored(t)
+	return err
+}
+
+func (e *EventStorage) CreateTaskStored(t models.Task) (models.Task, error) {
+	stored, err := createStored(e.Storage, t)
+	if err != nil {
+		return t, err
+	}
+
+	if stored == nil {
+		return t, nil
+	}
+
+	e.publish(Event{Type: EventCreated, Guid: stored.Guid, After: stored})
+
+	return *stored, nil
+}
+
+func (e *EventStorage) CreateTasks(t []models.Task) []error {
+	_, errs := e.CreateTasksStored(t)
+	return errs
+}
+
+func (e *EventStorage) CreateTasksStored(t []models.Task) ([]models.Task, []error) {
+	stored, errs := createAllStored(e.Storage, t)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	for i := range stored {
+		task := stored[i]
+		e.publish(Event{Type: EventCreated, Guid: task.Guid, After: &task})
+	}
+
+	return stored, nil
+}
+
+func (e *EventStorage) EditTask(oldTask, newTask models.Task) error {
+	if err := e.Storage.EditTask(oldTask, newTask); err != nil {
+		return err
+	}
+
+	// Without a ConflictError, oldTask is what was stored, and newTask is
+	// what is stored now, at the next revision. Reading them from the
+	// Storage instead could give us someone else's edit.
+	before, after := oldTask, newTask
+	after.Revision = oldTask.Revision + 1
+
+	event := Event{Type: EventEdited, Guid: after.Guid, Before: &before, After: &after}
+	if before.Finished == nil && after.Finished != nil {
+		event.Type = EventFinished
+	}
+
+	e.publish(event)
+
+	return nil
+}
+
+func (e *EventStorage) DeleteTask(guid uint64) error {
+	if !e.listening() {
+		return e.Storage.DeleteTask(guid)
+	}
+
+	before, err := e.Storage.GetTask(guid)
+	if err != nil {
+		return e.Storage.DeleteTask(guid)
+	}
+
+	if err := e.Storage.DeleteTask(guid); err != nil {
+		return err
+	}
+
+	e.publish(Event{Type: EventDeleted, Guid: guid, Before: &before})
+
+	return nil
+}
+
+func (e *EventStorage) DeleteTaskUnlinked(guid uint64) ([]models.Task, error) {
+	if !e.listening() {
+		return deleteUnlinked(e.Storage, guid)
+	}
+
+	before, err := e.Storage.GetTask(guid)
+	if err != nil {
+		return deleteUnlinked(e.Storage, guid)
+	}
+
+	unlinked, err := deleteUnlinked(e.Storage, guid)
+	if err != nil {
+		return nil, err
+	}
+
+	e.publish(Event{Type: EventDeleted, Guid: guid, Before: &before})
+
+	return unlinked, nil
+}
@@ -0,0 +1,71 @@
+package storage_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/oatmealraisin/tasker/pkg/models"
+	"github.com/oatmealraisin/tasker/pkg/storage"
+	"github.com/spf13/viper"
+)
+
+func TestEventStorage(t *testing.T) {
+	dir := t.TempDir()
+	viper.Set("WorkingDir", dir)
+
+	busy := &busyStorage{Storage: storage.NewJsonStorage(filepath.Join(dir, "tasklist.json"))}
+	e := storage.NewEventStorage(busy)
+
+	var events []storage.Event
+	cancel := e.Subscribe(func(event storage.Event) {
+		events = append(events, event)
+	})
+	defer cancel()
+
+	if errs := e.CreateTasks([]models.Task{{Name: "a"}, {Name: "b"}}); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+
+	if len(events) != 2 {
+		t.Fatalf("Got %d events for creating 2 Tasks", len(events))
+	}
+
+	for i, name := range []string{"a", "b"} {
+		if events[i].Type != storage.EventCreated || events[i].After.Name != name {
+			t.Errorf("Event %d is %s of %s, expected created of %s", i, events[i].Type, events[i].After.Name, name)
+		}
+
+		if events[i].Guid == busy.other[0] {
+			t.Errorf("Event %d is about the Task someone else created", i)
+		}
+	}
+
+	a, err := e.GetTask(events[0].Guid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	finished := a
+	finished.Finished = a.Added
+	if err := e.EditTask(a, finished); err != nil {
+		t.Fatal(err)
+	}
+
+	edit := events[2]
+	if edit.Type != storage.EventFinished || edit.Before.Finished != nil || edit.After.Finished == nil {
+		t.Errorf("Finishing a Task gave a %s event", edit.Type)
+	}
+
+	if edit.Before.Revision != a.Revision || edit.After.Revision != a.Revision+1 {
+		t.Errorf("Edit event goes from revision %d to %d, expected %d to %d", edit.Before.Revision, edit.After.Revision, a.Revision, a.Revision+1)
+	}
+
+	// A conflict isn't a change
+	if err := e.EditTask(a, finished); !storage.IsConflictError(err) {
+		t.Fatalf("EditTask with an old copy = %v, expected a ConflictError", err)
+	}
+
+	if len(events) != 3 {
+		t.Errorf("Got %d events, expected 3", len(events))
+	}
+}
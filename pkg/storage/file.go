@@ -0,0 +1,323 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/oatmealraisin/tasker/pkg/models"
+)
+
+// fileStorage is a bufferStorage that is saved by rewriting a whole file every
+// time a Task changes. The file format is up to the embedding type, through
+// encode and decode. The file is encrypted if the config has a key, see
+// sealer.
+type fileStorage struct {
+	*bufferStorage
+	name   string
+	file   *lockedFile
+	sealer *sealer
+
+	encode func(tasks []models.Task) ([]byte, error)
+	decode func(b []byte) ([]models.Task, error)
+}
+
+func newFileStorage(name, filename string, encode func([]models.Task) ([]byte, error), decode func([]byte) ([]models.Task, error)) (*fileStorage, error) {
+	file, err := openLockedFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	sealer, err := newSealer()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &fileStorage{
+		bufferStorage: newBufferStorage(),
+		name:          name,
+		file:          file,
+		sealer:        sealer,
+		encode:        encode,
+		decode:        decode,
+	}
+	result.guids = newGuidAllocator(filename + ".guid")
+	result.refresh = result.catchUp
+
+	if err = result.file.RLock(); err != nil {
+		return nil, err
+	}
+	defer result.file.Unlock()
+
+	if err = result.loadTasks(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// begin takes the write locks on the buffers and the storage file, and
+// catches up with any changes another process made since we last read it. The
+// caller must call f.end when it is done.
+//
+// The file lock is only held once per process, so the buffers are locked
+// first to keep goroutines apart.
+func (f *fileStorage) begin() error {
+	f.mu.Lock()
+
+	if err := f.file.Lock(); err != nil {
+		f.mu.Unlock()
+		return err
+	}
+
+	if f.file.Changed() {
+		if err := f.loadTasks(); err != nil {
+			f.end()
+			return err
+		}
+	}
+
+	if err := f.guids.load(); err != nil {
+		f.end()
+		return err
+	}
+
+	return nil
+}
+
+func (f *fileStorage) end() {
+	f.file.Unlock()
+	f.mu.Unlock()
+}
+
+// catchUp reloads the buffers if another process wrote the storage file since
+// we last read it. If it can't, the buffers are kept as they are.
+func (f *fileStorage) catchUp() {
+	f.mu.RLock()
+	changed := f.file.Changed()
+	f.mu.RUnlock()
+
+	if !changed {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	err := f.file.RLock()
+	if err == nil {
+		if f.file.Changed() {
+			err = f.loadTasks()
+		}
+
+		f.file.Unlock()
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: could not read the changes of another process: %s\n", f.name, err.Error())
+	}
+}
+
+func (f *fileStorage) CreateTask(t models.Task) error {
+	_, err := f.CreateTaskStored(t)
+	return err
+}
+
+func (f *fileStorage) CreateTaskStored(t models.Task) (models.Task, error) {
+	if err := f.begin(); err != nil {
+		return t, fmt.Errorf("%s.CreateTask: %s", f.name, err.Error())
+	}
+	defer f.end()
+
+	created, err := f.createTask(t)
+	if err != nil {
+		return t, err
+	}
+
+	if err := f.save(); err != nil {
+		return t, fmt.Errorf("%s.CreateTask: %s", f.name, err.Error())
+	}
+
+	return created, nil
+}
+
+func (f *fileStorage) CreateTasks(t []models.Task) []error {
+	_, errs := f.CreateTasksStored(t)
+	return errs
+}
+
+// CreateTasksStored creates all of the given Tasks with a single write. If any
+// of them fails, none of them are created.
+func (f *fileStorage) CreateTasksStored(t []models.Task) ([]models.Task, []error) {
+	if err := f.begin(); err != nil {
+		return nil, []error{fmt.Errorf("%s.CreateTasks: %s", f.name, err.Error())}
+	}
+	defer f.end()
+
+	var created []models.Task
+	var result []error
+
+	for i, task := range t {
+		stored, err := f.createTask(task)
+		if err != nil {
+			result = append(result, fmt.Errorf("Task %d (%s): %s", i, task.Name, err.Error()))
+			continue
+		}
+
+		created = append(created, stored)
+	}
+
+	if len(result) > 0 {
+		// The file hasn't been written, so it still has everything as it
+		// was before
+		if err := f.loadTasks(); err != nil {
+			result = append(result, fmt.Errorf("%s.CreateTasks: %s", f.name, err.Error()))
+		}
+
+		return nil, result
+	}
+
+	if err := f.save(); err != nil {
+		return nil, []error{fmt.Errorf("%s.CreateTasks: %s", f.name, err.Error())}
+	}
+
+	return created, nil
+}
+
+func (f *fileStorage) EditTask(oldTask, newTask models.Task) error {
+	if err := f.begin(); err != nil {
+		return fmt.Errorf("%s.EditTask: %s", f.name, err.Error())
+	}
+	defer f.end()
+
+	if err := f.editTask(oldTask, newTask); err != nil {
+		return err
+	}
+
+	if err := f.save(); err != nil {
+		return fmt.Errorf("%s.EditTask: %s", f.name, err.Error())
+	}
+
+	return nil
+}
+
+func (f *fileStorage) DeleteTask(guid uint64) error {
+	_, err := f.DeleteTaskUnlinked(guid)
+	return err
+}
+
+func (f *fileStorage) DeleteTaskUnlinked(guid uint64) ([]models.Task, error) {
+	if err := f.begin(); err != nil {
+		return nil, fmt.Errorf("%s.DeleteTask: %s", f.name, err.Error())
+	}
+	defer f.end()
+
+	unlinked, err := f.deleteTask(guid)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := f.save(); err != nil {
+		return nil, fmt.Errorf("%s.DeleteTask: %s", f.name, err.Error())
+	}
+
+	return unlinked, nil
+}
+
+// loadTasks replaces the buffers with the content of the storage file. It must
+// be called with the write lock on the buffers held.
+func (f *fileStorage) loadTasks() error {
+	r, err := f.file.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	if b, err = f.sealer.openFile(b); err != nil {
+		return err
+	}
+
+	tasks, err := f.decode(b)
+	if err != nil {
+		return err
+	}
+
+	if err := checkGuids(tasks); err != nil {
+		return err
+	}
+
+	f.reset()
+	for i := range tasks {
+		f.updateBuffers(&tasks[i])
+	}
+
+	return nil
+}
+
+// save writes a change made to the buffers to the file. If that fails, the
+// buffers are loaded from the file again, so they don't keep a change that
+// never reached it. It must be called with the write locks held.
+func (f *fileStorage) save() error {
+	err := f.writeAll()
+	if err == nil {
+		return nil
+	}
+
+	if lerr := f.loadTasks(); lerr != nil {
+		return fmt.Errorf("%s, and could not read the file again: %s", err.Error(), lerr.Error())
+	}
+
+	return err
+}
+
+// checkGuids makes sure every Task read from a file has a GUID of its own, as
+// the buffers would otherwise keep only one of them, and the rest would be
+// lost on the next write.
+func checkGuids(tasks []models.Task) error {
+	seen := make(map[uint64]int, len(tasks))
+
+	for i, task := range tasks {
+		if task.Guid == 0 {
+			return fmt.Errorf("Task %d (%s) has no GUID", i, task.Name)
+		}
+
+		if other, ok := seen[task.Guid]; ok {
+			return fmt.Errorf("Task %d (%s) has GUID %d, like Task %d", i, task.Name, task.Guid, other)
+		}
+		seen[task.Guid] = i
+	}
+
+	return nil
+}
+
+// writeAll must be called with the write locks held.
+func (f *fileStorage) writeAll() error {
+	if err := f.guids.save(); err != nil {
+		return fmt.Errorf("%s.writeAll: %s", f.name, err.Error())
+	}
+
+	b, err := f.encode(f.sortedTasks())
+	if err != nil {
+		return fmt.Errorf("%s.writeAll: %s", f.name, err.Error())
+	}
+
+	if b, err = f.sealer.sealFile(b); err != nil {
+		return fmt.Errorf("%s.writeAll: %s", f.name, err.Error())
+	}
+
+	err = f.file.Write(func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("%s.writeAll: %s", f.name, err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,596 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/oatmealraisin/tasker/pkg/models"
+)
+
+const (
+	gitTasksDir = "tasks"
+	gitGuidFile = "guid"
+	// gitIgnore keeps the lock file, which sits next to the tasks
+	// directory, and files left half written by a crash out of the
+	// repository
+	gitIgnore        = "/" + gitTasksDir + ".lock\n*.tmp*\n"
+	gitTaskExt       = ".json"
+	gitFallbackName  = "tasker"
+	gitFallbackEmail = "tasker@localhost"
+)
+
+// GitStorage keeps every Task in its own JSON file in a git repository, and
+// commits every change with a message saying what changed, so the history of
+// the Tasks is the history of the repository. The repository is only changed
+// through the git command, and can be pushed, pulled and blamed like any
+// other.
+//
+// Tasks are reloaded whenever HEAD moves, such as after a pull. GUIDs come
+// from the sequence in the "guid" file, which is committed too, but two
+// machines adding Tasks before syncing can still pick the same GUID, and git
+// will report the conflict when they merge. Nothing is changed while the
+// repository has conflicts, or Task files that don't parse.
+type GitStorage struct {
+	*bufferStorage
+	dir    string
+	lock   *lockedFile
+	sealer *sealer
+
+	// head is the commit the buffers were loaded from.
+	head string
+	// index is the git index as of the last time we checked head. Every
+	// commit changes it, so reads only ask git for HEAD when it changed.
+	index os.FileInfo
+	// identity is passed to git commit when git has no user configured.
+	identity []string
+}
+
+func NewGitStorage(dir string) Storage {
+	var err error
+
+	err = setupStorageDir()
+	if err != nil {
+		return nil
+	}
+
+	result := &GitStorage{
+		bufferStorage: newBufferStorage(),
+		dir:           dir,
+	}
+	result.guids = newGuidAllocator(filepath.Join(dir, gitGuidFile))
+	result.refresh = result.catchUp
+
+	if result.sealer, err = newSealer(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening Git Storage: %s\n", err.Error())
+		return nil
+	}
+
+	if err = result.init(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening Git Storage: %s\n", err.Error())
+		return nil
+	}
+
+	if err = result.lock.RLock(); err != nil {
+		return nil
+	}
+	defer result.lock.Unlock()
+
+	if err = result.loadTasks(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading Git Storage: %s\n", err.Error())
+		return nil
+	}
+
+	return result
+}
+
+// init creates the repository, unless dir already is one, such as a clone of
+// the repository on another machine.
+func (g *GitStorage) init() error {
+	if err := os.MkdirAll(filepath.Join(g.dir, gitTasksDir), 0755); err != nil {
+		return err
+	}
+
+	var err error
+	if g.lock, err = openLockedFile(filepath.Join(g.dir, gitTasksDir)); err != nil {
+		return err
+	}
+
+	if err = g.lock.Lock(); err != nil {
+		return err
+	}
+	defer g.lock.Unlock()
+
+	if _, err := g.git("config", "user.email"); err != nil {
+		g.identity = []string{"-c", "user.name=" + gitFallbackName, "-c", "user.email=" + gitFallbackEmail}
+	}
+
+	if _, err := os.Stat(filepath.Join(g.dir, ".git")); err == nil {
+		return nil
+	}
+
+	if _, err := g.git("init", "-q"); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(g.dir, ".gitignore"), []byte(gitIgnore), 0644); err != nil {
+		return err
+	}
+
+	return g.commit("Start keeping tasks in git", ".gitignore")
+}
+
+// git runs a git command in the repository and returns its output.
+func (g *GitStorage) git(args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = g.dir
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("git %s: %s", args[0], msg)
+		}
+
+		return "", fmt.Errorf("git %s: %s", args[0], err.Error())
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// commit stages paths, and commits them if anything changed.
+func (g *GitStorage) commit(message string, paths ...string) error {
+	if _, err := g.git(append([]string{"add", "-A", "--"}, paths...)...); err != nil {
+		return err
+	}
+
+	// diff --quiet fails when there is something to commit
+	if _, err := g.git("diff", "--cached", "--quiet"); err == nil {
+		return nil
+	}
+
+	args := append(append([]string{}, g.identity...), "commit", "-q", "-m", message)
+	if _, err := g.git(args...); err != nil {
+		return err
+	}
+
+	g.head, _ = g.git("rev-parse", "HEAD")
+
+	return nil
+}
+
+// begin takes the write locks on the buffers and the repository, and catches
+// up with any commits made since we last read it. The caller must call g.end
+// when it is done.
+func (g *GitStorage) begin() error {
+	g.mu.Lock()
+
+	if err := g.lock.Lock(); err != nil {
+		g.mu.Unlock()
+		return err
+	}
+
+	// Changes that never made it into a commit, most likely because tasker
+	// crashed in between, are committed first, so ours stay on their own.
+	// Not if they are from a merge that still has conflicts, or don't
+	// parse, since committing them would hide the problem.
+	status, err := g.git("status", "--porcelain")
+	if err == nil {
+		if paths := unmergedPaths(status); len(paths) > 0 {
+			err = fmt.Errorf("GitStorage: %s has conflicts, resolve them with git before changing any tasks: %s", g.dir, strings.Join(paths, ", "))
+		}
+	}
+
+	if err == nil {
+		status, err = g.git("status", "--porcelain", "--", gitTasksDir, gitGuidFile)
+	}
+
+	if err == nil && status != "" {
+		if err = g.loadTasks(); err != nil {
+			err = fmt.Errorf("GitStorage: the uncommitted changes in %s don't parse, fix them with git before changing any tasks: %s", g.dir, err.Error())
+		} else {
+			err = g.commit("Commit changes to tasks that weren't committed", gitTasksDir, gitGuidFile)
+		}
+	}
+
+	if err == nil {
+		var head string
+		if head, err = g.git("rev-parse", "HEAD"); err == nil && head != g.head {
+			err = g.loadTasks()
+		}
+	}
+
+	if err == nil {
+		err = g.guids.load()
+	}
+
+	if err != nil {
+		g.end()
+		return err
+	}
+
+	return nil
+}
+
+// unmergedPaths lists the paths git status --porcelain reports as unmerged.
+func unmergedPaths(status string) []string {
+	var result []string
+	for _, line := range strings.Split(status, "\n") {
+		if len(line) < 4 {
+			continue
+		}
+
+		switch line[:2] {
+		case "DD", "AU", "UD", "UA", "DU", "AA", "UU":
+			result = append(result, line[3:])
+		}
+	}
+
+	return result
+}
+
+func (g *GitStorage) end() {
+	g.lock.Unlock()
+	g.mu.Unlock()
+}
+
+// catchUp reloads the buffers if HEAD moved since we last read it, such as
+// when another process committed a change. Uncommitted changes are left for
+// the next write, see begin. If it can't, the buffers are kept as they are.
+func (g *GitStorage) catchUp() {
+	g.mu.RLock()
+	changed := g.indexChanged()
+	g.mu.RUnlock()
+
+	if !changed {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	err := g.lock.RLock()
+	if err == nil {
+		if g.indexChanged() {
+			index, _ := os.Stat(filepath.Join(g.dir, ".git", "index"))
+
+			var head string
+			if head, err = g.git("rev-parse", "HEAD"); err == nil && head != g.head {
+				err = g.loadTasks()
+			}
+
+			if err == nil {
+				g.index = index
+			}
+		}
+
+		g.lock.Unlock()
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "GitStorage: could not read the changes of another process: %s\n", err.Error())
+	}
+}
+
+func (g *GitStorage) indexChanged() bool {
+	info, err := os.Stat(filepath.Join(g.dir, ".git", "index"))
+	if err != nil || g.index == nil {
+		return true
+	}
+
+	return !os.SameFile(g.index, info) ||
+		!g.index.ModTime().Equal(info.ModTime()) ||
+		g.index.Size() != info.Size()
+}
+
+// loadTasks replaces the buffers with the Tasks in the work tree. It must be
+// called with the write lock on the buffers held.
+func (g *GitStorage) loadTasks() error {
+	head, _ := g.git("rev-parse", "HEAD")
+
+	entries, err := ioutil.ReadDir(filepath.Join(g.dir, gitTasksDir))
+	if err != nil {
+		return err
+	}
+
+	var tasks []models.Task
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() || filepath.Ext(entry.Name()) != gitTaskExt {
+			continue
+		}
+
+		task, err := g.readTask(filepath.Join(g.dir, gitTasksDir, entry.Name()))
+		if err != nil {
+			return fmt.Errorf("%s: %s", entry.Name(), err.Error())
+		}
+
+		tasks = append(tasks, task)
+	}
+
+	g.reset()
+	for i := range tasks {
+		g.updateBuffers(&tasks[i])
+	}
+
+	g.head = head
+
+	return nil
+}
+
+func (g *GitStorage) readTask(filename string) (models.Task, error) {
+	var result models.Task
+
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return result, err
+	}
+
+	if b, err = g.sealer.openFile(b); err != nil {
+		return result, err
+	}
+
+	u := jsonpb.Unmarshaler{AllowUnknownFields: true}
+	err = u.Unmarshal(bytes.NewReader(b), &result)
+
+	return result, err
+}
+
+func (g *GitStorage) taskFile(guid uint64) string {
+	return filepath.Join(g.dir, gitTasksDir, strconv.FormatUint(guid, 10)+gitTaskExt)
+}
+
+func (g *GitStorage) writeTask(task models.Task) error {
+	m := jsonpb.Marshaler{OrigName: true, Indent: "  "}
+
+	s, err := m.MarshalToString(&task)
+	if err != nil {
+		return fmt.Errorf("Could not encode Task %d: %s", task.Guid, err.Error())
+	}
+
+	b, err := g.sealer.sealFile([]byte(s + "\n"))
+	if err != nil {
+		return err
+	}
+
+	out := &lockedFile{filename: g.taskFile(task.Guid)}
+	return out.Write(func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	})
+}
+
+// save writes the given Tasks from the buffers to their files, removes the
+// files of deleted ones, and commits it all. If anything fails, the work tree
+// and the buffers go back to the last commit. It must be called with the write
+// locks held.
+func (g *GitStorage) save(message string, written, deleted []uint64) error {
+	err := g.guids.save()
+
+	for i := 0; err == nil && i < len(written); i++ {
+		var task models.Task
+		if task, err = g.getTask(written[i]); err == nil {
+			err = g.writeTask(task)
+		}
+	}
+
+	for i := 0; err == nil && i < len(deleted); i++ {
+		err = os.Remove(g.taskFile(deleted[i]))
+	}
+
+	if err == nil {
+		err = g.commit(message, gitTasksDir, gitGuidFile)
+	}
+
+	if err != nil {
+		g.rollback()
+		return err
+	}
+
+	return nil
+}
+
+// rollback throws away what save did to the work tree, apart from the GUID
+// sequence, which must never go back.
+func (g *GitStorage) rollback() {
+	g.git("reset", "-q", "--", gitTasksDir)
+	g.git("checkout", "-q", "--", gitTasksDir)
+	g.git("clean", "-fq", "--", gitTasksDir)
+
+	if err := g.loadTasks(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading Git Storage: %s\n", err.Error())
+	}
+}
+
+func (g *GitStorage) CreateTask(t models.Task) error {
+	_, err := g.CreateTaskStored(t)
+	return err
+}
+
+func (g *GitStorage) CreateTaskStored(t models.Task) (models.Task, error) {
+	if err := g.begin(); err != nil {
+		return t, fmt.Errorf("GitStorage.CreateTask: %s", err.Error())
+	}
+	defer g.end()
+
+	task, err := g.createTask(t)
+	if err != nil {
+		return t, err
+	}
+
+	if err := g.save(g.message("Add", task), withParent(task), nil); err != nil {
+		return t, fmt.Errorf("GitStorage.CreateTask: %s", err.Error())
+	}
+
+	return task, nil
+}
+
+func (g *GitStorage) CreateTasks(t []models.Task) []error {
+	_, errs := g.CreateTasksStored(t)
+	return errs
+}
+
+// CreateTasksStored creates all of the given Tasks in a single commit. If any
+// of them fails, none of them are created.
+func (g *GitStorage) CreateTasksStored(t []models.Task) ([]models.Task, []error) {
+	if err := g.begin(); err != nil {
+		return nil, []error{fmt.Errorf("GitStorage.CreateTasks: %s", err.Error())}
+	}
+	defer g.end()
+
+	var created []models.Task
+	var result []error
+	var written []uint64
+	var lines []string
+
+	for i, task := range t {
+		stored, err := g.createTask(task)
+		if err != nil {
+			result = append(result, fmt.Errorf("Task %d (%s): %s", i, task.Name, err.Error()))
+			continue
+		}
+
+		created = append(created, stored)
+		written = append(written, withParent(stored)...)
+		lines = append(lines, g.message("Add", stored))
+	}
+
+	if len(result) > 0 {
+		// Nothing has been written, so the work tree still has everything
+		// as it was before
+		if err := g.loadTasks(); err != nil {
+			result = append(result, fmt.Errorf("GitStorage.CreateTasks: %s", err.Error()))
+		}
+
+		return nil, result
+	}
+
+	message := fmt.Sprintf("Add %d tasks\n\n%s", len(t), strings.Join(lines, "\n"))
+	if len(t) == 1 {
+		message = lines[0]
+	}
+
+	if err := g.save(message, written, nil); err != nil {
+		return nil, []error{fmt.Errorf("GitStorage.CreateTasks: %s", err.Error())}
+	}
+
+	return created, nil
+}
+
+func (g *GitStorage) EditTask(oldTask, newTask models.Task) error {
+	if err := g.begin(); err != nil {
+		return fmt.Errorf("GitStorage.EditTask: %s", err.Error())
+	}
+	defer g.end()
+
+	before, err := g.getTask(oldTask.Guid)
+	if err != nil {
+		return err
+	}
+
+	if err := g.editTask(oldTask, newTask); err != nil {
+		return err
+	}
+
+	if err := g.save(g.editMessage(before, newTask), []uint64{newTask.Guid}, nil); err != nil {
+		return fmt.Errorf("GitStorage.EditTask: %s", err.Error())
+	}
+
+	return nil
+}
+
+func (g *GitStorage) DeleteTask(guid uint64) error {
+	_, err := g.DeleteTaskUnlinked(guid)
+	return err
+}
+
+func (g *GitStorage) DeleteTaskUnlinked(guid uint64) ([]models.Task, error) {
+	if err := g.begin(); err != nil {
+		return nil, fmt.Errorf("GitStorage.DeleteTask: %s", err.Error())
+	}
+	defer g.end()
+
+	task, err := g.getTask(guid)
+	if err != nil {
+		return nil, err
+	}
+
+	unlinked, err := g.deleteTask(guid)
+	if err != nil {
+		return nil, err
+	}
+
+	referrers := make([]uint64, len(unlinked))
+	for i, ref := range unlinked {
+		referrers[i] = ref.Guid
+	}
+
+	if err := g.save(g.message("Delete", task), referrers, []uint64{guid}); err != nil {
+		return nil, fmt.Errorf("GitStorage.DeleteTask: %s", err.Error())
+	}
+
+	return unlinked, nil
+}
+
+// withParent returns the GUID of a new Task, and of its parent, which lists
+// it as a subtask now.
+func withParent(task models.Task) []uint64 {
+	if task.Parent == 0 {
+		return []uint64{task.Guid}
+	}
+
+	return []uint64{task.Guid, task.Parent}
+}
+
+// message is the line of a commit message for verb done to task. The name is
+// left out when the Storage is encrypted, since commit messages aren't.
+func (g *GitStorage) message(verb string, task models.Task) string {
+	if g.sealer != nil {
+		return fmt.Sprintf("%s task %d", verb, task.Guid)
+	}
+
+	return fmt.Sprintf("%s task %d: %s", verb, task.Guid, task.Name)
+}
+
+// editMessage describes an edit, with a line for each field that changed,
+// unless the Storage is encrypted.
+func (g *GitStorage) editMessage(before, after models.Task) string {
+	verb := map[string]string{
+		HistoryEdit:   "Edit",
+		HistoryFinish: "Finish",
+		HistoryRemove: "Remove",
+	}[editOp(before, after)]
+
+	message := g.message(verb, after)
+	if g.sealer != nil {
+		return message
+	}
+
+	changes := diffTasks(before, after)
+	if len(changes) == 0 {
+		return message
+	}
+
+	lines := make([]string, len(changes))
+	for i, change := range changes {
+		lines[i] = fmt.Sprintf("%s: %s -> %s", change.Field, gitValue(change.Old), gitValue(change.New))
+	}
+
+	return message + "\n\n" + strings.Join(lines, "\n")
+}
+
+func gitValue(value string) string {
+	if value == "" {
+		return "(none)"
+	}
+
+	return value
+}
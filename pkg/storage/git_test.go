@@ -0,0 +1,156 @@
+package storage_test
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/oatmealraisin/tasker/pkg/models"
+	"github.com/oatmealraisin/tasker/pkg/storage"
+	"github.com/spf13/viper"
+)
+
+// skipWithoutGit skips tests of the Git Storage where git isn't installed.
+func skipWithoutGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't on the PATH")
+	}
+}
+
+// gitStorage opens a GitStorage with one Task in it, and returns the
+// repository and the file of the Task along with it.
+func gitStorage(t *testing.T) (storage.Storage, string, string) {
+	s := tempStorage(storage.NewGitStorage, "tasklist")(t)
+	if s == nil {
+		t.Fatal("Could not open the Git Storage")
+	}
+
+	if err := s.CreateTask(models.Task{Name: "task"}); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(viper.GetString("WorkingDir"), "tasklist")
+	files, err := filepath.Glob(filepath.Join(dir, "tasks", "*.json"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Expected the file of one Task, found %v, %v", files, err)
+	}
+
+	return s, dir, files[0]
+}
+
+// git runs a git command in dir, and fails the test if it fails.
+func git(t *testing.T, dir string, args ...string) string {
+	out, err := gitCommand(dir, args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %s", strings.Join(args, " "), out)
+	}
+
+	return strings.TrimSpace(string(out))
+}
+
+func gitCommand(dir string, args ...string) *exec.Cmd {
+	cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@localhost"}, args...)...)
+	cmd.Dir = dir
+
+	return cmd
+}
+
+func TestGitStorageRefusesConflicts(t *testing.T) {
+	skipWithoutGit(t)
+	s, dir, file := gitStorage(t)
+
+	branch := git(t, dir, "rev-parse", "--abbrev-ref", "HEAD")
+	git(t, dir, "checkout", "-q", "-b", "other")
+	if err := ioutil.WriteFile(file, []byte("{\"name\": \"theirs\"}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	git(t, dir, "commit", "-q", "-am", "theirs")
+
+	git(t, dir, "checkout", "-q", branch)
+	if err := ioutil.WriteFile(file, []byte("{\"name\": \"ours\"}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	git(t, dir, "commit", "-q", "-am", "ours")
+	if err := gitCommand(dir, "merge", "-q", "other").Run(); err == nil {
+		t.Fatal("Expected the merge to conflict")
+	}
+	head := git(t, dir, "rev-parse", "HEAD")
+
+	if err := s.CreateTask(models.Task{Name: "another"}); err == nil {
+		t.Error("CreateTask succeeded in the middle of a merge with conflicts")
+	}
+
+	if after := git(t, dir, "rev-parse", "HEAD"); after != head {
+		t.Errorf("Expected nothing to be committed, HEAD moved from %s to %s", head, after)
+	}
+
+	if status := git(t, dir, "status", "--porcelain"); !strings.HasPrefix(status, "UU") {
+		t.Errorf("Expected the conflict to be left alone, git status says %q", status)
+	}
+}
+
+func TestGitStorageRefusesBrokenChanges(t *testing.T) {
+	skipWithoutGit(t)
+	s, dir, file := gitStorage(t)
+	head := git(t, dir, "rev-parse", "HEAD")
+
+	if err := ioutil.WriteFile(file, []byte("{\"name\": "), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.CreateTask(models.Task{Name: "another"}); err == nil {
+		t.Error("CreateTask succeeded with a Task file that doesn't parse")
+	}
+
+	if after := git(t, dir, "rev-parse", "HEAD"); after != head {
+		t.Errorf("Expected nothing to be committed, HEAD moved from %s to %s", head, after)
+	}
+}
+
+func TestGitStorageEncryptedLog(t *testing.T) {
+	skipWithoutGit(t)
+	viper.Set("EncryptionKey", "hunter2")
+	defer viper.Set("EncryptionKey", "")
+
+	s := tempStorage(storage.NewGitStorage, "tasklist")(t)
+	if s == nil {
+		t.Fatal("Could not open the Git Storage")
+	}
+	dir := filepath.Join(viper.GetString("WorkingDir"), "tasklist")
+
+	errs := s.CreateTasks([]models.Task{{Name: "first secret"}, {Name: "second secret"}})
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+
+	guids := s.GetAllTasks()
+	if len(guids) != 2 {
+		t.Fatalf("Expected two Tasks, found %v", guids)
+	}
+
+	task, err := s.GetTask(guids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	edited := task
+	edited.Name = "renamed secret"
+	edited.Tags = []string{"secret-tag"}
+	if err := s.EditTask(task, edited); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.DeleteTask(guids[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.CreateTask(models.Task{Name: "third secret"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if log := git(t, dir, "log", "--format=%B"); strings.Contains(log, "secret") {
+		t.Errorf("Expected no names or fields in the log of an encrypted repository, found:\n%s", log)
+	}
+}
@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// guidAllocator hands out the GUIDs of new Tasks. GUIDs only ever go up, and
+// the last one handed out is kept in a file next to the storage file, so a
+// GUID isn't reused after its Task is deleted, even by another process. The
+// SQL backends keep the same sequence in their guid_sequence table instead.
+//
+// It must only be used with the write lock of the storage held, except for
+// observe while the storage is being opened.
+type guidAllocator struct {
+	// file is only used to replace the sequence in one go, the lock of the
+	// storage file covers it. It is nil for Storages that only live in memory.
+	file *lockedFile
+
+	last  uint64
+	saved uint64
+}
+
+func newGuidAllocator(filename string) *guidAllocator {
+	return &guidAllocator{file: &lockedFile{filename: filename}}
+}
+
+// load catches up with GUIDs handed out by other processes.
+func (g *guidAllocator) load() error {
+	if g.file == nil {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(g.file.filename)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Could not read GUID sequence: %s", err.Error())
+	}
+
+	last, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return fmt.Errorf("Could not read GUID sequence %s: %s", g.file.filename, err.Error())
+	}
+
+	g.observe(last)
+	g.saved = last
+
+	return nil
+}
+
+// observe makes sure guid is never handed out, because a Task already has it.
+// Storages observe every Task they load, so the sequence starts after the
+// existing Tasks when it is first used.
+func (g *guidAllocator) observe(guid uint64) {
+	if guid > g.last {
+		g.last = guid
+	}
+}
+
+func (g *guidAllocator) next() uint64 {
+	g.last++
+	return g.last
+}
+
+// save writes the sequence out if it moved. It has to be called before the
+// Tasks using the new GUIDs are saved, so a crash in between only skips GUIDs.
+func (g *guidAllocator) save() error {
+	if g.file == nil || g.last <= g.saved {
+		return nil
+	}
+
+	err := g.file.Write(func(w io.Writer) error {
+		_, err := fmt.Fprintf(w, "%d\n", g.last)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Could not save GUID sequence: %s", err.Error())
+	}
+
+	g.saved = g.last
+
+	return nil
+}
@@ -0,0 +1,523 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/ptypes"
+	tspb "github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/oatmealraisin/tasker/pkg/models"
+)
+
+const (
+	HistoryCreate = "create"
+	HistoryEdit   = "edit"
+	HistoryFinish = "finish"
+	HistoryRemove = "remove"
+	HistoryDelete = "delete"
+	// HistoryUndo puts a Task back the way it was before the change Undoes,
+	// see HistoryStorage.Undo.
+	HistoryUndo = "undo"
+)
+
+// HistoryEntry is one change to a Task.
+type HistoryEntry struct {
+	Time time.Time `json:"time"`
+	// Change is shared by the entries made by a single call, such as
+	// CreateTasks, so they are undone together.
+	Change  int64         `json:"change,omitempty"`
+	Guid    uint64        `json:"guid"`
+	Op      string        `json:"op"`
+	Changes []FieldChange `json:"changes,omitempty"`
+	Undoes  int64         `json:"undoes,omitempty"`
+	// Created is set on creates of Tasks the Storage said were created by
+	// that call, see Creator. Older creates may name Tasks someone else
+	// created at the same time, so Undo doesn't delete those.
+	Created bool `json:"created,omitempty"`
+
+	// Before and After are the whole Task, in the format of the JSON
+	// Storage, so the change can be undone. Creates have no Before, and
+	// deletes no After.
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+}
+
+// FieldChange is the old and new value of a field of a Task, as text. A value
+// that isn't set is empty.
+type FieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old,omitempty"`
+	New   string `json:"new,omitempty"`
+}
+
+// HistoryStorage passes every change made through it on to the Storage it
+// wraps, and then records it in a history file, one JSON HistoryEntry per
+// line. Changes made to the wrapped Storage directly aren't recorded.
+//
+// With an encryption key, the history is encrypted like the storage, a line
+// at a time, see sealer.sealLine.
+type HistoryStorage struct {
+	Storage
+	filename string
+
+	mu         sync.Mutex
+	lastChange int64
+
+	sealer    *sealer
+	sealerErr error
+	// salt is the one in the encryption header the history file is known to
+	// have, if any.
+	salt []byte
+}
+
+func NewHistoryStorage(s Storage, filename string) *HistoryStorage {
+	result := &HistoryStorage{Storage: s, filename: filename}
+
+	// Reported when the history is used, as recording changes in the clear
+	// would defeat the point
+	result.sealer, result.sealerErr = newSealer()
+
+	return result
+}
+
+func (h *HistoryStorage) Unwrap() Storage {
+	return h.Storage
+}
+
+func (h *HistoryStorage) CreateTask(t models.Task) error {
+	_, err := h.CreateTaskStored(t)
+	return err
+}
+
+func (h *HistoryStorage) CreateTaskStored(t models.Task) (models.Task, error) {
+	change := h.newChange()
+
+	stored, err := createStored(h.Storage, t)
+	if err != nil {
+		return t, err
+	}
+
+	if stored == nil {
+		h.unrecorded(t)
+		return t, nil
+	}
+
+	h.record(change, HistoryCreate, nil, stored)
+
+	return *stored, nil
+}
+
+func (h *HistoryStorage) CreateTasks(t []models.Task) []error {
+	_, errs := h.CreateTasksStored(t)
+	return errs
+}
+
+func (h *HistoryStorage) CreateTasksStored(t []models.Task) ([]models.Task, []error) {
+	change := h.newChange()
+
+	stored, errs := createAllStored(h.Storage, t)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	if len(stored) < len(t) {
+		h.unrecorded(t...)
+	}
+
+	for i := range stored {
+		h.record(change, HistoryCreate, nil, &stored[i])
+	}
+
+	return stored, nil
+}
+
+// unrecorded warns that Tasks without a GUID were created in a Storage that
+// doesn't say which GUIDs it gave them, so their creation can't be undone.
+func (h *HistoryStorage) unrecorded(tasks ...models.Task) {
+	for _, task := range tasks {
+		if task.Guid == 0 {
+			fmt.Fprintf(os.Stderr, "Could not record history of new Task %s: the storage doesn't say which GUID it has\n", task.Name)
+		}
+	}
+}
+
+func (h *HistoryStorage) EditTask(oldTask, newTask models.Task) error {
+	// The caller's copy may be out of date, and the Storage may fill some
+	// fields in, so we diff what was actually stored
+	before, err := h.Storage.GetTask(oldTask.Guid)
+	if err != nil {
+		before = oldTask
+	}
+
+	if err := h.Storage.EditTask(oldTask, newTask); err != nil {
+		return err
+	}
+
+	after, err := h.Storage.GetTask(newTask.Guid)
+	if err != nil {
+		after = newTask
+	}
+
+	h.record(h.newChange(), editOp(before, after), &before, &after)
+
+	return nil
+}
+
+func (h *HistoryStorage) DeleteTask(guid uint64) error {
+	_, err := h.DeleteTaskUnlinked(guid)
+	return err
+}
+
+func (h *HistoryStorage) DeleteTaskUnlinked(guid uint64) ([]models.Task, error) {
+	before, err := h.Storage.GetTask(guid)
+	if err != nil {
+		return deleteUnlinked(h.Storage, guid)
+	}
+
+	// The Storage takes the Task off the subtasks and dependencies of other
+	// Tasks too. Those edits are part of the change, so undoing it puts the
+	// links back.
+	referrers, err := deleteUnlinked(h.Storage, guid)
+	if err != nil {
+		return nil, err
+	}
+
+	change := h.newChange()
+	h.record(change, HistoryDelete, &before, nil)
+
+	// Recorded after the delete, so they are undone before the Task is
+	// created again, and its parent lists it where it used to
+	for i := range referrers {
+		after, err := h.Storage.GetTask(referrers[i].Guid)
+		if err != nil {
+			continue
+		}
+
+		h.record(change, HistoryEdit, &referrers[i], &after)
+	}
+
+	return referrers, nil
+}
+
+// newChange returns an ID for the entries of a single call. IDs go up with
+// time, and never repeat within a process.
+func (h *HistoryStorage) newChange() int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	result := time.Now().UnixNano()
+	if result <= h.lastChange {
+		result = h.lastChange + 1
+	}
+	h.lastChange = result
+
+	return result
+}
+
+// record appends an entry to the history file. The change has already been
+// made by then, so failing to record it is only reported.
+func (h *HistoryStorage) record(change int64, op string, before, after *models.Task) {
+	entry := HistoryEntry{Time: time.Now(), Change: change, Op: op, Created: op == HistoryCreate}
+
+	var err error
+	if before != nil {
+		entry.Guid = before.Guid
+		if entry.Before, err = historySnapshot(before); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not record history of Task %d: %s\n", entry.Guid, err.Error())
+			return
+		}
+	}
+
+	if after != nil {
+		entry.Guid = after.Guid
+		if entry.After, err = historySnapshot(after); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not record history of Task %d: %s\n", entry.Guid, err.Error())
+			return
+		}
+	}
+
+	var empty models.Task
+	if before == nil {
+		before = &empty
+	}
+
+	if after == nil {
+		after = &empty
+	}
+
+	entry.Changes = diffTasks(*before, *after)
+	if op == HistoryEdit && len(entry.Changes) == 0 {
+		return
+	}
+
+	if err := h.append(entry); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not record history of Task %d: %s\n", entry.Guid, err.Error())
+	}
+}
+
+func (h *HistoryStorage) append(entries ...HistoryEntry) error {
+	var buf bytes.Buffer
+	for _, entry := range entries {
+		b, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+
+		buf.Write(b)
+		buf.WriteByte('\n')
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.sealerErr != nil {
+		return h.sealerErr
+	}
+
+	f, err := os.OpenFile(h.filename, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	b := buf.Bytes()
+
+	if h.sealer != nil {
+		if h.salt == nil {
+			var written bool
+			if h.salt, written, err = h.sealHistory(f, b); err != nil {
+				return err
+			}
+
+			if written {
+				return nil
+			}
+		}
+
+		var salt []byte
+		if b, salt, err = h.sealer.sealLine(b, h.salt); err != nil {
+			return err
+		}
+		h.salt = salt
+	}
+
+	// A single write, so entries from other processes don't interleave
+	if _, err := f.Write(b); err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+// sealHistory encrypts what was recorded before there was an encryption key,
+// and returns the salt of the header the history file starts with. If there
+// was anything to encrypt, the new entries are written with it, since f is
+// the file being replaced, and it reports that they have been. It must be
+// called with h.mu held.
+func (h *HistoryStorage) sealHistory(f *os.File, entries []byte) ([]byte, bool, error) {
+	content, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if len(content) == 0 || bytes.HasPrefix(content, []byte(sealedLinePrefix)) {
+		return lineSalt(bytes.NewReader(content)), false, nil
+	}
+
+	plain, _, err := h.sealer.openLines(bytes.NewReader(content))
+	if err != nil {
+		return nil, false, err
+	}
+
+	// A line cut short by a crash mustn't swallow the first new entry
+	if len(plain) > 0 && plain[len(plain)-1] != '\n' {
+		plain = append(plain, '\n')
+	}
+
+	b, salt, err := h.sealer.sealLine(append(plain, entries...), nil)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Replaced in one go, so a crash can't leave the history half sealed.
+	// Entries another process appends meanwhile are lost, but only this once.
+	out := &lockedFile{filename: h.filename, release: func() { f.Close() }}
+	err = out.Write(func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	return salt, true, nil
+}
+
+// History returns every recorded change to the Task with the given GUID,
+// oldest first.
+func (h *HistoryStorage) History(guid uint64) ([]HistoryEntry, error) {
+	entries, err := h.entries()
+	if err != nil {
+		return nil, fmt.Errorf("HistoryStorage.History: %s", err.Error())
+	}
+
+	var result []HistoryEntry
+	for _, entry := range entries {
+		if entry.Guid == guid {
+			result = append(result, entry)
+		}
+	}
+
+	return result, nil
+}
+
+// entries reads the whole history file, oldest first.
+func (h *HistoryStorage) entries() ([]HistoryEntry, error) {
+	if h.sealerErr != nil {
+		return nil, h.sealerErr
+	}
+
+	f, err := os.Open(h.filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Lines that can't be decrypted are skipped, like lines that can't be
+	// parsed below
+	plain, _, err := h.sealer.openLines(f)
+	if err == errSealedNoKey || err == errSealedWrongKey {
+		return nil, err
+	}
+
+	var result []HistoryEntry
+
+	scanner := bufio.NewScanner(bytes.NewReader(plain))
+	scanner.Buffer(nil, 16*1024*1024)
+
+	for scanner.Scan() {
+		var entry HistoryEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// Most likely the last line, cut short by a crash
+			continue
+		}
+
+		result = append(result, entry)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Time.Before(result[j].Time) })
+
+	return result, nil
+}
+
+func historySnapshot(task *models.Task) (json.RawMessage, error) {
+	m := jsonpb.Marshaler{OrigName: true}
+
+	s, err := m.MarshalToString(task)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.RawMessage(s), nil
+}
+
+func historyTask(snapshot json.RawMessage) (models.Task, error) {
+	var result models.Task
+	err := jsonpb.Unmarshal(bytes.NewReader(snapshot), &result)
+
+	return result, err
+}
+
+// editOp names an edit after what it did, if it finished or removed the Task.
+func editOp(before, after models.Task) string {
+	if before.Finished == nil && after.Finished != nil {
+		return HistoryFinish
+	}
+
+	if !before.Removed && after.Removed {
+		return HistoryRemove
+	}
+
+	return HistoryEdit
+}
+
+// diffTasks lists the fields that differ between two versions of a Task. The
+// revision and add date aren't edits, and the dependants are left out, since
+// some Storages derive them from the dependencies of other Tasks.
+func diffTasks(before, after models.Task) []FieldChange {
+	var result []FieldChange
+
+	diff := func(field, old, new string) {
+		if old != new {
+			result = append(result, FieldChange{Field: field, Old: old, New: new})
+		}
+	}
+
+	diff("name", before.Name, after.Name)
+	diff("size", historyUint(uint64(before.Size)), historyUint(uint64(after.Size)))
+	diff("priority", historyUint(uint64(before.Priority)), historyUint(uint64(after.Priority)))
+	diff("due", historyTimestamp(before.Due), historyTimestamp(after.Due))
+	diff("tags", strings.Join(before.Tags, ","), strings.Join(after.Tags, ","))
+	diff("url", before.Url, after.Url)
+	diff("parent", historyUint(before.Parent), historyUint(after.Parent))
+	diff("active", historyTimestamp(before.Active), historyTimestamp(after.Active))
+	diff("finished", historyTimestamp(before.Finished), historyTimestamp(after.Finished))
+	diff("removed", historyBool(before.Removed), historyBool(after.Removed))
+	diff("repeats", historyBool(before.Repeats), historyBool(after.Repeats))
+	diff("guid_previous", historyUint(uint64(before.GuidPrevious)), historyUint(uint64(after.GuidPrevious)))
+	diff("subtasks", historyGuids(before.Subtasks), historyGuids(after.Subtasks))
+	diff("dependencies", historyGuids(before.Dependencies), historyGuids(after.Dependencies))
+
+	return result
+}
+
+func historyGuids(guids []uint64) string {
+	result := make([]string, len(guids))
+	for i, guid := range guids {
+		result[i] = strconv.FormatUint(guid, 10)
+	}
+
+	return strings.Join(result, ",")
+}
+
+func historyUint(n uint64) string {
+	if n == 0 {
+		return ""
+	}
+
+	return strconv.FormatUint(n, 10)
+}
+
+func historyBool(b bool) string {
+	if !b {
+		return ""
+	}
+
+	return "true"
+}
+
+func historyTimestamp(t *tspb.Timestamp) string {
+	result, err := ptypes.Timestamp(t)
+	if err != nil {
+		return ""
+	}
+
+	return result.Format(time.RFC3339)
+}
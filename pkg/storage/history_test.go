@@ -0,0 +1,339 @@
+package storage_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/oatmealraisin/tasker/pkg/models"
+	"github.com/oatmealraisin/tasker/pkg/storage"
+	"github.com/oatmealraisin/tasker/pkg/storage/storagetest"
+	"github.com/spf13/viper"
+)
+
+func historyStorage(t *testing.T) *storage.HistoryStorage {
+	s := jsonStorage(t)
+	return storage.NewHistoryStorage(s, filepath.Join(viper.GetString("WorkingDir"), "history.jsonl"))
+}
+
+func TestHistoryStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return historyStorage(t)
+	})
+}
+
+// busyStorage creates another Task whenever a Task is created through it, like
+// a plugin or another process would at the same time.
+type busyStorage struct {
+	storage.Storage
+	other []uint64
+}
+
+func (b *busyStorage) CreateTaskStored(t models.Task) (models.Task, error) {
+	b.busy()
+	return b.Storage.(storage.Creator).CreateTaskStored(t)
+}
+
+func (b *busyStorage) CreateTasksStored(t []models.Task) ([]models.Task, []error) {
+	b.busy()
+	return b.Storage.(storage.Creator).CreateTasksStored(t)
+}
+
+func (b *busyStorage) busy() {
+	other, _ := b.Storage.(storage.Creator).CreateTaskStored(models.Task{Name: "other"})
+	b.other = append(b.other, other.Guid)
+}
+
+func TestHistoryRecordsOnlyItsCreates(t *testing.T) {
+	h := historyStorage(t)
+	busy := &busyStorage{Storage: h.Unwrap()}
+	h = storage.NewHistoryStorage(busy, filepath.Join(viper.GetString("WorkingDir"), "history.jsonl"))
+
+	if err := h.CreateTask(models.Task{Name: "mine"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if errs := h.CreateTasks([]models.Task{{Name: "mine too"}, {Name: "and mine"}}); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+
+	for _, guid := range busy.other {
+		if entries, err := h.History(guid); err != nil || len(entries) != 0 {
+			t.Errorf("History(%d) of a Task created by someone else = %v, %v", guid, entries, err)
+		}
+	}
+
+	for _, name := range []string{"mine", "mine too", "and mine"} {
+		guids := h.GetByName(name)
+		if len(guids) != 1 {
+			t.Fatalf("GetByName(%s) = %v", name, guids)
+		}
+
+		entries, err := h.History(guids[0])
+		if err != nil || len(entries) != 1 || entries[0].Op != storage.HistoryCreate {
+			t.Errorf("History(%d) of %s = %v, %v, expected a create", guids[0], name, entries, err)
+		}
+	}
+}
+
+func TestHistoryUndoDeletesOnlyItsCreates(t *testing.T) {
+	h := historyStorage(t)
+	busy := &busyStorage{Storage: h.Unwrap()}
+	h = storage.NewHistoryStorage(busy, filepath.Join(viper.GetString("WorkingDir"), "history.jsonl"))
+
+	if errs := h.CreateTasks([]models.Task{{Name: "mine"}, {Name: "mine too"}}); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+
+	undone, err := h.Undo(1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(undone) != 2 {
+		t.Errorf("Undo undid %d entries, expected 2", len(undone))
+	}
+
+	if all := h.GetAllTasks(); len(all) != 1 || all[0] != busy.other[0] {
+		t.Errorf("GetAllTasks = %v after the undo, expected only the other Task %v", all, busy.other)
+	}
+}
+
+func TestHistoryRecordsEveryField(t *testing.T) {
+	h := historyStorage(t)
+
+	if errs := h.CreateTasks([]models.Task{{Name: "task"}, {Name: "dependency"}}); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+
+	task, err := h.GetTask(h.GetByName("task")[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	edited := task
+	edited.Dependencies = h.GetByName("dependency")
+	edited.Repeats = true
+	edited.GuidPrevious = 7
+	if err := h.EditTask(task, edited); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := h.History(task.Guid)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("History(%d) = %v, %v, expected a create and an edit", task.Guid, entries, err)
+	}
+
+	fields := map[string]bool{}
+	for _, change := range entries[1].Changes {
+		fields[change.Field] = true
+	}
+
+	for _, field := range []string{"dependencies", "repeats", "guid_previous"} {
+		if !fields[field] {
+			t.Errorf("The edit has no change to %s: %v", field, entries[1].Changes)
+		}
+	}
+}
+
+func TestHistoryUndoRestoresLinks(t *testing.T) {
+	h := historyStorage(t)
+
+	if errs := h.CreateTasks([]models.Task{{Name: "a"}, {Name: "b"}, {Name: "dependency"}}); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	a, b, dependency := h.GetByName("a")[0], h.GetByName("b")[0], h.GetByName("dependency")[0]
+
+	if err := h.CreateTask(models.Task{Name: "sub", Parent: a}); err != nil {
+		t.Fatal(err)
+	}
+
+	sub, _ := h.GetTask(h.GetByName("sub")[0])
+	moved := sub
+	moved.Parent = b
+	moved.Dependencies = []uint64{dependency}
+	if err := h.EditTask(sub, moved); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := h.Undo(1, false); err != nil {
+		t.Fatal(err)
+	}
+
+	undone, _ := h.GetTask(sub.Guid)
+	if undone.Parent != a || len(undone.Dependencies) != 0 {
+		t.Errorf("After the undo, the subtask has parent %d and dependencies %v, expected %d and none", undone.Parent, undone.Dependencies, a)
+	}
+
+	if parent, _ := h.GetTask(a); !containsGuid(parent.Subtasks, sub.Guid) {
+		t.Errorf("Subtasks of the old parent = %v, expected it to list %d again", parent.Subtasks, sub.Guid)
+	}
+
+	if parent, _ := h.GetTask(b); containsGuid(parent.Subtasks, sub.Guid) {
+		t.Errorf("Subtasks of the new parent = %v, expected it not to list %d", parent.Subtasks, sub.Guid)
+	}
+}
+
+// listingStorage counts the calls to GetAllTasks, and passes deletes on to a
+// Deleter.
+type listingStorage struct {
+	storage.Storage
+	listed int
+}
+
+func (l *listingStorage) GetAllTasks() []uint64 {
+	l.listed++
+	return l.Storage.GetAllTasks()
+}
+
+func (l *listingStorage) DeleteTaskUnlinked(guid uint64) ([]models.Task, error) {
+	return l.Storage.(storage.Deleter).DeleteTaskUnlinked(guid)
+}
+
+func TestHistoryDeleteAsksTheDeleter(t *testing.T) {
+	s := &listingStorage{Storage: jsonStorage(t)}
+	h := storage.NewHistoryStorage(s, filepath.Join(viper.GetString("WorkingDir"), "history.jsonl"))
+
+	if err := h.CreateTask(models.Task{Name: "parent"}); err != nil {
+		t.Fatal(err)
+	}
+	parent := h.GetByName("parent")[0]
+
+	if err := h.CreateTask(models.Task{Name: "sub", Parent: parent}); err != nil {
+		t.Fatal(err)
+	}
+	sub := h.GetByName("sub")[0]
+
+	s.listed = 0
+	if err := h.DeleteTask(sub); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.listed != 0 {
+		t.Errorf("DeleteTask listed every Task %d times, expected the Deleter to say which Tasks it changed", s.listed)
+	}
+
+	if _, err := h.Undo(1, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if task, _ := h.GetTask(parent); !containsGuid(task.Subtasks, sub) {
+		t.Errorf("Subtasks of the parent after the undo = %v, expected it to list %d again", task.Subtasks, sub)
+	}
+}
+
+func TestHistoryUndoRefusesLinksChangedSince(t *testing.T) {
+	h := historyStorage(t)
+
+	if errs := h.CreateTasks([]models.Task{{Name: "task"}, {Name: "dependency"}}); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+
+	task, _ := h.GetTask(h.GetByName("task")[0])
+	edited := task
+	edited.Name = "renamed"
+	if err := h.EditTask(task, edited); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another process adds a dependency, without going through the history
+	task, _ = h.GetTask(task.Guid)
+	edited = task
+	edited.Dependencies = h.GetByName("dependency")
+	if err := h.Unwrap().EditTask(task, edited); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := h.Undo(1, false); err == nil {
+		t.Error("Undo succeeded, though the dependencies changed since")
+	}
+
+	if task, _ = h.GetTask(task.Guid); task.Name != "renamed" || len(task.Dependencies) != 1 {
+		t.Errorf("Expected the Task to be left alone, found %s with dependencies %v", task.Name, task.Dependencies)
+	}
+}
+
+func TestHistoryUndoCarriesOnAfterFailing(t *testing.T) {
+	h := historyStorage(t)
+
+	if errs := h.CreateTasks([]models.Task{{Name: "first"}, {Name: "second"}}); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+
+	// Another process renames the first, so it can't be undone for now
+	first, _ := h.GetTask(h.GetByName("first")[0])
+	renamed := first
+	renamed.Name = "renamed"
+	if err := h.Unwrap().EditTask(first, renamed); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := h.Undo(1, false); err == nil {
+		t.Fatal("Undo succeeded, though the first Task changed since")
+	}
+
+	if all := h.GetAllTasks(); len(all) != 1 || all[0] != first.Guid {
+		t.Fatalf("GetAllTasks = %v after the undo, expected only %d", all, first.Guid)
+	}
+
+	// Once it's renamed back, the rest of the change can be undone
+	renamed, _ = h.GetTask(first.Guid)
+	first.Revision = renamed.Revision
+	if err := h.Unwrap().EditTask(renamed, first); err != nil {
+		t.Fatal(err)
+	}
+
+	undone, err := h.Undo(1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(undone) != 1 || undone[0].Guid != first.Guid {
+		t.Errorf("Undo undid %v, expected the create of %d", undone, first.Guid)
+	}
+
+	if all := h.GetAllTasks(); len(all) != 0 {
+		t.Errorf("GetAllTasks = %v after undoing again, expected none", all)
+	}
+}
+
+func TestHistorySealsEarlierEntries(t *testing.T) {
+	h := historyStorage(t)
+	filename := filepath.Join(viper.GetString("WorkingDir"), "history.jsonl")
+
+	if err := h.CreateTask(models.Task{Name: "plain"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Turning encryption on seals what was recorded so far, along with the
+	// next change
+	viper.Set("EncryptionKey", "hunter2")
+	defer viper.Set("EncryptionKey", "")
+	h = storage.NewHistoryStorage(h.Unwrap(), filename)
+
+	if err := h.CreateTask(models.Task{Name: "sealed"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"plain", "sealed"} {
+		guid := h.GetByName(name)[0]
+		if entries, err := h.History(guid); err != nil || len(entries) != 1 {
+			t.Errorf("History of %s = %v, %v, expected its create", name, entries, err)
+		}
+	}
+
+	if b, err := ioutil.ReadFile(filename); err != nil || bytes.Contains(b, []byte("plain")) {
+		t.Errorf("Expected the history to be sealed, found %q, %v", b, err)
+	}
+}
+
+func containsGuid(l []uint64, u uint64) bool {
+	for _, guid := range l {
+		if guid == u {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,35 +1,94 @@
 package storage
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"os"
 
+	"github.com/golang/protobuf/jsonpb"
 	"github.com/oatmealraisin/tasker/pkg/models"
 )
 
+const jsonFormatVersion = 1
+
+// JsonStorage keeps every Task in a single, indented JSON file. Tasks are
+// written in GUID order with every field of the Task, so the file is lossless
+// and changes show up as small diffs.
 type JsonStorage struct {
-	f os.File
+	*fileStorage
 }
 
-func (j *JsonStorage) CreateTask(t *models.Task) error {
-	panic("not implemented")
+type jsonFile struct {
+	Version int               `json:"version"`
+	Tasks   []json.RawMessage `json:"tasks"`
 }
 
-func (j *JsonStorage) CreateTasks(t []*models.Task) []error {
-	panic("not implemented")
-}
+func NewJsonStorage(filename string) Storage {
+	var err error
 
-func (j *JsonStorage) GetTask(guid uint64) (models.Task, error) {
-	panic("not implemented")
-}
+	err = setupStorageDir()
+	if err != nil {
+		return nil
+	}
+
+	result := new(JsonStorage)
+	result.fileStorage, err = newFileStorage("JsonStorage", filename, tasksToJson, tasksFromJson)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading JSON Storage: %s\n", err.Error())
+		return nil
+	}
 
-func (j *JsonStorage) GetByTag(tag string) ([]models.Task, error) {
-	panic("not implemented")
+	return result
 }
 
-func (j *JsonStorage) GetByName(name string) ([]models.Task, error) {
-	panic("not implemented")
+// tasksToJson encodes Tasks in the format of the JSON Storage file.
+func tasksToJson(tasks []models.Task) ([]byte, error) {
+	m := jsonpb.Marshaler{OrigName: true}
+	f := jsonFile{
+		Version: jsonFormatVersion,
+		Tasks:   make([]json.RawMessage, len(tasks)),
+	}
+
+	for i := range tasks {
+		s, err := m.MarshalToString(&tasks[i])
+		if err != nil {
+			return nil, fmt.Errorf("Could not encode Task %d: %s", tasks[i].Guid, err.Error())
+		}
+
+		f.Tasks[i] = json.RawMessage(s)
+	}
+
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append(b, '\n'), nil
 }
 
-func (j *JsonStorage) GetAllTasks() ([]models.Task, error) {
-	panic("not implemented")
+func tasksFromJson(b []byte) ([]models.Task, error) {
+	if len(bytes.TrimSpace(b)) == 0 {
+		return nil, nil
+	}
+
+	var f jsonFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, err
+	}
+
+	if f.Version > jsonFormatVersion {
+		return nil, fmt.Errorf("JSON Storage has format version %d, this tasker only reads up to %d", f.Version, jsonFormatVersion)
+	}
+
+	result := make([]models.Task, len(f.Tasks))
+
+	u := jsonpb.Unmarshaler{AllowUnknownFields: true}
+	for i, raw := range f.Tasks {
+		if err := u.Unmarshal(bytes.NewReader(raw), &result[i]); err != nil {
+			return nil, fmt.Errorf("Task %d: %s", i, err.Error())
+		}
+	}
+
+	return result, nil
 }
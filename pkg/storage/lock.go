@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// lockedFile guards a storage file that is shared between processes, such as
+// two tasker invocations, or a plugin and the CLI.
+//
+// Writers never modify the file in place. They write a temporary file next to
+// it and rename it over the old one, so a crash leaves either the old or the
+// new list behind, never half of one. Readers and writers take an advisory
+// lock on a separate ".lock" file, because the storage file itself is
+// replaced on every write. Locking and replacing are platform specific, see
+// lock_unix.go and lock_windows.go.
+type lockedFile struct {
+	filename string
+	lock     *os.File
+
+	// release, if set, is called right before the file is replaced, to close
+	// whatever still has the old version open. Windows won't replace a file
+	// this process has open.
+	release func()
+
+	// loaded describes the version of the file that is in memory, so we can
+	// tell when another process has written a newer one.
+	loaded os.FileInfo
+}
+
+func openLockedFile(filename string) (*lockedFile, error) {
+	lock, err := os.OpenFile(filename+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open lock file: %s", err.Error())
+	}
+
+	return &lockedFile{filename: filename, lock: lock}, nil
+}
+
+// Open opens the current version of the file for reading, creating it if it
+// doesn't exist yet, and remembers which version was opened.
+func (l *lockedFile) Open() (*os.File, error) {
+	f, err := openShared(l.filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if l.loaded, err = f.Stat(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Changed reports whether the file on disk is no longer the version that was
+// last opened or written by us.
+func (l *lockedFile) Changed() bool {
+	if l.loaded == nil {
+		return true
+	}
+
+	info, err := os.Stat(l.filename)
+	if err != nil {
+		return true
+	}
+
+	return !os.SameFile(l.loaded, info) ||
+		!l.loaded.ModTime().Equal(info.ModTime()) ||
+		l.loaded.Size() != info.Size()
+}
+
+// Write replaces the file with whatever write produces. The new content is
+// synced to disk before it is renamed into place. Once release has been
+// called, the old version is closed even if Write fails.
+func (l *lockedFile) Write(write func(w io.Writer) error) error {
+	dir, base := filepath.Split(l.filename)
+	if dir == "" {
+		dir = "."
+	}
+
+	tmp, err := ioutil.TempFile(dir, base+".tmp")
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if tmp != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if err = write(tmp); err != nil {
+		return err
+	}
+
+	if err = tmp.Chmod(0644); err != nil {
+		return err
+	}
+
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	if l.release != nil {
+		l.release()
+	}
+
+	if err = replaceFile(tmp.Name(), l.filename); err != nil {
+		return err
+	}
+	tmp = nil
+
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	l.loaded, err = os.Stat(l.filename)
+	return err
+}
@@ -0,0 +1,48 @@
+//go:build !windows
+// +build !windows
+
+package storage
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// openShared opens filename for reading, creating it if it doesn't exist.
+func openShared(filename string) (*os.File, error) {
+	return os.OpenFile(filename, os.O_RDONLY|os.O_CREATE, 0644)
+}
+
+// replaceFile renames from over to. Whoever has to open keeps reading the old
+// version.
+func replaceFile(from, to string) error {
+	return os.Rename(from, to)
+}
+
+// RLock blocks until no other process is writing the file.
+func (l *lockedFile) RLock() error {
+	return l.flock(syscall.LOCK_SH)
+}
+
+// Lock blocks until no other process is reading or writing the file.
+func (l *lockedFile) Lock() error {
+	return l.flock(syscall.LOCK_EX)
+}
+
+func (l *lockedFile) Unlock() error {
+	return l.flock(syscall.LOCK_UN)
+}
+
+func (l *lockedFile) flock(how int) error {
+	for {
+		err := syscall.Flock(int(l.lock.Fd()), how)
+		if err != syscall.EINTR {
+			if err != nil {
+				return fmt.Errorf("Could not lock %s: %s", l.filename, err.Error())
+			}
+
+			return nil
+		}
+	}
+}
@@ -0,0 +1,87 @@
+//go:build windows
+// +build windows
+
+package storage
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// The whole lock file is locked, whatever its size.
+const lockAll = ^uint32(0)
+
+// openShared opens filename for reading, creating it if it doesn't exist.
+// Unlike os.Open, it shares the file for deleting too, so a CsvStorage in
+// another process that keeps it open doesn't stop us from replacing it.
+func openShared(filename string) (*os.File, error) {
+	name, err := windows.UTF16PtrFromString(filename)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: filename, Err: err}
+	}
+
+	share := uint32(windows.FILE_SHARE_READ | windows.FILE_SHARE_WRITE | windows.FILE_SHARE_DELETE)
+	h, err := windows.CreateFile(name, windows.GENERIC_READ, share, nil, windows.OPEN_ALWAYS, windows.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: filename, Err: err}
+	}
+
+	return os.NewFile(uintptr(h), filename), nil
+}
+
+// replaceFile moves from over to. This fails with a sharing violation while
+// to is open without FILE_SHARE_DELETE, so this process closes its own copy
+// first, see lockedFile.release, and everyone opens it with openShared. If it
+// fails anyway, such as on a file system without POSIX delete semantics
+// while another process reads the file, CsvStorage keeps the change in its
+// journal and tries again at the next compaction.
+func replaceFile(from, to string) error {
+	fromName, err := windows.UTF16PtrFromString(from)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: err}
+	}
+
+	toName, err := windows.UTF16PtrFromString(to)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: err}
+	}
+
+	err = windows.MoveFileEx(fromName, toName, windows.MOVEFILE_REPLACE_EXISTING|windows.MOVEFILE_WRITE_THROUGH)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: err}
+	}
+
+	return nil
+}
+
+// RLock blocks until no other process is writing the file.
+func (l *lockedFile) RLock() error {
+	return l.lockFile(0)
+}
+
+// Lock blocks until no other process is reading or writing the file.
+func (l *lockedFile) Lock() error {
+	return l.lockFile(windows.LOCKFILE_EXCLUSIVE_LOCK)
+}
+
+func (l *lockedFile) Unlock() error {
+	ol := new(windows.Overlapped)
+	err := windows.UnlockFileEx(windows.Handle(l.lock.Fd()), 0, lockAll, lockAll, ol)
+	if err != nil {
+		return fmt.Errorf("Could not unlock %s: %s", l.filename, err.Error())
+	}
+
+	return nil
+}
+
+func (l *lockedFile) lockFile(flags uint32) error {
+	ol := new(windows.Overlapped)
+	err := windows.LockFileEx(windows.Handle(l.lock.Fd()), flags, 0, lockAll, lockAll, ol)
+	if err != nil {
+		return fmt.Errorf("Could not lock %s: %s", l.filename, err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,169 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/oatmealraisin/tasker/pkg/models"
+)
+
+// Migrate copies every Task in from to to, which must be empty. Tasks keep
+// their GUIDs, and parents are created before their subtasks, so the
+// relationships between Tasks come through unchanged. The Tasks are created
+// with a single CreateTasks, so if any of them can't be copied, to is left
+// empty. Once everything is copied, to is checked against from, and if it
+// doesn't match, the copied Tasks are deleted from to again.
+func Migrate(from, to Storage) error {
+	if existing := to.GetAllTasks(); len(existing) != 0 {
+		return fmt.Errorf("Migrate: the new storage already has %d Tasks", len(existing))
+	}
+
+	tasks, err := migrationOrder(from)
+	if err != nil {
+		return fmt.Errorf("Migrate: %s", err.Error())
+	}
+
+	if errs := to.CreateTasks(tasks); len(errs) > 0 {
+		return fmt.Errorf("Migrate: could not copy the Tasks, nothing was copied:\n\t%s", errorList(errs))
+	}
+
+	if err := verifyMigration(tasks, to); err != nil {
+		var errs []error
+		for _, task := range tasks {
+			if _, err := to.GetTask(task.Guid); err != nil {
+				continue
+			}
+
+			if err := to.DeleteTask(task.Guid); err != nil {
+				errs = append(errs, err)
+			}
+		}
+
+		if len(errs) > 0 {
+			return fmt.Errorf("Migrate: %s\nThe new storage holds a copy that didn't check out, and it could not be deleted:\n\t%s", err.Error(), errorList(errs))
+		}
+
+		return fmt.Errorf("Migrate: %s\nThe copy was deleted from the new storage again", err.Error())
+	}
+
+	return nil
+}
+
+// migrationOrder reads every Task in s, ordered so that each Task comes after
+// its parent.
+func migrationOrder(s Storage) ([]models.Task, error) {
+	guids := s.GetAllTasks()
+	sort.Slice(guids, func(i, j int) bool { return guids[i] < guids[j] })
+
+	byGuid := make(map[uint64]models.Task, len(guids))
+	for _, guid := range guids {
+		task, err := s.GetTask(guid)
+		if err != nil {
+			return nil, fmt.Errorf("could not read Task %d: %s", guid, err.Error())
+		}
+
+		byGuid[guid] = task
+	}
+
+	return parentsFirst(guids, byGuid)
+}
+
+// parentsFirst orders the Tasks with the given GUIDs so that each Task comes
+// after its parent.
+func parentsFirst(guids []uint64, byGuid map[uint64]models.Task) ([]models.Task, error) {
+	result := make([]models.Task, 0, len(guids))
+	// done is false while a Task's parents are being added, to catch cycles
+	done := map[uint64]bool{}
+
+	var add func(guid uint64) error
+	add = func(guid uint64) error {
+		if finished, ok := done[guid]; ok {
+			if !finished {
+				return fmt.Errorf("Task %d is its own ancestor", guid)
+			}
+
+			return nil
+		}
+
+		task := byGuid[guid]
+		done[guid] = false
+
+		if task.Parent != 0 {
+			if _, ok := byGuid[task.Parent]; !ok {
+				return fmt.Errorf("Task %d has parent %d, which doesn't exist", guid, task.Parent)
+			}
+
+			if err := add(task.Parent); err != nil {
+				return err
+			}
+		}
+
+		done[guid] = true
+		result = append(result, task)
+
+		return nil
+	}
+
+	for _, guid := range guids {
+		if err := add(guid); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// verifyMigration checks that s holds exactly tasks, with the same names and
+// relationships.
+func verifyMigration(tasks []models.Task, s Storage) error {
+	if got := len(s.GetAllTasks()); got != len(tasks) {
+		return fmt.Errorf("expected %d Tasks after copying, found %d", len(tasks), got)
+	}
+
+	for _, want := range tasks {
+		got, err := s.GetTask(want.Guid)
+		if err != nil {
+			return fmt.Errorf("Task %d is missing: %s", want.Guid, err.Error())
+		}
+
+		if got.Name != want.Name {
+			return fmt.Errorf("Task %d is named '%s' instead of '%s'", want.Guid, got.Name, want.Name)
+		}
+
+		if got.Parent != want.Parent {
+			return fmt.Errorf("Task %d has parent %d instead of %d", want.Guid, got.Parent, want.Parent)
+		}
+
+		if !sameGuids(got.Subtasks, want.Subtasks) {
+			return fmt.Errorf("Task %d has subtasks %v instead of %v", want.Guid, got.Subtasks, want.Subtasks)
+		}
+
+		if !sameGuids(got.Dependencies, want.Dependencies) {
+			return fmt.Errorf("Task %d has dependencies %v instead of %v", want.Guid, got.Dependencies, want.Dependencies)
+		}
+	}
+
+	return nil
+}
+
+// sameGuids compares two lists of GUIDs, ignoring order.
+func sameGuids(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	count := map[uint64]int{}
+	for _, guid := range a {
+		count[guid]++
+	}
+
+	for _, guid := range b {
+		if count[guid] == 0 {
+			return false
+		}
+
+		count[guid]--
+	}
+
+	return true
+}
@@ -0,0 +1,41 @@
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/oatmealraisin/tasker/pkg/models"
+	"github.com/oatmealraisin/tasker/pkg/storage"
+)
+
+// renamingStorage reads back every Task with another name, like a backend
+// that doesn't store names right would.
+type renamingStorage struct {
+	storage.Storage
+}
+
+func (r renamingStorage) GetTask(guid uint64) (models.Task, error) {
+	task, err := r.Storage.GetTask(guid)
+	task.Name += " (renamed)"
+
+	return task, err
+}
+
+func TestMigrateDeletesCopyThatDoesntCheckOut(t *testing.T) {
+	from := jsonStorage(t)
+	if errs := from.CreateTasks([]models.Task{{Name: "a"}, {Name: "b"}}); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+
+	to := renamingStorage{jsonStorage(t)}
+	if err := storage.Migrate(from, to); err == nil {
+		t.Fatal("Migrate succeeded, though the copy has the wrong names")
+	}
+
+	if guids := to.GetAllTasks(); len(guids) != 0 {
+		t.Errorf("The new storage has %v after a failed migration, expected nothing", guids)
+	}
+
+	if guids := from.GetAllTasks(); len(guids) != 2 {
+		t.Errorf("The old storage has %v after a failed migration, expected it to be left alone", guids)
+	}
+}
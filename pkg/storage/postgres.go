@@ -1,29 +1,141 @@
 package storage
 
-import "github.com/oatmealraisin/tasker/pkg/models"
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
 
-type PostgresStorage struct{}
+	_ "github.com/lib/pq"
+	"github.com/spf13/viper"
+)
 
-func (p *PostgresStorage) CreateTask(t *models.Task) error {
-	panic("not implemented")
-}
+var postgresMigrations = []string{`
+CREATE TABLE IF NOT EXISTS tasks (
+	guid          BIGINT PRIMARY KEY,
+	name          TEXT NOT NULL,
+	priority      BIGINT NOT NULL DEFAULT 0,
+	size          BIGINT NOT NULL DEFAULT 0,
+	added         TIMESTAMPTZ,
+	active        TIMESTAMPTZ,
+	due           TIMESTAMPTZ,
+	finished      TIMESTAMPTZ,
+	removed       BOOLEAN NOT NULL DEFAULT FALSE,
+	repeats       BOOLEAN NOT NULL DEFAULT FALSE,
+	guid_previous BIGINT NOT NULL DEFAULT 0,
+	url           TEXT NOT NULL DEFAULT '',
+	parent        BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS tasks_name ON tasks (name);
+
+CREATE TABLE IF NOT EXISTS tags (
+	guid     BIGINT NOT NULL REFERENCES tasks (guid) ON DELETE CASCADE,
+	tag      TEXT NOT NULL,
+	position INTEGER NOT NULL,
+	PRIMARY KEY (guid, tag)
+);
+
+CREATE INDEX IF NOT EXISTS tags_tag ON tags (tag);
 
-func (p *PostgresStorage) CreateTasks(t []*models.Task) []error {
-	panic("not implemented")
+CREATE TABLE IF NOT EXISTS subtasks (
+	parent   BIGINT NOT NULL REFERENCES tasks (guid) ON DELETE CASCADE,
+	subtask  BIGINT NOT NULL,
+	position INTEGER NOT NULL,
+	PRIMARY KEY (parent, subtask)
+);
+
+CREATE TABLE IF NOT EXISTS dependencies (
+	guid       BIGINT NOT NULL REFERENCES tasks (guid) ON DELETE CASCADE,
+	dependency BIGINT NOT NULL,
+	position   INTEGER NOT NULL,
+	PRIMARY KEY (guid, dependency)
+);
+
+CREATE INDEX IF NOT EXISTS dependencies_dependency ON dependencies (dependency);
+`, `
+CREATE TABLE guid_sequence (last BIGINT NOT NULL);
+
+INSERT INTO guid_sequence (last) SELECT COALESCE(MAX(guid), 0) FROM tasks;
+`, `
+ALTER TABLE tasks ADD COLUMN revision BIGINT NOT NULL DEFAULT 0;
+`,
 }
 
-func (p *PostgresStorage) GetTask(guid uint64) (models.Task, error) {
-	panic("not implemented")
+// PostgresStorage keeps Tasks in a PostgreSQL database, so that several people
+// can share one task list.
+type PostgresStorage struct {
+	*sqlStorage
 }
 
-func (p *PostgresStorage) GetByTag(tag string) ([]models.Task, error) {
-	panic("not implemented")
+func NewPostgresStorage(dataSource string) Storage {
+	sealer, err := newSealer()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not open Postgres Storage: %s\n", err.Error())
+		return nil
+	} else if sealer != nil {
+		fmt.Fprintf(os.Stderr, "Could not open Postgres Storage: it can't be encrypted, unset EncryptionKey and EncryptionKeyFile or use another StorageType\n")
+		return nil
+	}
+
+	db, err := sql.Open("postgres", dataSource)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not open Postgres Storage: %s\n", err.Error())
+		return nil
+	}
+
+	if err = db.Ping(); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not connect to Postgres: %s\n", err.Error())
+		db.Close()
+		return nil
+	}
+
+	result := &PostgresStorage{
+		sqlStorage: &sqlStorage{
+			db:         db,
+			name:       "PostgresStorage",
+			rebind:     rebindDollar,
+			lockTable:  "LOCK TABLE %s IN EXCLUSIVE MODE",
+			migrations: postgresMigrations,
+		},
+	}
+
+	if err = result.migrate(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		db.Close()
+		return nil
+	}
+
+	return result
 }
 
-func (p *PostgresStorage) GetByName(name string) ([]models.Task, error) {
-	panic("not implemented")
+// PostgresDataSource builds a connection string from the Postgres* config
+// variables. If PostgresURL is set, it is used as is.
+func PostgresDataSource() string {
+	if url := viper.GetString("PostgresURL"); url != "" {
+		return url
+	}
+
+	params := []string{}
+	for _, p := range []struct{ key, name string }{
+		{"host", "PostgresHost"},
+		{"port", "PostgresPort"},
+		{"user", "PostgresUser"},
+		{"password", "PostgresPassword"},
+		{"dbname", "PostgresDatabase"},
+		{"sslmode", "PostgresSSLMode"},
+	} {
+		if value := viper.GetString(p.name); value != "" {
+			params = append(params, fmt.Sprintf("%s=%s", p.key, quotePostgresValue(value)))
+		}
+	}
+
+	return strings.Join(params, " ")
 }
 
-func (p *PostgresStorage) GetAllTasks() ([]models.Task, error) {
-	panic("not implemented")
+func quotePostgresValue(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `'`, `\'`, -1)
+
+	return fmt.Sprintf("'%s'", value)
 }
@@ -0,0 +1,39 @@
+package storage_test
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+
+	"github.com/oatmealraisin/tasker/pkg/storage"
+)
+
+// postgresDataSource is where the Postgres tests run. They drop every table
+// tasker uses there, so don't point it at a real task list.
+const postgresDataSource = "TASKER_TEST_POSTGRES"
+
+// skipWithoutPostgres skips tests of the Postgres Storage unless there is a
+// database to run them in.
+func skipWithoutPostgres(t *testing.T) {
+	if os.Getenv(postgresDataSource) == "" {
+		t.Skipf("%s isn't set", postgresDataSource)
+	}
+}
+
+// postgresStorage empties the test database before opening it.
+func postgresStorage(t *testing.T) storage.Storage {
+	dataSource := os.Getenv(postgresDataSource)
+
+	db, err := sql.Open("postgres", dataSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec(`DROP TABLE IF EXISTS tags, subtasks, dependencies, tasks, guid_sequence, schema_version`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return storage.NewPostgresStorage(dataSource)
+}
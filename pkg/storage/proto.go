@@ -0,0 +1,295 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/oatmealraisin/tasker/pkg/models"
+)
+
+const (
+	protoFormatVersion = 1
+
+	// protoMagic starts the file, and is followed by the format version.
+	protoMagic = "TASKERPB"
+	// protoIndexMagic ends the file, after the offset of the index.
+	protoIndexMagic  = "TIDX"
+	protoTrailerSize = 8 + len(protoIndexMagic)
+
+	// protoParallelAfter is how many Tasks a file needs before they are
+	// decoded in parallel.
+	protoParallelAfter = 4096
+)
+
+// ProtoStorage keeps every Task as a length-delimited protobuf record in a
+// single binary file, so every field is kept and the file stays small. The
+// records are in GUID order, and are followed by an index:
+//
+//	"TASKERPB" version
+//	length Task, for each Task
+//	count, then guid offset for each Task
+//	offset of the index, as 8 bytes little endian, then "TIDX"
+//
+// Numbers are varints unless noted. The index lets large lists be decoded in
+// parallel. If it is damaged, the records are read one after another instead.
+type ProtoStorage struct {
+	*fileStorage
+}
+
+func NewProtoStorage(filename string) Storage {
+	var err error
+
+	err = setupStorageDir()
+	if err != nil {
+		return nil
+	}
+
+	result := new(ProtoStorage)
+	result.fileStorage, err = newFileStorage("ProtoStorage", filename, tasksToProto, tasksFromProto)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading Proto Storage: %s\n", err.Error())
+		return nil
+	}
+
+	return result
+}
+
+// tasksToProto encodes Tasks in the format of the Proto Storage file.
+func tasksToProto(tasks []models.Task) ([]byte, error) {
+	var buf bytes.Buffer
+	var scratch [binary.MaxVarintLen64]byte
+
+	putUvarint := func(n uint64) {
+		buf.Write(scratch[:binary.PutUvarint(scratch[:], n)])
+	}
+
+	buf.WriteString(protoMagic)
+	putUvarint(protoFormatVersion)
+
+	offsets := make([]uint64, len(tasks))
+	for i := range tasks {
+		b, err := proto.Marshal(&tasks[i])
+		if err != nil {
+			return nil, fmt.Errorf("Could not encode Task %d: %s", tasks[i].Guid, err.Error())
+		}
+
+		offsets[i] = uint64(buf.Len())
+		putUvarint(uint64(len(b)))
+		buf.Write(b)
+	}
+
+	index := uint64(buf.Len())
+	putUvarint(uint64(len(tasks)))
+	for i := range tasks {
+		putUvarint(tasks[i].Guid)
+		putUvarint(offsets[i])
+	}
+
+	binary.Write(&buf, binary.LittleEndian, index)
+	buf.WriteString(protoIndexMagic)
+
+	return buf.Bytes(), nil
+}
+
+func tasksFromProto(b []byte) ([]models.Task, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+
+	if !bytes.HasPrefix(b, []byte(protoMagic)) {
+		return nil, fmt.Errorf("Not a Proto Storage file")
+	}
+
+	version, n := binary.Uvarint(b[len(protoMagic):])
+	if n <= 0 {
+		return nil, fmt.Errorf("Proto Storage file has no format version")
+	}
+
+	if version > protoFormatVersion {
+		return nil, fmt.Errorf("Proto Storage has format version %d, this tasker only reads up to %d", version, protoFormatVersion)
+	}
+
+	start := len(protoMagic) + n
+	end := protoRecordsEnd(b, start)
+
+	index, err := readProtoIndex(b, start, end)
+	if err == nil {
+		var result []models.Task
+		if result, err = decodeProtoRecords(b[:end], index); err == nil {
+			return result, nil
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Proto Storage index is damaged, reading every record instead: %s\n", err.Error())
+	return scanProtoRecords(b, start, end)
+}
+
+type protoIndexEntry struct {
+	guid   uint64
+	offset int
+}
+
+// protoRecordsEnd returns where the index starts, going by the trailer, or the
+// end of the file if the trailer is damaged.
+func protoRecordsEnd(b []byte, start int) int {
+	if len(b) < start+protoTrailerSize || string(b[len(b)-len(protoIndexMagic):]) != protoIndexMagic {
+		return len(b)
+	}
+
+	index := binary.LittleEndian.Uint64(b[len(b)-protoTrailerSize:])
+	if index < uint64(start) || index > uint64(len(b)-protoTrailerSize) {
+		return len(b)
+	}
+
+	return int(index)
+}
+
+// readProtoIndex reads the index between end and the trailer, checking that
+// the records it points to are in order and between start and end.
+func readProtoIndex(b []byte, start, end int) ([]protoIndexEntry, error) {
+	if end > len(b)-protoTrailerSize {
+		return nil, fmt.Errorf("the file doesn't end in an index")
+	}
+
+	r := b[end : len(b)-protoTrailerSize]
+
+	next := func() (uint64, error) {
+		v, n := binary.Uvarint(r)
+		if n <= 0 {
+			return 0, fmt.Errorf("the index is cut short")
+		}
+
+		r = r[n:]
+		return v, nil
+	}
+
+	count, err := next()
+	if err != nil {
+		return nil, err
+	}
+
+	// Each entry takes at least two bytes
+	if count > uint64(len(r)/2) {
+		return nil, fmt.Errorf("the index has more entries than fit in it")
+	}
+
+	result := make([]protoIndexEntry, count)
+	last := uint64(start)
+	for i := range result {
+		guid, err := next()
+		if err != nil {
+			return nil, err
+		}
+
+		offset, err := next()
+		if err != nil {
+			return nil, err
+		}
+
+		if offset < last || offset >= uint64(end) {
+			return nil, fmt.Errorf("entry %d points outside of the records", i)
+		}
+
+		result[i] = protoIndexEntry{guid: guid, offset: int(offset)}
+		last = offset + 1
+	}
+
+	return result, nil
+}
+
+// decodeProtoRecords decodes the records in index, in parallel for large
+// lists.
+func decodeProtoRecords(b []byte, index []protoIndexEntry) ([]models.Task, error) {
+	result := make([]models.Task, len(index))
+
+	workers := runtime.GOMAXPROCS(0)
+	if len(index) < protoParallelAfter || workers < 2 {
+		workers = 1
+	}
+
+	chunk := (len(index) + workers - 1) / workers
+	errs := make([]error, workers)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		from, to := w*chunk, (w+1)*chunk
+		if to > len(index) {
+			to = len(index)
+		}
+
+		wg.Add(1)
+		go func(w, from, to int) {
+			defer wg.Done()
+
+			for i := from; i < to; i++ {
+				if _, err := readProtoRecord(b, index[i].offset, &result[i]); err != nil {
+					errs[w] = fmt.Errorf("Task %d: %s", index[i].guid, err.Error())
+					return
+				}
+
+				if result[i].Guid != index[i].guid {
+					errs[w] = fmt.Errorf("the index has Task %d where Task %d is", index[i].guid, result[i].Guid)
+					return
+				}
+			}
+		}(w, from, to)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// scanProtoRecords decodes the records between start and end one after
+// another.
+func scanProtoRecords(b []byte, start, end int) ([]models.Task, error) {
+	var result []models.Task
+
+	for offset := start; offset < end; {
+		var task models.Task
+
+		next, err := readProtoRecord(b[:end], offset, &task)
+		if err == nil && task.Guid == 0 {
+			err = fmt.Errorf("the Task has no GUID")
+		}
+
+		if err != nil {
+			// Carrying on would drop every Task after this one the next
+			// time we write
+			return nil, fmt.Errorf("Could not read record at offset %d: %s", offset, err.Error())
+		}
+
+		result = append(result, task)
+		offset = next
+	}
+
+	return result, nil
+}
+
+// readProtoRecord decodes the record at offset into task, and returns where
+// the next record starts.
+func readProtoRecord(b []byte, offset int, task *models.Task) (int, error) {
+	size, n := binary.Uvarint(b[offset:])
+	if n <= 0 || size > uint64(len(b)-offset-n) {
+		return 0, fmt.Errorf("the record is cut short")
+	}
+
+	start := offset + n
+	end := start + int(size)
+
+	if err := proto.Unmarshal(b[start:end], task); err != nil {
+		return 0, err
+	}
+
+	return end, nil
+}
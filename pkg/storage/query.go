@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	tspb "github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/oatmealraisin/tasker/pkg/models"
+)
+
+// Query describes the common ways of narrowing down Tasks, so that a Storage
+// can find them without loading every Task. The zero value of each field
+// matches every Task, and a Task has to match every field that is set.
+type Query struct {
+	// Tags matches Tasks with at least one of the tags.
+	Tags []string
+
+	Finished *bool
+	Removed  *bool
+
+	// DueBefore matches Tasks with a due date before it.
+	DueBefore time.Time
+	// CreatedAfter and CreatedBefore match on the add date of Tasks.
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+
+	SizeIs    *uint32
+	SizeIsNot *uint32
+}
+
+// Queryable is implemented by Storages that can find the Tasks matching a
+// Query themselves. Use Find rather than calling Query directly, so Storages
+// without it still work.
+type Queryable interface {
+	// Query returns the GUIDs of the Tasks matching q, in GUID order.
+	Query(q Query) ([]uint64, error)
+}
+
+// Find returns the GUIDs of the Tasks in s that match q, in GUID order.
+func Find(s Storage, q Query) ([]uint64, error) {
+	for _, layer := range layers(s) {
+		if queryable, ok := layer.(Queryable); ok {
+			return queryable.Query(q)
+		}
+	}
+
+	var candidates []uint64
+	if len(q.Tags) > 0 {
+		candidates = s.GetByTags(q.Tags)
+	} else {
+		candidates = s.GetAllTasks()
+	}
+
+	result := []uint64{}
+	seen := map[uint64]bool{}
+
+	for _, guid := range candidates {
+		// A Task is listed once for every tag it matches
+		if seen[guid] {
+			continue
+		}
+		seen[guid] = true
+
+		task, err := s.GetTask(guid)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not get task %d\n", guid)
+			continue
+		}
+
+		if q.Matches(task) {
+			result = append(result, guid)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+
+	return result, nil
+}
+
+// Filter returns a Filter that lets through the Tasks matching q, for Tasks
+// that didn't come from Find.
+func (q Query) Filter() (result models.Filter) {
+	result.Apply = func(task models.Task, get func(uuid uint64) (models.Task, error)) bool {
+		return q.Matches(task)
+	}
+
+	return result
+}
+
+// Matches reports whether task matches every field set in q.
+func (q Query) Matches(task models.Task) bool {
+	if len(q.Tags) > 0 && !hasAnyTag(task, q.Tags) {
+		return false
+	}
+
+	if q.Finished != nil && *q.Finished != (task.Finished != nil) {
+		return false
+	}
+
+	if q.Removed != nil && *q.Removed != task.Removed {
+		return false
+	}
+
+	if !q.DueBefore.IsZero() && !timestampBefore(task.Due, q.DueBefore) {
+		return false
+	}
+
+	if !q.CreatedAfter.IsZero() && !timestampAfter(task.Added, q.CreatedAfter) {
+		return false
+	}
+
+	if !q.CreatedBefore.IsZero() && !timestampBefore(task.Added, q.CreatedBefore) {
+		return false
+	}
+
+	if q.SizeIs != nil && task.Size != *q.SizeIs {
+		return false
+	}
+
+	if q.SizeIsNot != nil && task.Size == *q.SizeIsNot {
+		return false
+	}
+
+	return true
+}
+
+func hasAnyTag(task models.Task, tags []string) bool {
+	for _, want := range tags {
+		for _, tag := range task.Tags {
+			if tag == want {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// timestampBefore is false if t isn't set.
+func timestampBefore(t *tspb.Timestamp, date time.Time) bool {
+	result, err := ptypes.Timestamp(t)
+	return err == nil && result.Before(date)
+}
+
+// timestampAfter is false if t isn't set.
+func timestampAfter(t *tspb.Timestamp, date time.Time) bool {
+	result, err := ptypes.Timestamp(t)
+	return err == nil && result.After(date)
+}
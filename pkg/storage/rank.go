@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/oatmealraisin/tasker/pkg/models"
+)
+
+// Ranker is implemented by Storages that keep Tasks sorted, so they can find
+// the first few without sorting every Task. Use NextDue, TopByPriority and
+// TopByScore rather than calling these directly, so Storages without them
+// still work.
+//
+// Each method returns up to n Tasks matching q, in order. If n is 0, it
+// returns all of them.
+type Ranker interface {
+	// NextDue leaves out Tasks without a due date, and starts with the one
+	// due soonest.
+	NextDue(n int, q Query) ([]uint64, error)
+	TopByPriority(n int, q Query) ([]uint64, error)
+	TopByScore(n int, q Query) ([]uint64, error)
+}
+
+// NextDue returns up to n Tasks in s matching q with the soonest due dates.
+func NextDue(s Storage, n int, q Query) ([]uint64, error) {
+	if r := ranker(s); r != nil {
+		return r.NextDue(n, q)
+	}
+
+	return rankTasks(s, n, q, hasDueDate, dueBefore)
+}
+
+// TopByPriority returns up to n Tasks in s matching q with the highest
+// priority.
+func TopByPriority(s Storage, n int, q Query) ([]uint64, error) {
+	if r := ranker(s); r != nil {
+		return r.TopByPriority(n, q)
+	}
+
+	return rankTasks(s, n, q, nil, morePriority)
+}
+
+// TopByScore returns up to n Tasks in s matching q with the highest score.
+func TopByScore(s Storage, n int, q Query) ([]uint64, error) {
+	if r := ranker(s); r != nil {
+		return r.TopByScore(n, q)
+	}
+
+	return rankTasks(s, n, q, nil, nil)
+}
+
+// ranker returns the Ranker of s, or of a Storage it wraps, if there is one.
+func ranker(s Storage) Ranker {
+	for _, layer := range layers(s) {
+		if r, ok := layer.(Ranker); ok {
+			return r
+		}
+	}
+
+	return nil
+}
+
+// rankTasks finds the Tasks in s matching q and sorts them with less, or by
+// score if less is nil.
+func rankTasks(s Storage, n int, q Query, include func(*models.Task) bool, less func(a, b *models.Task) bool) ([]uint64, error) {
+	guids, err := Find(s, q)
+	if err != nil {
+		return nil, err
+	}
+
+	tasks := make([]models.Task, 0, len(guids))
+	scores := map[uint64]float64{}
+
+	for _, guid := range guids {
+		task, err := s.GetTask(guid)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not get task %d\n", guid)
+			continue
+		}
+
+		if include != nil && !include(&task) {
+			continue
+		}
+
+		if less == nil {
+			scores[guid] = task.Score()
+		}
+
+		tasks = append(tasks, task)
+	}
+
+	if less == nil {
+		less = func(a, b *models.Task) bool {
+			if scores[a.Guid] != scores[b.Guid] {
+				return scores[a.Guid] > scores[b.Guid]
+			}
+
+			return a.Guid < b.Guid
+		}
+	}
+
+	sort.Slice(tasks, func(i, j int) bool { return less(&tasks[i], &tasks[j]) })
+
+	if n > 0 && len(tasks) > n {
+		tasks = tasks[:n]
+	}
+
+	result := make([]uint64, len(tasks))
+	for i, task := range tasks {
+		result[i] = task.Guid
+	}
+
+	return result, nil
+}
@@ -0,0 +1,258 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Resolver turns the ways a user can name a Task on the command line into its
+// GUID:
+//
+//	1042    a GUID
+//	#1042   a GUID too
+//	@3      the working ID of a Task, see Id
+//	groc    the start of the name of a single Task with a working ID
+//
+// A bare number is always a GUID, as it was before there were working IDs, so
+// a script running "tasker finish 1042" doesn't finish some other Task.
+//
+// Working IDs number the Tasks that are neither finished nor removed, in GUID
+// order, starting at 1. Like the IDs of taskwarrior, they are kept in a file
+// and only handed out again by Renumber, which commands that list Tasks call
+// before printing them. Until then, finishing Task 2 doesn't turn Task 3 into
+// Task 2, and Tasks added in the meantime get the next free IDs.
+type Resolver struct {
+	s Storage
+	// filename keeps the working IDs between invocations, one GUID per
+	// line, so line i has working ID i. Without one, every process numbers
+	// the Tasks again.
+	filename string
+
+	// guids[i] has working ID i+1. It is loaded on first use.
+	guids []uint64
+	ids   map[uint64]int
+}
+
+func NewResolver(s Storage, filename string) *Resolver {
+	return &Resolver{s: s, filename: filename}
+}
+
+// unfinished returns the Tasks that get a working ID, in GUID order.
+func (r *Resolver) unfinished() ([]uint64, error) {
+	unfinished, notRemoved := false, false
+	guids, err := Find(r.s, Query{Finished: &unfinished, Removed: &notRemoved})
+	if err != nil {
+		return nil, fmt.Errorf("Could not number tasks: %s", err.Error())
+	}
+
+	return guids, nil
+}
+
+// load reads the working IDs handed out last time, and gives the next ones to
+// Tasks that were added since.
+func (r *Resolver) load() error {
+	if r.ids != nil {
+		return nil
+	}
+
+	unfinished, err := r.unfinished()
+	if err != nil {
+		return err
+	}
+
+	saved, err := r.read()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not read the working IDs, numbering tasks again: %s\n", err.Error())
+	}
+
+	r.number(saved)
+
+	added := false
+	for _, guid := range unfinished {
+		if _, ok := r.ids[guid]; !ok {
+			r.guids = append(r.guids, guid)
+			r.ids[guid] = len(r.guids)
+			added = true
+		}
+	}
+
+	if added {
+		if err := r.save(); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		}
+	}
+
+	return nil
+}
+
+// Renumber hands out working IDs again, so they are as short as they can be
+// and finished Tasks lose theirs.
+func (r *Resolver) Renumber() error {
+	unfinished, err := r.unfinished()
+	if err != nil {
+		return err
+	}
+
+	r.number(unfinished)
+
+	return r.save()
+}
+
+func (r *Resolver) number(guids []uint64) {
+	r.guids = guids
+	r.ids = make(map[uint64]int, len(guids))
+	for i, guid := range guids {
+		r.ids[guid] = i + 1
+	}
+}
+
+// read returns the GUIDs saved in r.filename, or nothing if there is no file
+// yet.
+func (r *Resolver) read() ([]uint64, error) {
+	if r.filename == "" {
+		return nil, nil
+	}
+
+	b, err := ioutil.ReadFile(r.filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var result []uint64
+	for i, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		if line == "" {
+			continue
+		}
+
+		guid, err := strconv.ParseUint(line, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s, line %d: %s", r.filename, i+1, err.Error())
+		}
+
+		result = append(result, guid)
+	}
+
+	return result, nil
+}
+
+// save writes the working IDs to a temporary file first, so other tasker
+// processes never read half of them.
+func (r *Resolver) save() error {
+	if r.filename == "" {
+		return nil
+	}
+
+	var b bytes.Buffer
+	for _, guid := range r.guids {
+		fmt.Fprintf(&b, "%d\n", guid)
+	}
+
+	tmp := r.filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, b.Bytes(), 0644); err != nil {
+		return fmt.Errorf("Could not save the working IDs: %s", err.Error())
+	}
+
+	if err := os.Rename(tmp, r.filename); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("Could not save the working IDs: %s", err.Error())
+	}
+
+	return nil
+}
+
+// Id returns the working ID of a Task, if it has one.
+func (r *Resolver) Id(guid uint64) (int, bool) {
+	if err := r.load(); err != nil {
+		return 0, false
+	}
+
+	id, ok := r.ids[guid]
+	return id, ok
+}
+
+// Resolve returns the GUID of the Task arg names.
+func (r *Resolver) Resolve(arg string) (uint64, error) {
+	arg = strings.TrimSpace(arg)
+	if arg == "" {
+		return 0, fmt.Errorf("No task given")
+	}
+
+	if guid, err := strconv.ParseUint(strings.TrimPrefix(arg, "#"), 10, 64); err == nil {
+		if guid == 0 {
+			return 0, fmt.Errorf("'%s' is not a GUID", arg)
+		}
+
+		if _, err := r.s.GetTask(guid); err != nil {
+			return 0, fmt.Errorf("No task with GUID %d, use @%d for the task with that ID", guid, guid)
+		}
+
+		return guid, nil
+	} else if strings.HasPrefix(arg, "#") {
+		return 0, fmt.Errorf("'%s' is not a GUID", arg)
+	}
+
+	if err := r.load(); err != nil {
+		return 0, err
+	}
+
+	if strings.HasPrefix(arg, "@") {
+		id, err := strconv.ParseUint(arg[1:], 10, 64)
+		if err != nil || id == 0 || id > uint64(len(r.guids)) {
+			return 0, fmt.Errorf("No task with ID %s", arg)
+		}
+
+		guid := r.guids[id-1]
+		if _, err := r.s.GetTask(guid); err != nil {
+			return 0, fmt.Errorf("Task %s was deleted, list the tasks again to get new IDs", arg)
+		}
+
+		return guid, nil
+	}
+
+	return r.resolveName(arg)
+}
+
+// resolveName finds the Task with a working ID whose name starts with prefix,
+// ignoring case. A Task named exactly prefix wins over longer names.
+func (r *Resolver) resolveName(prefix string) (uint64, error) {
+	lower := strings.ToLower(prefix)
+
+	var matches, exact []uint64
+	var names []string
+
+	for _, guid := range r.guids {
+		task, err := r.s.GetTask(guid)
+		if err != nil {
+			continue
+		}
+
+		name := strings.ToLower(task.Name)
+		if !strings.HasPrefix(name, lower) {
+			continue
+		}
+
+		matches = append(matches, guid)
+		names = append(names, fmt.Sprintf("\t@%d: %s", r.ids[guid], task.Name))
+
+		if name == lower {
+			exact = append(exact, guid)
+		}
+	}
+
+	switch {
+	case len(exact) == 1:
+		return exact[0], nil
+	case len(matches) == 1:
+		return matches[0], nil
+	case len(matches) == 0:
+		return 0, fmt.Errorf("No unfinished task starts with '%s'", prefix)
+	}
+
+	return 0, fmt.Errorf("'%s' could be any of these tasks:\n%s", prefix, strings.Join(names, "\n"))
+}
@@ -0,0 +1,51 @@
+package storage_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/oatmealraisin/tasker/pkg/models"
+	"github.com/oatmealraisin/tasker/pkg/storage"
+	"github.com/spf13/viper"
+)
+
+func TestResolverKeepsBareNumbersAsGuids(t *testing.T) {
+	s := jsonStorage(t)
+
+	if errs := s.CreateTasks([]models.Task{{Name: "first"}, {Name: "second"}, {Name: "third"}}); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	first, second, third := s.GetByName("first")[0], s.GetByName("second")[0], s.GetByName("third")[0]
+
+	// Finishing the first Task shifts the working IDs away from the GUIDs
+	task, _ := s.GetTask(first)
+	finished := task
+	finished.Finished = ptypes.TimestampNow()
+	if err := s.EditTask(task, finished); err != nil {
+		t.Fatal(err)
+	}
+
+	r := storage.NewResolver(s, filepath.Join(viper.GetString("WorkingDir"), "working-ids"))
+	if err := r.Renumber(); err != nil {
+		t.Fatal(err)
+	}
+
+	for arg, expected := range map[string]uint64{
+		"2":   second,
+		"#3":  third,
+		"@1":  second,
+		"@2":  third,
+		"thi": third,
+	} {
+		if guid, err := r.Resolve(arg); err != nil || guid != expected {
+			t.Errorf("Resolve(%s) = %d, %v, expected %d", arg, guid, err, expected)
+		}
+	}
+
+	for _, arg := range []string{"0", "9", "#9", "@0", "@3", "@x", "fourth"} {
+		if guid, err := r.Resolve(arg); err == nil {
+			t.Errorf("Resolve(%s) = %d, expected an error", arg, guid)
+		}
+	}
+}
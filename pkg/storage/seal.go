@@ -0,0 +1,372 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// sealedFileMagic starts files that are encrypted as a whole. It is
+	// followed by the salt, the nonce and the ciphertext.
+	sealedFileMagic = "tasker-sealed-1\n"
+	// sealedLinePrefix starts the header line of files that are encrypted a
+	// line at a time, followed by the salt. Every line after it is the nonce
+	// and ciphertext of one append, in base64.
+	sealedLinePrefix = "tasker-sealed-1 "
+
+	sealedSaltSize = 16
+)
+
+var (
+	errSealedNoKey    = fmt.Errorf("The file is encrypted, set EncryptionKey or EncryptionKeyFile to read it")
+	errSealedWrongKey = fmt.Errorf("Could not decrypt, the encryption key is wrong")
+)
+
+// sealer encrypts what tasker keeps on disk, when EncryptionKey or
+// EncryptionKeyFile is set. Everything is sealed with AES-256-GCM, under a
+// key derived from the passphrase and a random salt with scrypt. The salt is
+// kept with the data, and reused when writing, so deriving the key, which is
+// slow on purpose, only happens about once per process.
+//
+// A nil *sealer leaves data as it is. Data that isn't sealed is always read
+// as it is, so turning encryption on seals files as they are next written.
+type sealer struct {
+	passphrase []byte
+
+	mu   sync.Mutex
+	salt []byte
+	keys map[string]cipher.AEAD
+}
+
+// newSealer returns the sealer set up in the config, or nil if encryption is
+// turned off.
+func newSealer() (*sealer, error) {
+	key := viper.GetString("EncryptionKey")
+	keyFile := viper.GetString("EncryptionKeyFile")
+
+	if key != "" && keyFile != "" {
+		return nil, fmt.Errorf("Only one of EncryptionKey and EncryptionKeyFile can be set")
+	}
+
+	if keyFile != "" {
+		b, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read EncryptionKeyFile: %s", err.Error())
+		}
+
+		key = strings.TrimRight(string(b), "\r\n")
+		if key == "" {
+			return nil, fmt.Errorf("EncryptionKeyFile %s is empty", keyFile)
+		}
+	}
+
+	if key == "" {
+		return nil, nil
+	}
+
+	return &sealer{passphrase: []byte(key), keys: map[string]cipher.AEAD{}}, nil
+}
+
+// aead returns the cipher for the key derived with salt. It must be called
+// with s.mu held.
+func (s *sealer) aead(salt []byte) (cipher.AEAD, error) {
+	if result, ok := s.keys[string(salt)]; ok {
+		return result, nil
+	}
+
+	key, err := scrypt.Key(s.passphrase, salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	s.keys[string(salt)] = result
+
+	return result, nil
+}
+
+// sealingAead returns the salt new data is sealed with and its cipher. It
+// must be called with s.mu held.
+func (s *sealer) sealingAead() ([]byte, cipher.AEAD, error) {
+	if s.salt == nil {
+		salt := make([]byte, sealedSaltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, nil, err
+		}
+
+		s.salt = salt
+	}
+
+	aead, err := s.aead(s.salt)
+	return s.salt, aead, err
+}
+
+// adopt makes salt the one new data is sealed with, unless there is one
+// already, so we don't derive another key just to write back what we read.
+func (s *sealer) adopt(salt []byte) {
+	if s.salt == nil {
+		s.salt = append([]byte(nil), salt...)
+	}
+}
+
+func (s *sealer) seal(aead cipher.AEAD, plain []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plain, nil), nil
+}
+
+func (s *sealer) open(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("sealed data is cut short")
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+
+	result, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// sealFile encrypts the whole content of a file.
+func (s *sealer) sealFile(plain []byte) ([]byte, error) {
+	if s == nil {
+		return plain, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	salt, aead, err := s.sealingAead()
+	if err != nil {
+		return nil, fmt.Errorf("Could not encrypt: %s", err.Error())
+	}
+
+	sealed, err := s.seal(aead, plain)
+	if err != nil {
+		return nil, fmt.Errorf("Could not encrypt: %s", err.Error())
+	}
+
+	result := make([]byte, 0, len(sealedFileMagic)+len(salt)+len(sealed))
+	result = append(result, sealedFileMagic...)
+	result = append(result, salt...)
+
+	return append(result, sealed...), nil
+}
+
+// openFile decrypts a file written by sealFile. Files that aren't sealed are
+// returned as they are.
+func (s *sealer) openFile(b []byte) ([]byte, error) {
+	if !bytes.HasPrefix(b, []byte(sealedFileMagic)) {
+		return b, nil
+	}
+
+	if s == nil {
+		return nil, errSealedNoKey
+	}
+
+	b = b[len(sealedFileMagic):]
+	if len(b) < sealedSaltSize {
+		return nil, fmt.Errorf("The encrypted file is cut short")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	salt := b[:sealedSaltSize]
+
+	aead, err := s.aead(salt)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decrypt: %s", err.Error())
+	}
+
+	result, err := s.open(aead, b[sealedSaltSize:])
+	if err != nil {
+		return nil, errSealedWrongKey
+	}
+
+	s.adopt(salt)
+
+	return result, nil
+}
+
+// sealLine encrypts one append to a file that is sealed a line at a time.
+// fileSalt is the salt of a header the file already has, if any. Unless it is
+// the one sealLine seals with, a new header goes first. It returns the salt
+// of the header the appended line needs, to pass in next time.
+func (s *sealer) sealLine(plain []byte, fileSalt []byte) ([]byte, []byte, error) {
+	if s == nil {
+		return plain, nil, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.adopt(fileSalt)
+
+	salt, aead, err := s.sealingAead()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not encrypt: %s", err.Error())
+	}
+
+	sealed, err := s.seal(aead, plain)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not encrypt: %s", err.Error())
+	}
+
+	var result bytes.Buffer
+	if !bytes.Equal(salt, fileSalt) {
+		result.WriteString(sealedLinePrefix)
+		result.WriteString(base64.StdEncoding.EncodeToString(salt))
+		result.WriteByte('\n')
+	}
+
+	result.WriteString(base64.StdEncoding.EncodeToString(sealed))
+	result.WriteByte('\n')
+
+	return result.Bytes(), salt, nil
+}
+
+// lineSalt returns the salt in the header on the first line of r, if it has
+// one.
+func lineSalt(r io.Reader) []byte {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, sealedLinePrefix) {
+		return nil
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(strings.TrimSpace(line[len(sealedLinePrefix):]))
+	if err != nil || len(salt) != sealedSaltSize {
+		return nil
+	}
+
+	return salt
+}
+
+// openLines decrypts a file written by sealLine. Lines that can't be
+// decrypted, most likely because a crash cut them short, are skipped, and the
+// first of them is returned as an error along with the rest. It also returns
+// the salt of the last header, if there is one.
+//
+// Lines before the first header are returned as they are, so files that
+// were appended to before encryption was turned on can still be read. If no
+// line at all can be decrypted, the key must be wrong, and nothing is
+// returned.
+func (s *sealer) openLines(r io.Reader) ([]byte, []byte, error) {
+	var result bytes.Buffer
+	var aeads []cipher.AEAD
+	var lastSalt []byte
+	var firstErr error
+	opened, failed := 0, 0
+
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		} else if err != nil && err != io.EOF {
+			return result.Bytes(), lastSalt, err
+		}
+
+		// A line without its newline was cut short
+		torn := err == io.EOF
+
+		if bytes.HasPrefix(line, []byte(sealedLinePrefix)) {
+			if s == nil {
+				return nil, nil, errSealedNoKey
+			}
+
+			salt, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(line[len(sealedLinePrefix):])))
+			if err != nil || len(salt) != sealedSaltSize || torn {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("Invalid encryption header")
+				}
+
+				continue
+			}
+
+			s.mu.Lock()
+			aead, err := s.aead(salt)
+			s.adopt(salt)
+			s.mu.Unlock()
+
+			if err != nil {
+				return nil, nil, fmt.Errorf("Could not decrypt: %s", err.Error())
+			}
+
+			// Processes racing to start the file may each write a header,
+			// so the lines after them could be sealed under either
+			aeads = append([]cipher.AEAD{aead}, aeads...)
+			lastSalt = salt
+			continue
+		}
+
+		if aeads == nil {
+			result.Write(line)
+			continue
+		}
+
+		plain, err := s.openLine(aeads, line)
+		if err != nil || torn {
+			if !torn {
+				failed++
+			}
+
+			if firstErr == nil {
+				firstErr = fmt.Errorf("Could not decrypt a line, it was cut short or the encryption key is wrong")
+			}
+
+			continue
+		}
+
+		opened++
+		result.Write(plain)
+	}
+
+	if failed > 0 && opened == 0 {
+		return nil, nil, errSealedWrongKey
+	}
+
+	return result.Bytes(), lastSalt, firstErr
+}
+
+func (s *sealer) openLine(aeads []cipher.AEAD, line []byte) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(line)))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, aead := range aeads {
+		if result, err := s.open(aead, sealed); err == nil {
+			return result, nil
+		}
+	}
+
+	return nil, fmt.Errorf("could not decrypt")
+}
@@ -0,0 +1,494 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/oatmealraisin/tasker/pkg/models"
+)
+
+const (
+	snapshotTasks  = "tasks.json"
+	snapshotPrefix = "tasker-"
+	snapshotSuffix = ".tar.gz"
+	snapshotTime   = "20060102-150405.000"
+)
+
+// SnapshotDir is a directory that is saved in snapshots along with the Tasks,
+// such as the one a plugin keeps its data in.
+type SnapshotDir struct {
+	// Name is where the files go in the snapshot, such as "plugins/today".
+	// Restoring puts everything under Name back into Path.
+	Name string
+	Path string
+
+	// Each restores every directory right under Name to the directory of
+	// the same name in Path, such as "plugins/today" to Path/today, for a
+	// Name that is saved as one SnapshotDir per directory. Files right
+	// under Name don't belong to any of them, so they are refused.
+	Each bool
+	// Exclude lists directories nothing is restored into, such as the one
+	// plugins are loaded from.
+	Exclude []string
+}
+
+// WriteSnapshot writes every Task in s, and the files in dirs, to w as a
+// gzipped tar archive. The Tasks are in the format of the JSON Storage, so a
+// snapshot can be restored into any backend. Directories that don't exist are
+// left out.
+func WriteSnapshot(w io.Writer, s Storage, dirs []SnapshotDir) error {
+	// Saved as they are, even if they wouldn't migrate, since a snapshot
+	// is most useful when something went wrong
+	guids := s.GetAllTasks()
+	sort.Slice(guids, func(i, j int) bool { return guids[i] < guids[j] })
+
+	tasks := make([]models.Task, 0, len(guids))
+	for _, guid := range guids {
+		task, err := s.GetTask(guid)
+		if err != nil {
+			return fmt.Errorf("WriteSnapshot: could not read Task %d: %s", guid, err.Error())
+		}
+
+		tasks = append(tasks, task)
+	}
+
+	b, err := tasksToJson(tasks)
+	if err != nil {
+		return fmt.Errorf("WriteSnapshot: %s", err.Error())
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	header := &tar.Header{Name: snapshotTasks, Mode: 0644, Size: int64(len(b)), ModTime: time.Now()}
+	if err := tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("WriteSnapshot: %s", err.Error())
+	}
+
+	if _, err := tw.Write(b); err != nil {
+		return fmt.Errorf("WriteSnapshot: %s", err.Error())
+	}
+
+	for _, dir := range dirs {
+		if err := snapshotDir(tw, dir); err != nil {
+			return fmt.Errorf("WriteSnapshot: %s: %s", dir.Path, err.Error())
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("WriteSnapshot: %s", err.Error())
+	}
+
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("WriteSnapshot: %s", err.Error())
+	}
+
+	return nil
+}
+
+// snapshotDir adds the regular files under dir to tw.
+func snapshotDir(tw *tar.Writer, dir SnapshotDir) error {
+	if _, err := os.Stat(dir.Path); os.IsNotExist(err) {
+		return nil
+	}
+
+	return filepath.Walk(dir.Path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir.Path, p)
+		if err != nil {
+			return err
+		}
+
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = path.Join(dir.Name, filepath.ToSlash(rel))
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		_, err = io.Copy(tw, f)
+		return err
+	})
+}
+
+// snapshotFile is a file from a snapshot, along with where it is restored to.
+type snapshotFile struct {
+	filename string
+	mode     os.FileMode
+	content  []byte
+}
+
+// RestoreSnapshot replaces every Task in s with the Tasks in the snapshot r,
+// and puts the files of dirs back where they were saved from. Files in dirs
+// that aren't in the snapshot are left alone, as are files in the snapshot
+// under a name that isn't in dirs.
+//
+// The snapshot may be encrypted, see SaveSnapshot. The whole snapshot is read
+// and checked before anything is changed, and its Tasks are created with a
+// single CreateTasks. If that fails, the Tasks s had before are put back.
+func RestoreSnapshot(r io.Reader, s Storage, dirs []SnapshotDir) error {
+	tasks, files, err := readSnapshot(r, dirs)
+	if err != nil {
+		return fmt.Errorf("RestoreSnapshot: %s", err.Error())
+	}
+
+	guids := make([]uint64, 0, len(tasks))
+	byGuid := make(map[uint64]models.Task, len(tasks))
+	for _, task := range tasks {
+		if task.Guid == 0 {
+			return fmt.Errorf("RestoreSnapshot: Task '%s' has no GUID", task.Name)
+		}
+
+		guids = append(guids, task.Guid)
+		byGuid[task.Guid] = task
+	}
+
+	if tasks, err = parentsFirst(guids, byGuid); err != nil {
+		return fmt.Errorf("RestoreSnapshot: %s", err.Error())
+	}
+
+	current, err := migrationOrder(s)
+	if err != nil {
+		return fmt.Errorf("RestoreSnapshot: %s", err.Error())
+	}
+
+	if err := replaceTasks(s, current, tasks); err != nil {
+		return fmt.Errorf("RestoreSnapshot: %s", err.Error())
+	}
+
+	if err := verifyMigration(tasks, s); err != nil {
+		return fmt.Errorf("RestoreSnapshot: %s", err.Error())
+	}
+
+	for _, file := range files {
+		if err := os.MkdirAll(filepath.Dir(file.filename), 0755); err != nil {
+			return fmt.Errorf("RestoreSnapshot: %s", err.Error())
+		}
+
+		out := &lockedFile{filename: file.filename}
+		err := out.Write(func(w io.Writer) error {
+			_, err := w.Write(file.content)
+			return err
+		})
+		if err == nil {
+			err = os.Chmod(file.filename, file.mode)
+		}
+		if err != nil {
+			return fmt.Errorf("RestoreSnapshot: could not restore %s: %s", file.filename, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// replaceTasks deletes the current Tasks from s, and creates tasks instead. If
+// that fails, it puts back the Tasks it deleted.
+func replaceTasks(s Storage, current, tasks []models.Task) error {
+	var deleted []models.Task
+
+	for _, task := range current {
+		if err := s.DeleteTask(task.Guid); err != nil {
+			return putBack(s, current, deleted, fmt.Errorf("could not delete Task %d: %s", task.Guid, err.Error()))
+		}
+
+		deleted = append(deleted, task)
+	}
+
+	if errs := s.CreateTasks(tasks); len(errs) > 0 {
+		return putBack(s, current, deleted, fmt.Errorf("could not restore the Tasks:\n\t%s", errorList(errs)))
+	}
+
+	return nil
+}
+
+// putBack creates the Tasks replaceTasks deleted again, after it failed with
+// cause. Deleting them took them off the subtasks and dependencies of the
+// Tasks that are left, so those get them back too.
+func putBack(s Storage, current, deleted []models.Task, cause error) error {
+	if errs := s.CreateTasks(deleted); len(errs) > 0 {
+		return fmt.Errorf("%s\nCould not put back the Tasks from before either:\n\t%s", cause.Error(), errorList(errs))
+	}
+
+	var errs []error
+	for _, task := range current {
+		stored, err := s.GetTask(task.Guid)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if sameGuids(stored.Subtasks, task.Subtasks) && sameGuids(stored.Dependencies, task.Dependencies) {
+			continue
+		}
+
+		relinked := stored
+		relinked.Subtasks = task.Subtasks
+		relinked.Dependencies = task.Dependencies
+
+		if err := s.EditTask(stored, relinked); err != nil {
+			errs = append(errs, fmt.Errorf("Task %d: %s", task.Guid, err.Error()))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s\nThe Tasks from before were put back, but not all of their subtasks and dependencies:\n\t%s", cause.Error(), errorList(errs))
+	}
+
+	return fmt.Errorf("%s\nThe Tasks from before were put back", cause.Error())
+}
+
+// readSnapshot reads the Tasks of a snapshot, and the files that belong in
+// dirs.
+func readSnapshot(r io.Reader, dirs []SnapshotDir) ([]models.Task, []snapshotFile, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sealer, err := newSealer()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if b, err = sealer.openFile(b); err != nil {
+		return nil, nil, err
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, nil, fmt.Errorf("not a snapshot: %s", err.Error())
+	}
+	defer gz.Close()
+
+	var tasks []models.Task
+	var files []snapshotFile
+	found := false
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if header.Name == snapshotTasks {
+			if tasks, err = tasksFromJson(content); err != nil {
+				return nil, nil, fmt.Errorf("%s: %s", snapshotTasks, err.Error())
+			}
+
+			found = true
+			continue
+		}
+
+		filename, err := snapshotTarget(header.Name, dirs)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if filename != "" {
+			files = append(files, snapshotFile{filename, os.FileMode(header.Mode).Perm(), content})
+		}
+	}
+
+	if !found {
+		return nil, nil, fmt.Errorf("the snapshot has no %s", snapshotTasks)
+	}
+
+	return tasks, files, nil
+}
+
+// snapshotTarget returns where the file name in a snapshot is restored to, or
+// nothing if it isn't in any of dirs.
+func snapshotTarget(name string, dirs []SnapshotDir) (string, error) {
+	clean := path.Clean(name)
+	if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("the snapshot has a file outside of it: %s", name)
+	}
+
+	for _, dir := range dirs {
+		if !strings.HasPrefix(clean, dir.Name+"/") {
+			continue
+		}
+
+		rel := strings.TrimPrefix(clean, dir.Name+"/")
+		if dir.Each && !strings.Contains(rel, "/") {
+			return "", fmt.Errorf("the snapshot has a file that belongs to no directory in %s: %s", dir.Name, name)
+		}
+
+		result := filepath.Join(dir.Path, filepath.FromSlash(rel))
+		for _, exclude := range dir.Exclude {
+			if within(result, exclude) {
+				return "", fmt.Errorf("the snapshot has a file that would go in %s: %s", exclude, name)
+			}
+		}
+
+		return result, nil
+	}
+
+	return "", nil
+}
+
+// within reports whether filename is dir, or somewhere under it.
+func within(filename, dir string) bool {
+	rel, err := filepath.Rel(filepath.Clean(dir), filename)
+	if err != nil {
+		return false
+	}
+
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
+
+// SaveSnapshot writes a snapshot of s and dirs into the directory dir, named
+// after the time and reason, such as "tasker-20190325-093000.000-import.tar.gz".
+// The snapshot is encrypted if the config has a key, like the storage.
+// Then it deletes all but the newest keep snapshots in dir with the same reason,
+// unless keep is 0, so snapshots tasker saves by itself don't push out the ones
+// saved by hand. It returns the name of the new snapshot.
+func SaveSnapshot(dir string, s Storage, dirs []SnapshotDir, reason string, keep int) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("SaveSnapshot: %s", err.Error())
+	}
+
+	name := snapshotPrefix + time.Now().Format(snapshotTime)
+	if reason != "" {
+		name += "-" + reason
+	}
+	filename := filepath.Join(dir, name+snapshotSuffix)
+
+	if _, err := os.Stat(filename); err == nil {
+		return "", fmt.Errorf("SaveSnapshot: %s already exists", filename)
+	}
+
+	sealer, err := newSealer()
+	if err != nil {
+		return "", fmt.Errorf("SaveSnapshot: %s", err.Error())
+	}
+
+	out := &lockedFile{filename: filename}
+	err = out.Write(func(w io.Writer) error {
+		if sealer == nil {
+			return WriteSnapshot(w, s, dirs)
+		}
+
+		var buf bytes.Buffer
+		if err := WriteSnapshot(&buf, s, dirs); err != nil {
+			return err
+		}
+
+		b, err := sealer.sealFile(buf.Bytes())
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(b)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("SaveSnapshot: %s", err.Error())
+	}
+
+	if keep > 0 {
+		if err := rotateSnapshots(dir, reason, keep); err != nil {
+			return filename, fmt.Errorf("SaveSnapshot: %s", err.Error())
+		}
+	}
+
+	return filename, nil
+}
+
+// Snapshots lists the snapshots saved in dir, oldest first.
+func Snapshots(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Snapshots: %s", err.Error())
+	}
+
+	var result []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.Mode().IsRegular() && strings.HasPrefix(name, snapshotPrefix) && strings.HasSuffix(name, snapshotSuffix) {
+			result = append(result, filepath.Join(dir, name))
+		}
+	}
+
+	// The time is the first thing in the name, and always the same length
+	sort.Strings(result)
+
+	return result, nil
+}
+
+// snapshotReason is the reason a snapshot was saved for, from its filename.
+func snapshotReason(filename string) string {
+	name := strings.TrimSuffix(filepath.Base(filename), snapshotSuffix)
+	name = strings.TrimPrefix(name, snapshotPrefix)
+	if len(name) <= len(snapshotTime) {
+		return ""
+	}
+
+	return strings.TrimPrefix(name[len(snapshotTime):], "-")
+}
+
+// rotateSnapshots deletes all but the newest keep snapshots in dir that were
+// saved for reason.
+func rotateSnapshots(dir, reason string, keep int) error {
+	all, err := Snapshots(dir)
+	if err != nil {
+		return err
+	}
+
+	var snapshots []string
+	for _, snapshot := range all {
+		if snapshotReason(snapshot) == reason {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+
+	for len(snapshots) > keep {
+		if err := os.Remove(snapshots[0]); err != nil {
+			return err
+		}
+
+		snapshots = snapshots[1:]
+	}
+
+	return nil
+}
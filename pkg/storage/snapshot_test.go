@@ -0,0 +1,283 @@
+package storage_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oatmealraisin/tasker/pkg/models"
+	"github.com/oatmealraisin/tasker/pkg/storage"
+	"github.com/spf13/viper"
+)
+
+func jsonStorage(t *testing.T) storage.Storage {
+	dir := t.TempDir()
+	viper.Set("WorkingDir", dir)
+
+	s := storage.NewJsonStorage(filepath.Join(dir, "tasklist.json"))
+	if s == nil {
+		t.Fatal("Could not open the JSON Storage")
+	}
+
+	return s
+}
+
+// failingStorage fails its first CreateTasks without creating anything, like
+// a backend that finds a problem with one of the Tasks would, if failCreate is
+// set. It fails to delete the Task failDelete.
+type failingStorage struct {
+	storage.Storage
+	failCreate bool
+	failDelete uint64
+}
+
+func (f *failingStorage) CreateTasks(t []models.Task) []error {
+	if f.failCreate {
+		f.failCreate = false
+		return []error{fmt.Errorf("failing on purpose")}
+	}
+
+	return f.Storage.CreateTasks(t)
+}
+
+func (f *failingStorage) DeleteTask(guid uint64) error {
+	if guid == f.failDelete {
+		return fmt.Errorf("failing on purpose")
+	}
+
+	return f.Storage.DeleteTask(guid)
+}
+
+func TestRestoreSnapshotPutsBackOnFailure(t *testing.T) {
+	from := jsonStorage(t)
+	if err := from.CreateTask(models.Task{Name: "snapshotted"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var snapshot bytes.Buffer
+	if err := storage.WriteSnapshot(&snapshot, from, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	to := &failingStorage{Storage: jsonStorage(t), failCreate: true}
+	if errs := to.Storage.CreateTasks([]models.Task{{Name: "before"}, {Name: "before too"}}); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+
+	if err := storage.RestoreSnapshot(&snapshot, to, nil); err == nil {
+		t.Fatal("RestoreSnapshot succeeded, though creating the Tasks failed")
+	}
+
+	if guids := to.GetAllTasks(); len(guids) != 2 {
+		t.Errorf("Expected the 2 Tasks from before, found %v", guids)
+	}
+
+	for _, name := range []string{"before", "before too"} {
+		if guids := to.GetByName(name); len(guids) != 1 {
+			t.Errorf("GetByName(%s) = %v, expected it to be put back", name, guids)
+		}
+	}
+
+	if guids := to.GetByName("snapshotted"); len(guids) != 0 {
+		t.Errorf("GetByName(snapshotted) = %v, expected nothing from the snapshot", guids)
+	}
+}
+
+func TestRestoreSnapshotPutsBackLinksOnFailure(t *testing.T) {
+	storages := []struct {
+		name string
+		open func(t *testing.T) storage.Storage
+	}{
+		{"json", jsonStorage},
+		{"sqlite", tempStorage(storage.NewSqliteStorage, "tasklist.db")},
+	}
+
+	for _, st := range storages {
+		for _, failDelete := range []bool{false, true} {
+			st := st
+			t.Run(fmt.Sprintf("%s/failDelete=%t", st.name, failDelete), func(t *testing.T) {
+				var snapshot bytes.Buffer
+				if err := storage.WriteSnapshot(&snapshot, st.open(t), nil); err != nil {
+					t.Fatal(err)
+				}
+
+				to := &failingStorage{Storage: st.open(t)}
+				if errs := to.CreateTasks([]models.Task{{Guid: 1, Name: "parent"}, {Guid: 2, Name: "sub", Parent: 1}}); len(errs) > 0 {
+					t.Fatal(errs)
+				}
+				if err := to.CreateTask(models.Task{Guid: 3, Name: "dependant", Dependencies: []uint64{2}}); err != nil {
+					t.Fatal(err)
+				}
+
+				// Deleting the parent and subtask first takes them off
+				// the Tasks that are left
+				if failDelete {
+					to.failDelete = 3
+				} else {
+					to.failCreate = true
+				}
+
+				if err := storage.RestoreSnapshot(&snapshot, to, nil); err == nil {
+					t.Fatal("RestoreSnapshot succeeded, though it was meant to fail")
+				}
+
+				parent, err := to.GetTask(1)
+				if err != nil || len(parent.Subtasks) != 1 || parent.Subtasks[0] != 2 {
+					t.Errorf("GetTask(1) = %v, %v, expected the parent with subtask 2", parent, err)
+				}
+
+				if sub, err := to.GetTask(2); err != nil || sub.Parent != 1 {
+					t.Errorf("GetTask(2) = %v, %v, expected the subtask of 1", sub, err)
+				}
+
+				dependant, err := to.GetTask(3)
+				if err != nil || len(dependant.Dependencies) != 1 || dependant.Dependencies[0] != 2 {
+					t.Errorf("GetTask(3) = %v, %v, expected the dependant of 2", dependant, err)
+				}
+			})
+		}
+	}
+}
+
+func TestSaveSnapshotRotatesPerReason(t *testing.T) {
+	s := jsonStorage(t)
+	dir := t.TempDir()
+
+	save := func(reason string) string {
+		// Snapshots are named after the time, to the millisecond
+		time.Sleep(2 * time.Millisecond)
+
+		filename, err := storage.SaveSnapshot(dir, s, nil, reason, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return filepath.Base(filename)
+	}
+
+	manual := []string{save(""), save("")}
+	var imports []string
+	for i := 0; i < 3; i++ {
+		imports = append(imports, save("import"))
+	}
+
+	snapshots, err := storage.Snapshots(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, snapshot := range snapshots {
+		names = append(names, filepath.Base(snapshot))
+	}
+
+	expected := append(manual, imports[1:]...)
+	if strings.Join(names, " ") != strings.Join(expected, " ") {
+		t.Errorf("Snapshots = %v, expected %v", names, expected)
+	}
+}
+
+// craftedSnapshot adds files to the snapshot of s, as if someone had put them
+// in by hand.
+func craftedSnapshot(t *testing.T, s storage.Storage, files map[string]string) *bytes.Buffer {
+	var snapshot bytes.Buffer
+	if err := storage.WriteSnapshot(&snapshot, s, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	gz, err := gzip.NewReader(&snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var crafted bytes.Buffer
+	gw := gzip.NewWriter(&crafted)
+	tw := tar.NewWriter(gw)
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			break
+		}
+
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, content := range files {
+		header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return &crafted
+}
+
+func TestRestoreSnapshotKeepsPluginFilesInPlace(t *testing.T) {
+	dataDir := t.TempDir()
+	pluginDir := filepath.Join(dataDir, "autoload")
+	dirs := []storage.SnapshotDir{{Name: "plugins", Path: dataDir, Each: true, Exclude: []string{pluginDir}}}
+
+	from := jsonStorage(t)
+	if err := from.CreateTask(models.Task{Name: "snapshotted"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"plugins/config.yaml", "plugins/autoload/evil.so", "plugins/autoload/../autoload/evil.so"} {
+		t.Run(name, func(t *testing.T) {
+			snapshot := craftedSnapshot(t, from, map[string]string{name: "crafted"})
+
+			to := jsonStorage(t)
+			if err := storage.RestoreSnapshot(snapshot, to, dirs); err == nil {
+				t.Fatalf("RestoreSnapshot restored %s", name)
+			}
+
+			if guids := to.GetAllTasks(); len(guids) != 0 {
+				t.Errorf("Expected no Tasks to be restored, found %v", guids)
+			}
+
+			for _, filename := range []string{filepath.Join(dataDir, "config.yaml"), filepath.Join(pluginDir, "evil.so")} {
+				if _, err := os.Stat(filename); !os.IsNotExist(err) {
+					t.Errorf("Expected %s not to be written", filename)
+				}
+			}
+		})
+	}
+
+	snapshot := craftedSnapshot(t, from, map[string]string{"plugins/today/today.json": "{}"})
+	if err := storage.RestoreSnapshot(snapshot, jsonStorage(t), dirs); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, err := ioutil.ReadFile(filepath.Join(dataDir, "today", "today.json")); err != nil || string(b) != "{}" {
+		t.Errorf("Expected the data of the today plugin to be restored, read %q, %v", b, err)
+	}
+}
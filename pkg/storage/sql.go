@@ -0,0 +1,727 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	tspb "github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/oatmealraisin/tasker/pkg/models"
+)
+
+// sqlStorage implements Storage on top of database/sql. The SQL backends embed
+// it and only provide what differs between databases: the schema, how query
+// parameters are written and how to lock a table.
+//
+// Every Task is a row in the tasks table. Tags, subtasks and dependencies live
+// in their own tables, so lookups by any of them don't need to load the whole
+// list. Dependants are not stored, they are derived from the dependencies of
+// other Tasks.
+type sqlStorage struct {
+	db   *sql.DB
+	name string
+
+	// rebind rewrites a query using '?' placeholders into the form the
+	// database expects.
+	rebind func(query string) string
+	// lockTable is a format string taking a table name. If it is set, it is
+	// run at the start of transactions that need the whole table to stay
+	// still, such as allocating a new GUID.
+	lockTable string
+	// migrations are applied in order. The index of the last applied
+	// migration is kept in the schema_version table, so only new ones run.
+	migrations []string
+}
+
+// querier is satisfied by both *sql.DB and *sql.Tx, so that reads can happen
+// inside or outside of a transaction.
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func (s *sqlStorage) errorf(method, format string, a ...interface{}) error {
+	return fmt.Errorf("%s.%s: %s", s.name, method, fmt.Sprintf(format, a...))
+}
+
+func (s *sqlStorage) exec(q querier, query string, args ...interface{}) (sql.Result, error) {
+	return q.Exec(s.rebind(query), args...)
+}
+
+func (s *sqlStorage) queryRow(q querier, query string, args ...interface{}) *sql.Row {
+	return q.QueryRow(s.rebind(query), args...)
+}
+
+func (s *sqlStorage) lock(q querier, table string) error {
+	if s.lockTable == "" {
+		return nil
+	}
+
+	_, err := q.Exec(fmt.Sprintf(s.lockTable, table))
+	return err
+}
+
+// migrate brings the schema up to date, creating it on first use.
+func (s *sqlStorage) migrate() error {
+	_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)`)
+	if err != nil {
+		return s.errorf("migrate", "%s", err.Error())
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return s.errorf("migrate", "%s", err.Error())
+	}
+	defer tx.Rollback()
+
+	if err := s.lock(tx, "schema_version"); err != nil {
+		return s.errorf("migrate", "%s", err.Error())
+	}
+
+	var version int
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&version); err != nil {
+		return s.errorf("migrate", "%s", err.Error())
+	}
+
+	for i := version; i < len(s.migrations); i++ {
+		if _, err := tx.Exec(s.migrations[i]); err != nil {
+			return s.errorf("migrate", "migration %d: %s", i+1, err.Error())
+		}
+
+		if _, err := s.exec(tx, `INSERT INTO schema_version (version) VALUES (?)`, i+1); err != nil {
+			return s.errorf("migrate", "migration %d: %s", i+1, err.Error())
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return s.errorf("migrate", "%s", err.Error())
+	}
+
+	return nil
+}
+
+func (s *sqlStorage) CreateTask(t models.Task) error {
+	_, err := s.CreateTaskStored(t)
+	return err
+}
+
+func (s *sqlStorage) CreateTaskStored(t models.Task) (models.Task, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return t, s.errorf("CreateTask", "%s", err.Error())
+	}
+
+	stored, err := s.createTask(tx, t)
+	if err != nil {
+		tx.Rollback()
+		return t, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return t, s.errorf("CreateTask", "%s", err.Error())
+	}
+
+	return stored, nil
+}
+
+func (s *sqlStorage) CreateTasks(t []models.Task) []error {
+	_, errs := s.CreateTasksStored(t)
+	return errs
+}
+
+// CreateTasksStored creates all of the given Tasks in a single transaction. If
+// any of them fails, none of them are created.
+func (s *sqlStorage) CreateTasksStored(t []models.Task) ([]models.Task, []error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, []error{s.errorf("CreateTasks", "%s", err.Error())}
+	}
+
+	var result []models.Task
+
+	for i, task := range t {
+		stored, err := s.createTask(tx, task)
+		if err != nil {
+			tx.Rollback()
+			return nil, []error{fmt.Errorf("Task %d (%s): %s", i, task.Name, err.Error())}
+		}
+
+		result = append(result, stored)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, []error{s.errorf("CreateTasks", "%s", err.Error())}
+	}
+
+	return result, nil
+}
+
+func (s *sqlStorage) createTask(q querier, t models.Task) (models.Task, error) {
+	err := s.lock(q, "tasks")
+	if err != nil {
+		return t, s.errorf("CreateTask", "%s", err.Error())
+	}
+
+	if t.Guid != 0 {
+		// Only a missing row means the GUID is free, other errors may
+		// just as well hide a Task that has it
+		var name string
+		err = s.queryRow(q, `SELECT name FROM tasks WHERE guid = ?`, t.Guid).Scan(&name)
+		if err == nil {
+			return t, fmt.Errorf("Task with GUID %d already exists:\n\t%s\n", t.Guid, name)
+		} else if err != sql.ErrNoRows {
+			return t, s.errorf("CreateTask", "%s", err.Error())
+		}
+
+		// Keep the sequence past it, see guidAllocator
+		_, err = s.exec(q, `UPDATE guid_sequence SET last = ? WHERE last < ?`, t.Guid, t.Guid)
+		if err != nil {
+			return t, s.errorf("CreateTask", "%s", err.Error())
+		}
+	} else {
+		t.Guid, err = s.nextGuid(q)
+		if err != nil {
+			return t, s.errorf("CreateTask", "%s", err.Error())
+		}
+	}
+
+	if t.Added == nil {
+		t.Added = ptypes.TimestampNow()
+	}
+
+	if t.Parent != 0 {
+		p, err := s.getTask(q, t.Parent)
+		if err != nil {
+			return t, fmt.Errorf("Could not add Parent %d: %s", t.Parent, err.Error())
+		}
+
+		if !containsGuid(p.Subtasks, t.Guid) {
+			_, err = s.exec(q, `INSERT INTO subtasks (parent, subtask, position) VALUES (?, ?, ?)`,
+				p.Guid, t.Guid, len(p.Subtasks))
+			if err != nil {
+				return t, fmt.Errorf("Could not add Parent %d: %s", t.Parent, err.Error())
+			}
+
+			// The parent changed, so copies of it from before can't be
+			// written back over the new subtask
+			_, err = s.exec(q, `UPDATE tasks SET revision = revision + 1 WHERE guid = ?`, p.Guid)
+			if err != nil {
+				return t, fmt.Errorf("Could not add Parent %d: %s", t.Parent, err.Error())
+			}
+		}
+	}
+
+	_, err = s.exec(q, `INSERT INTO tasks (
+		guid, name, priority, size, added, active, due, finished, removed,
+		repeats, guid_previous, url, parent, revision
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		t.Guid, t.Name, t.Priority, t.Size,
+		timestampToNullTime(t.Added),
+		timestampToNullTime(t.Active),
+		timestampToNullTime(t.Due),
+		timestampToNullTime(t.Finished),
+		t.Removed, t.Repeats, t.GuidPrevious, t.Url, t.Parent, t.Revision,
+	)
+	if err != nil {
+		return t, s.errorf("CreateTask", "%s", err.Error())
+	}
+
+	return t, s.writeRelations(q, t)
+}
+
+// nextGuid takes the next GUID from guid_sequence. GUIDs of deleted Tasks are
+// never handed out again.
+func (s *sqlStorage) nextGuid(q querier) (uint64, error) {
+	if _, err := s.exec(q, `UPDATE guid_sequence SET last = last + 1`); err != nil {
+		return 0, err
+	}
+
+	var result uint64
+	if err := s.queryRow(q, `SELECT last FROM guid_sequence`).Scan(&result); err != nil {
+		return 0, err
+	}
+
+	return result, nil
+}
+
+func (s *sqlStorage) EditTask(oldTask, newTask models.Task) error {
+	if oldTask.Guid != newTask.Guid {
+		return fmt.Errorf("Cannot change the GUID of a Task.")
+	}
+
+	if !proto.Equal(oldTask.Added, newTask.Added) {
+		return fmt.Errorf("Cannot change the add date of a Task")
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return s.errorf("EditTask", "%s", err.Error())
+	}
+
+	if err := s.editTask(tx, oldTask.Revision, newTask); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return s.errorf("EditTask", "%s", err.Error())
+	}
+
+	return nil
+}
+
+// editTask writes t over the Task with the same GUID, if it is still at
+// revision, and moves it on to the next revision.
+func (s *sqlStorage) editTask(q querier, revision uint64, t models.Task) error {
+	res, err := s.exec(q, `UPDATE tasks SET
+		name = ?, priority = ?, size = ?, active = ?, due = ?, finished = ?,
+		removed = ?, repeats = ?, guid_previous = ?, url = ?, parent = ?,
+		revision = revision + 1
+	WHERE guid = ? AND revision = ?`,
+		t.Name, t.Priority, t.Size,
+		timestampToNullTime(t.Active),
+		timestampToNullTime(t.Due),
+		timestampToNullTime(t.Finished),
+		t.Removed, t.Repeats, t.GuidPrevious, t.Url, t.Parent,
+		t.Guid, revision,
+	)
+	if err != nil {
+		return s.errorf("EditTask", "%s", err.Error())
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		current, err := s.getTask(q, t.Guid)
+		if err != nil {
+			return s.errorf("EditTask", "Guid %d not found.", t.Guid)
+		}
+
+		return ConflictError{Guid: t.Guid, Revision: revision, Current: current.Revision}
+	}
+
+	return s.writeRelations(q, t)
+}
+
+// writeRelations replaces the tags, subtasks and dependencies of a Task with
+// the ones in t.
+func (s *sqlStorage) writeRelations(q querier, t models.Task) error {
+	for _, table := range []string{"tags", "dependencies"} {
+		if _, err := s.exec(q, fmt.Sprintf(`DELETE FROM %s WHERE guid = ?`, table), t.Guid); err != nil {
+			return s.errorf("writeRelations", "Could not clear %s: %s", table, err.Error())
+		}
+	}
+
+	if _, err := s.exec(q, `DELETE FROM subtasks WHERE parent = ?`, t.Guid); err != nil {
+		return s.errorf("writeRelations", "Could not clear subtasks: %s", err.Error())
+	}
+
+	for i, tag := range t.Tags {
+		_, err := s.exec(q, `INSERT INTO tags (guid, tag, position) VALUES (?, ?, ?) ON CONFLICT DO NOTHING`, t.Guid, tag, i)
+		if err != nil {
+			return s.errorf("writeRelations", "Could not add tag '%s': %s", tag, err.Error())
+		}
+	}
+
+	for i, subtask := range t.Subtasks {
+		_, err := s.exec(q, `INSERT INTO subtasks (parent, subtask, position) VALUES (?, ?, ?) ON CONFLICT DO NOTHING`, t.Guid, subtask, i)
+		if err != nil {
+			return s.errorf("writeRelations", "Could not add subtask %d: %s", subtask, err.Error())
+		}
+	}
+
+	for i, dependency := range t.Dependencies {
+		_, err := s.exec(q, `INSERT INTO dependencies (guid, dependency, position) VALUES (?, ?, ?) ON CONFLICT DO NOTHING`, t.Guid, dependency, i)
+		if err != nil {
+			return s.errorf("writeRelations", "Could not add dependency %d: %s", dependency, err.Error())
+		}
+	}
+
+	return nil
+}
+
+func (s *sqlStorage) GetTask(guid uint64) (models.Task, error) {
+	if guid == 0 {
+		return models.Task{}, getZeroGuidError{}
+	}
+
+	return s.getTask(s.db, guid)
+}
+
+func (s *sqlStorage) getTask(q querier, guid uint64) (models.Task, error) {
+	var result models.Task
+	var added, active, due, finished sql.NullTime
+
+	err := s.queryRow(q, `SELECT
+		guid, name, priority, size, added, active, due, finished, removed,
+		repeats, guid_previous, url, parent, revision
+	FROM tasks WHERE guid = ?`, guid).Scan(
+		&result.Guid, &result.Name, &result.Priority, &result.Size,
+		&added, &active, &due, &finished,
+		&result.Removed, &result.Repeats, &result.GuidPrevious, &result.Url, &result.Parent,
+		&result.Revision,
+	)
+	if err == sql.ErrNoRows {
+		return models.Task{}, s.errorf("GetTask", "guid not found %d", guid)
+	} else if err != nil {
+		return models.Task{}, s.errorf("GetTask", "%s", err.Error())
+	}
+
+	result.Added = nullTimeToTimestamp(added)
+	result.Active = nullTimeToTimestamp(active)
+	result.Due = nullTimeToTimestamp(due)
+	result.Finished = nullTimeToTimestamp(finished)
+
+	if result.Tags, err = s.queryStrings(q, `SELECT tag FROM tags WHERE guid = ? ORDER BY position`, guid); err != nil {
+		return models.Task{}, err
+	}
+
+	if result.Subtasks, err = s.queryGuids(q, `SELECT subtask FROM subtasks WHERE parent = ? ORDER BY position`, guid); err != nil {
+		return models.Task{}, err
+	}
+
+	if result.Dependencies, err = s.queryGuids(q, `SELECT dependency FROM dependencies WHERE guid = ? ORDER BY position`, guid); err != nil {
+		return models.Task{}, err
+	}
+
+	if result.Dependants, err = s.queryGuids(q, `SELECT guid FROM dependencies WHERE dependency = ? ORDER BY guid`, guid); err != nil {
+		return models.Task{}, err
+	}
+
+	return result, nil
+}
+
+func (s *sqlStorage) GetByTag(tag string) []uint64 {
+	result, err := s.queryGuids(s.db, `SELECT guid FROM tags WHERE tag = ? ORDER BY guid`, tag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+	}
+
+	return result
+}
+
+func (s *sqlStorage) GetByTags(tags []string) []uint64 {
+	result := []uint64{}
+	for _, tag := range tags {
+		if tasks := s.GetByTag(tag); len(tasks) > 0 {
+			result = append(result, tasks...)
+		} else {
+			fmt.Fprintf(os.Stderr, "Could not find tasks with tag '%s'\n", tag)
+		}
+	}
+
+	return result
+}
+
+func (s *sqlStorage) GetByName(name string) []uint64 {
+	result, err := s.queryGuids(s.db, `SELECT guid FROM tasks WHERE name = ? ORDER BY guid`, name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+	}
+
+	if len(result) == 0 {
+		return nil
+	}
+
+	return result
+}
+
+func (s *sqlStorage) GetAllTasks() []uint64 {
+	result, err := s.queryGuids(s.db, `SELECT guid FROM tasks ORDER BY guid`)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+	}
+
+	return result
+}
+
+func (s *sqlStorage) GetAllTags() []string {
+	result, err := s.queryStrings(s.db, `SELECT DISTINCT tag FROM tags ORDER BY tag`)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+	}
+
+	return result
+}
+
+// Query finds the Tasks matching q with a single SELECT, see Queryable.
+func (s *sqlStorage) Query(q Query) ([]uint64, error) {
+	where, args := queryWhere(q)
+
+	return s.queryGuids(s.db, `SELECT guid FROM tasks`+where+` ORDER BY guid`, args...)
+}
+
+// NextDue lets the database sort by due date, see Ranker.
+func (s *sqlStorage) NextDue(n int, q Query) ([]uint64, error) {
+	where, args := queryWhere(q, "due IS NOT NULL")
+
+	return s.queryGuids(s.db, `SELECT guid FROM tasks`+where+` ORDER BY due, guid`+queryLimit(n), args...)
+}
+
+// TopByPriority lets the database sort by priority, see Ranker.
+func (s *sqlStorage) TopByPriority(n int, q Query) ([]uint64, error) {
+	where, args := queryWhere(q)
+
+	return s.queryGuids(s.db, `SELECT guid FROM tasks`+where+` ORDER BY priority DESC, guid`+queryLimit(n), args...)
+}
+
+// TopByScore filters in the database, but scores depend on the time, so the
+// Tasks are sorted here.
+func (s *sqlStorage) TopByScore(n int, q Query) ([]uint64, error) {
+	return rankTasks(s, n, q, nil, nil)
+}
+
+// queryWhere turns a Query into a WHERE clause on the tasks table, along with
+// its arguments. Any extra conditions are added to it.
+func queryWhere(q Query, extra ...string) (string, []interface{}) {
+	where := extra
+	var args []interface{}
+
+	if len(q.Tags) > 0 {
+		placeholders := make([]string, len(q.Tags))
+		for i, tag := range q.Tags {
+			placeholders[i] = "?"
+			args = append(args, tag)
+		}
+
+		where = append(where, fmt.Sprintf("guid IN (SELECT guid FROM tags WHERE tag IN (%s))", strings.Join(placeholders, ", ")))
+	}
+
+	if q.Finished != nil {
+		if *q.Finished {
+			where = append(where, "finished IS NOT NULL")
+		} else {
+			where = append(where, "finished IS NULL")
+		}
+	}
+
+	if q.Removed != nil {
+		where = append(where, "removed = ?")
+		args = append(args, *q.Removed)
+	}
+
+	// Times are stored in UTC, so they compare correctly even in SQLite,
+	// where they are strings
+	if !q.DueBefore.IsZero() {
+		where = append(where, "due < ?")
+		args = append(args, q.DueBefore.UTC())
+	}
+
+	if !q.CreatedAfter.IsZero() {
+		where = append(where, "added > ?")
+		args = append(args, q.CreatedAfter.UTC())
+	}
+
+	if !q.CreatedBefore.IsZero() {
+		where = append(where, "added < ?")
+		args = append(args, q.CreatedBefore.UTC())
+	}
+
+	if q.SizeIs != nil {
+		where = append(where, "size = ?")
+		args = append(args, *q.SizeIs)
+	}
+
+	if q.SizeIsNot != nil {
+		where = append(where, "size <> ?")
+		args = append(args, *q.SizeIsNot)
+	}
+
+	if len(where) == 0 {
+		return "", args
+	}
+
+	return ` WHERE ` + strings.Join(where, " AND "), args
+}
+
+func queryLimit(n int) string {
+	if n <= 0 {
+		return ""
+	}
+
+	return fmt.Sprintf(" LIMIT %d", n)
+}
+
+// DeleteTask deletes a Task, and takes it off the subtasks and dependencies
+// of other Tasks, in a single transaction.
+func (s *sqlStorage) DeleteTask(guid uint64) error {
+	_, err := s.DeleteTaskUnlinked(guid)
+	return err
+}
+
+func (s *sqlStorage) DeleteTaskUnlinked(guid uint64) ([]models.Task, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, s.errorf("DeleteTask", "%s", err.Error())
+	}
+
+	unlinked, err := s.unlinked(tx, guid)
+	if err == nil {
+		err = s.deleteTask(tx, guid)
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, s.errorf("DeleteTask", "%s", err.Error())
+	}
+
+	return unlinked, nil
+}
+
+// unlinked returns the Tasks that have guid as a subtask or a dependency.
+func (s *sqlStorage) unlinked(q querier, guid uint64) ([]models.Task, error) {
+	guids, err := s.queryGuids(q, `SELECT parent FROM subtasks WHERE subtask = ?
+		UNION SELECT guid FROM dependencies WHERE dependency = ?`, guid, guid)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []models.Task
+	for _, ref := range guids {
+		task, err := s.getTask(q, ref)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, task)
+	}
+
+	return result, nil
+}
+
+func (s *sqlStorage) deleteTask(q querier, guid uint64) error {
+	res, err := s.exec(q, `DELETE FROM tasks WHERE guid = ?`, guid)
+	if err != nil {
+		return s.errorf("DeleteTask", "%s", err.Error())
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return s.errorf("DeleteTask", "Guid %d not found.", guid)
+	}
+
+	// The Tasks that pointed at it changed, so copies of them from before
+	// can't be written back with it
+	_, err = s.exec(q, `UPDATE tasks SET revision = revision + 1 WHERE guid IN (
+		SELECT parent FROM subtasks WHERE subtask = ?
+		UNION SELECT guid FROM dependencies WHERE dependency = ?
+	)`, guid, guid)
+	if err != nil {
+		return s.errorf("DeleteTask", "%s", err.Error())
+	}
+
+	if _, err := s.exec(q, `DELETE FROM subtasks WHERE subtask = ?`, guid); err != nil {
+		return s.errorf("DeleteTask", "Could not clear subtasks: %s", err.Error())
+	}
+
+	if _, err := s.exec(q, `DELETE FROM dependencies WHERE dependency = ?`, guid); err != nil {
+		return s.errorf("DeleteTask", "Could not clear dependencies: %s", err.Error())
+	}
+
+	return nil
+}
+
+func (s *sqlStorage) queryGuids(q querier, query string, args ...interface{}) ([]uint64, error) {
+	rows, err := q.Query(s.rebind(query), args...)
+	if err != nil {
+		return nil, s.errorf("queryGuids", "%s", err.Error())
+	}
+	defer rows.Close()
+
+	result := []uint64{}
+	for rows.Next() {
+		var guid uint64
+		if err := rows.Scan(&guid); err != nil {
+			return nil, s.errorf("queryGuids", "%s", err.Error())
+		}
+
+		result = append(result, guid)
+	}
+
+	return result, rows.Err()
+}
+
+func (s *sqlStorage) queryStrings(q querier, query string, args ...interface{}) ([]string, error) {
+	rows, err := q.Query(s.rebind(query), args...)
+	if err != nil {
+		return nil, s.errorf("queryStrings", "%s", err.Error())
+	}
+	defer rows.Close()
+
+	result := []string{}
+	for rows.Next() {
+		var str string
+		if err := rows.Scan(&str); err != nil {
+			return nil, s.errorf("queryStrings", "%s", err.Error())
+		}
+
+		result = append(result, str)
+	}
+
+	return result, rows.Err()
+}
+
+// rebindQuestion leaves '?' placeholders as they are.
+func rebindQuestion(query string) string {
+	return query
+}
+
+// rebindDollar numbers the '?' placeholders of a query, as in $1, $2, ...
+func rebindDollar(query string) string {
+	var b strings.Builder
+	n := 0
+
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$")
+			b.WriteString(strconv.Itoa(n))
+			continue
+		}
+
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+func timestampToNullTime(t *tspb.Timestamp) sql.NullTime {
+	if t == nil {
+		return sql.NullTime{}
+	}
+
+	result, err := ptypes.Timestamp(t)
+	if err != nil {
+		return sql.NullTime{}
+	}
+
+	return sql.NullTime{Time: result, Valid: true}
+}
+
+func nullTimeToTimestamp(t sql.NullTime) *tspb.Timestamp {
+	if !t.Valid {
+		return nil
+	}
+
+	result, err := ptypes.TimestampProto(t.Time)
+	if err != nil {
+		return nil
+	}
+
+	return result
+}
+
+func containsGuid(l []uint64, u uint64) bool {
+	for _, uuid := range l {
+		if uuid == u {
+			return true
+		}
+	}
+
+	return false
+}
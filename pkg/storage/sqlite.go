@@ -1,36 +1,110 @@
 package storage
 
 import (
+	"database/sql"
+	"fmt"
 	"os"
 
-	"github.com/oatmealraisin/tasker/pkg/models"
+	_ "github.com/mattn/go-sqlite3"
 )
 
-type SqliteStorage struct {
-	f      os.File
-	buffer map[uint64]*models.Task
-}
+var sqliteMigrations = []string{`
+CREATE TABLE IF NOT EXISTS tasks (
+	guid          INTEGER PRIMARY KEY,
+	name          TEXT NOT NULL,
+	priority      INTEGER NOT NULL DEFAULT 0,
+	size          INTEGER NOT NULL DEFAULT 0,
+	added         TIMESTAMP,
+	active        TIMESTAMP,
+	due           TIMESTAMP,
+	finished      TIMESTAMP,
+	removed       BOOLEAN NOT NULL DEFAULT 0,
+	repeats       BOOLEAN NOT NULL DEFAULT 0,
+	guid_previous INTEGER NOT NULL DEFAULT 0,
+	url           TEXT NOT NULL DEFAULT '',
+	parent        INTEGER NOT NULL DEFAULT 0
+);
 
-func (s *SqliteStorage) CreateTask(t *models.Task) error {
-	panic("not implemented")
-}
+CREATE INDEX IF NOT EXISTS tasks_name ON tasks (name);
 
-func (s *SqliteStorage) CreateTasks(t []*models.Task) []error {
-	panic("not implemented")
-}
+CREATE TABLE IF NOT EXISTS tags (
+	guid     INTEGER NOT NULL REFERENCES tasks (guid) ON DELETE CASCADE,
+	tag      TEXT NOT NULL,
+	position INTEGER NOT NULL,
+	PRIMARY KEY (guid, tag)
+);
 
-func (s *SqliteStorage) GetTask(guid uint64) (models.Task, error) {
-	panic("not implemented")
-}
+CREATE INDEX IF NOT EXISTS tags_tag ON tags (tag);
+
+CREATE TABLE IF NOT EXISTS subtasks (
+	parent   INTEGER NOT NULL REFERENCES tasks (guid) ON DELETE CASCADE,
+	subtask  INTEGER NOT NULL,
+	position INTEGER NOT NULL,
+	PRIMARY KEY (parent, subtask)
+);
+
+CREATE TABLE IF NOT EXISTS dependencies (
+	guid       INTEGER NOT NULL REFERENCES tasks (guid) ON DELETE CASCADE,
+	dependency INTEGER NOT NULL,
+	position   INTEGER NOT NULL,
+	PRIMARY KEY (guid, dependency)
+);
+
+CREATE INDEX IF NOT EXISTS dependencies_dependency ON dependencies (dependency);
+`, `
+CREATE TABLE guid_sequence (last INTEGER NOT NULL);
 
-func (s *SqliteStorage) GetByTag(tag string) ([]models.Task, error) {
-	panic("not implemented")
+INSERT INTO guid_sequence (last) SELECT COALESCE(MAX(guid), 0) FROM tasks;
+`, `
+ALTER TABLE tasks ADD COLUMN revision INTEGER NOT NULL DEFAULT 0;
+`,
 }
 
-func (s *SqliteStorage) GetByName(name string) ([]models.Task, error) {
-	panic("not implemented")
+// SqliteStorage keeps Tasks in a single SQLite database file.
+type SqliteStorage struct {
+	*sqlStorage
 }
 
-func (s *SqliteStorage) GetAllTasks() ([]models.Task, error) {
-	panic("not implemented")
+func NewSqliteStorage(filename string) Storage {
+	var err error
+
+	err = setupStorageDir()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not create storage directory: %s\n", err.Error())
+		return nil
+	}
+
+	sealer, err := newSealer()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not open SQLite Storage: %s\n", err.Error())
+		return nil
+	} else if sealer != nil {
+		fmt.Fprintf(os.Stderr, "Could not open SQLite Storage: it can't be encrypted, unset EncryptionKey and EncryptionKeyFile or use another StorageType\n")
+		return nil
+	}
+
+	// Transactions take the write lock up front, so two tasker processes
+	// can't both read the same next GUID.
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_foreign_keys=1&_busy_timeout=5000&_txlock=immediate", filename))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not open SQLite Storage: %s\n", err.Error())
+		return nil
+	}
+
+	result := &SqliteStorage{
+		sqlStorage: &sqlStorage{
+			db:         db,
+			name:       "SqliteStorage",
+			rebind:     rebindQuestion,
+			migrations: sqliteMigrations,
+		},
+	}
+
+	if err = result.migrate(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		db.Close()
+		return nil
+	}
+
+	return result
 }
@@ -0,0 +1,26 @@
+package storage_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/oatmealraisin/tasker/pkg/storage"
+	"github.com/spf13/viper"
+)
+
+func TestSqliteStorageEncrypted(t *testing.T) {
+	dir := t.TempDir()
+	viper.Set("WorkingDir", dir)
+	viper.Set("EncryptionKey", "hunter2")
+	defer viper.Set("EncryptionKey", "")
+
+	filename := filepath.Join(dir, "tasklist.db")
+	if s := storage.NewSqliteStorage(filename); s != nil {
+		t.Fatal("NewSqliteStorage opened a database that it can't encrypt")
+	}
+
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("NewSqliteStorage left %s behind in plaintext", filename)
+	}
+}
@@ -1,7 +1,10 @@
 package storage
 
 import (
+	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/oatmealraisin/tasker/pkg/models"
 	"github.com/spf13/viper"
@@ -9,8 +12,16 @@ import (
 
 type Storage interface {
 	CreateTask(t models.Task) error
+
+	// CreateTasks creates all of the given Tasks, or none of them. If nothing
+	// was created, it returns at least one error, otherwise it returns none.
+	// Use CreateTasksPartial to create as many as possible instead.
 	CreateTasks(t []models.Task) []error
 
+	// EditTask replaces a Task with newTask, as long as it hasn't changed
+	// since the caller read oldTask: if the stored Task has another revision
+	// than oldTask, it returns a ConflictError and changes nothing. The
+	// stored Task gets the next revision, whatever newTask has.
 	EditTask(oldTask, newTask models.Task) error
 
 	GetTask(guid uint64) (models.Task, error)
@@ -28,6 +39,218 @@ type Storage interface {
 	DeleteTask(guid uint64) error
 }
 
+// Creator is implemented by Storages that return the Tasks they create, as
+// they stored them. Those have the GUIDs the Storage gave them, so wrappers
+// like HistoryStorage know exactly which Tasks a call created, without
+// looking for new GUIDs that may just as well be someone else's.
+//
+// A wrapper is a Creator as long as the Storage it wraps is one. Otherwise
+// only the Tasks that came with a GUID can be told apart: CreateTaskStored
+// returns the others without one, and CreateTasksStored leaves them out.
+type Creator interface {
+	// CreateTaskStored is CreateTask, returning the Task as it was stored.
+	CreateTaskStored(t models.Task) (models.Task, error)
+
+	// CreateTasksStored is CreateTasks, returning the Tasks as they were
+	// stored, in the same order.
+	CreateTasksStored(t []models.Task) ([]models.Task, []error)
+}
+
+// Deleter is implemented by Storages that return the Tasks a delete took the
+// deleted Task off of. Those are found while deleting anyway, so wrappers like
+// HistoryStorage don't have to look through every Task for them.
+//
+// A wrapper is a Deleter as long as the Storage it wraps is one. Otherwise it
+// looks through every Task for them before deleting.
+type Deleter interface {
+	// DeleteTaskUnlinked is DeleteTask, returning the Tasks that had guid as
+	// a subtask or a dependency, as they were before.
+	DeleteTaskUnlinked(guid uint64) ([]models.Task, error)
+}
+
+// ConflictError is returned by EditTask when the Task was changed since the
+// caller read it, such as by a plugin or another tasker process. The caller
+// should get the Task again and redo its edit.
+type ConflictError struct {
+	Guid uint64
+	// Revision is the revision of the caller's copy, and Current the one
+	// that is stored.
+	Revision uint64
+	Current  uint64
+}
+
+func (e ConflictError) Error() string {
+	return fmt.Sprintf("Task %d was changed since it was read, it is at revision %d instead of %d", e.Guid, e.Current, e.Revision)
+}
+
+// IsConflictError reports whether err is a ConflictError.
+func IsConflictError(err error) bool {
+	_, ok := err.(ConflictError)
+	return ok
+}
+
+// Wrapper is implemented by Storages that add to another Storage, such as
+// HistoryStorage. Optional interfaces like Ranker and Queryable are looked up
+// on the wrapped Storage too, so wrapping doesn't lose them.
+type Wrapper interface {
+	Unwrap() Storage
+}
+
+// layers returns s followed by every Storage it wraps, outermost first.
+func layers(s Storage) []Storage {
+	result := []Storage{s}
+
+	for {
+		w, ok := s.(Wrapper)
+		if !ok {
+			return result
+		}
+
+		s = w.Unwrap()
+		result = append(result, s)
+	}
+}
+
+// Open opens the Storage of the given type, as it would be named by the
+// StorageType setting, with its files in WorkingDir.
+func Open(storageType string) (Storage, error) {
+	var result Storage
+
+	switch storageType {
+	case "csv":
+		result = NewCsvStorage(filepath.Join(viper.GetString("WorkingDir"), "tasklist.csv"))
+	case "json":
+		result = NewJsonStorage(filepath.Join(viper.GetString("WorkingDir"), "tasklist.json"))
+	case "yaml":
+		result = NewYamlStorage(filepath.Join(viper.GetString("WorkingDir"), "tasklist.yaml"))
+	case "sqlite":
+		result = NewSqliteStorage(filepath.Join(viper.GetString("WorkingDir"), "tasklist.db"))
+	case "proto":
+		result = NewProtoStorage(filepath.Join(viper.GetString("WorkingDir"), "tasklist.pb"))
+	case "bolt":
+		result = NewBoltStorage(filepath.Join(viper.GetString("WorkingDir"), "tasklist.bolt"))
+	case "git":
+		result = NewGitStorage(filepath.Join(viper.GetString("WorkingDir"), "tasklist"))
+	case "postgres":
+		result = NewPostgresStorage(PostgresDataSource())
+	default:
+		return nil, fmt.Errorf("Unknown database type: %s", storageType)
+	}
+
+	if result == nil {
+		return nil, fmt.Errorf("Could not open %s storage", storageType)
+	}
+
+	return result, nil
+}
+
+// CreateTasksPartial creates the given Tasks one at a time, so the ones that
+// can be created are, even if others fail. It returns an error for each Task
+// that wasn't created.
+func CreateTasksPartial(s Storage, t []models.Task) []error {
+	var result []error
+
+	for i, task := range t {
+		if err := s.CreateTask(task); err != nil {
+			result = append(result, fmt.Errorf("Task %d (%s): %s", i, task.Name, err.Error()))
+		}
+	}
+
+	return result
+}
+
+// errorList puts errors one per line, for messages about all of them.
+func errorList(errs []error) string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+
+	return strings.Join(messages, "\n\t")
+}
+
+// createStored creates t in s, and returns it as it was stored. If s isn't a
+// Creator, a Task without a GUID can't be told apart from ones others are
+// creating at the same time, so it is created but nothing is returned.
+func createStored(s Storage, t models.Task) (*models.Task, error) {
+	if c, ok := s.(Creator); ok {
+		stored, err := c.CreateTaskStored(t)
+		if err != nil || stored.Guid == 0 {
+			return nil, err
+		}
+
+		return &stored, nil
+	}
+
+	if err := s.CreateTask(t); err != nil {
+		return nil, err
+	}
+
+	return getStored(s, t), nil
+}
+
+// deleteUnlinked deletes guid from s, and returns the Tasks the delete took it
+// off of, as they were before. If s isn't a Deleter, they are looked for among
+// every Task first.
+func deleteUnlinked(s Storage, guid uint64) ([]models.Task, error) {
+	if d, ok := s.(Deleter); ok {
+		return d.DeleteTaskUnlinked(guid)
+	}
+
+	var unlinked []models.Task
+	for _, other := range s.GetAllTasks() {
+		task, err := s.GetTask(other)
+		if err != nil {
+			continue
+		}
+
+		if containsGuid(task.Subtasks, guid) || containsGuid(task.Dependencies, guid) {
+			unlinked = append(unlinked, task)
+		}
+	}
+
+	if err := s.DeleteTask(guid); err != nil {
+		return nil, err
+	}
+
+	return unlinked, nil
+}
+
+// createAllStored is createStored for CreateTasks. It returns the Tasks it
+// can tell were created.
+func createAllStored(s Storage, t []models.Task) ([]models.Task, []error) {
+	if c, ok := s.(Creator); ok {
+		return c.CreateTasksStored(t)
+	}
+
+	if errs := s.CreateTasks(t); len(errs) > 0 {
+		return nil, errs
+	}
+
+	var result []models.Task
+	for _, task := range t {
+		if stored := getStored(s, task); stored != nil {
+			result = append(result, *stored)
+		}
+	}
+
+	return result, nil
+}
+
+// getStored reads back a Task that was created with a GUID of its own.
+func getStored(s Storage, t models.Task) *models.Task {
+	if t.Guid == 0 {
+		return nil
+	}
+
+	stored, err := s.GetTask(t.Guid)
+	if err != nil {
+		return nil
+	}
+
+	return &stored
+}
+
 func setupStorageDir() error {
 	wd := viper.GetString("WorkingDir")
 
@@ -38,3 +261,4 @@ func setupStorageDir() error {
 type CreateFunc func(t models.Task) error
 type GetFunc func(uuid uint64) (models.Task, error)
 type EditFunc func(oldTask, newTask models.Task) error
+type ResolveFunc func(arg string) (uint64, error)
@@ -0,0 +1,107 @@
+package storage_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/oatmealraisin/tasker/pkg/storage"
+	"github.com/oatmealraisin/tasker/pkg/storage/storagetest"
+	"github.com/spf13/viper"
+)
+
+// backend is a storage backend the storagetest suites run against.
+type backend struct {
+	name string
+	// skip skips the tests of the backend where it can't run, if it isn't
+	// nil.
+	skip    func(t *testing.T)
+	factory storagetest.Factory
+	// shared is nil for backends that can't share their Tasks between
+	// processes through a directory.
+	shared storagetest.Opener
+}
+
+// fileBackend is a backend that keeps its Tasks in filename, opened with open.
+func fileBackend(name string, open func(filename string) storage.Storage, filename string) backend {
+	return backend{
+		name:    name,
+		factory: tempStorage(open, filename),
+		shared:  sharedStorage(open, filename),
+	}
+}
+
+var backends = []backend{
+	fileBackend("csv", storage.NewCsvStorage, "tasklist.csv"),
+	fileBackend("sqlite", storage.NewSqliteStorage, "tasklist.db"),
+	fileBackend("json", storage.NewJsonStorage, "tasklist.json"),
+	fileBackend("yaml", storage.NewYamlStorage, "tasklist.yaml"),
+	{name: "postgres", skip: skipWithoutPostgres, factory: postgresStorage},
+	{
+		name:    "git",
+		skip:    skipWithoutGit,
+		factory: tempStorage(storage.NewGitStorage, "tasklist"),
+		shared:  sharedStorage(storage.NewGitStorage, "tasklist"),
+	},
+	fileBackend("proto", storage.NewProtoStorage, "tasklist.pb"),
+	fileBackend("bolt", storage.NewBoltStorage, "tasklist.bolt"),
+}
+
+func TestBackends(t *testing.T) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			if b.skip != nil {
+				b.skip(t)
+			}
+
+			storagetest.Run(t, b.factory)
+		})
+	}
+}
+
+func TestBackendsConcurrent(t *testing.T) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			if b.skip != nil {
+				b.skip(t)
+			}
+
+			storagetest.RunConcurrent(t, b.factory)
+		})
+	}
+}
+
+func TestBackendsShared(t *testing.T) {
+	for _, b := range backends {
+		if b.shared == nil {
+			continue
+		}
+
+		t.Run(b.name, func(t *testing.T) {
+			if b.skip != nil {
+				b.skip(t)
+			}
+
+			storagetest.RunShared(t, b.shared)
+		})
+	}
+}
+
+// tempStorage returns a Factory that opens filename with open, in a new
+// WorkingDir for every test.
+func tempStorage(open func(filename string) storage.Storage, filename string) storagetest.Factory {
+	return func(t *testing.T) storage.Storage {
+		dir := t.TempDir()
+		viper.Set("WorkingDir", dir)
+
+		return open(filepath.Join(dir, filename))
+	}
+}
+
+// sharedStorage returns an Opener that opens filename in dir with open.
+func sharedStorage(open func(filename string) storage.Storage, filename string) storagetest.Opener {
+	return func(t *testing.T, dir string) storage.Storage {
+		viper.Set("WorkingDir", dir)
+
+		return open(filepath.Join(dir, filename))
+	}
+}
@@ -0,0 +1,261 @@
+package storagetest
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/oatmealraisin/tasker/pkg/models"
+	"github.com/oatmealraisin/tasker/pkg/storage"
+)
+
+const (
+	concurrentWriters = 8
+	concurrentTasks   = 20
+	concurrentReaders = 4
+)
+
+// RunConcurrent checks that a Storage can be shared by several goroutines, as
+// it is in long-running processes. The Storage has to be right, not just
+// avoid crashing, so run it with the race detector:
+//
+//	go test -race ./...
+func RunConcurrent(t *testing.T, newStorage Factory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, s storage.Storage)
+	}{
+		{"ConcurrentCreate", testConcurrentCreate},
+		{"ConcurrentEdit", testConcurrentEdit},
+		{"ConcurrentDelete", testConcurrentDelete},
+	}
+
+	for _, tt := range tests {
+		test := tt.test
+		t.Run(tt.name, func(t *testing.T) {
+			s := newStorage(t)
+			if s == nil {
+				t.Fatal("Factory returned a nil Storage")
+			}
+
+			test(t, s)
+		})
+	}
+}
+
+// whileReading runs write once in each of concurrentWriters goroutines, and
+// keeps reading from s in other goroutines until they are all done.
+func whileReading(t *testing.T, s storage.Storage, write func(i int)) {
+	t.Helper()
+
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+
+	for i := 0; i < concurrentReaders; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				read(t, s)
+			}
+		}()
+	}
+
+	var writers sync.WaitGroup
+	for i := 0; i < concurrentWriters; i++ {
+		writers.Add(1)
+		go func(i int) {
+			defer writers.Done()
+			write(i)
+		}(i)
+	}
+
+	writers.Wait()
+	close(done)
+	readers.Wait()
+}
+
+// read goes through s the ways tasker does. Tasks may disappear while it does,
+// so only the errors that can't be explained by that are reported.
+func read(t *testing.T, s storage.Storage) {
+	for _, guid := range s.GetAllTasks() {
+		if guid == 0 {
+			t.Errorf("GetAllTasks returned GUID 0")
+		}
+
+		s.GetTask(guid)
+	}
+
+	s.GetAllTags()
+	s.GetByTag("concurrent")
+	s.GetByTags([]string{"concurrent", "writer-0"})
+	s.GetByName("writer-0-0")
+
+	unfinished := false
+	if _, err := storage.Find(s, storage.Query{Finished: &unfinished}); err != nil {
+		t.Errorf("Find: %s", err.Error())
+	}
+
+	if _, err := storage.TopByScore(s, 5, storage.Query{}); err != nil {
+		t.Errorf("TopByScore: %s", err.Error())
+	}
+}
+
+func testConcurrentCreate(t *testing.T, s storage.Storage) {
+	whileReading(t, s, func(i int) {
+		createAll(t, s, i)
+	})
+
+	checkCreated(t, s)
+}
+
+// createAll creates the Tasks of writer i.
+func createAll(t *testing.T, s storage.Storage, i int) {
+	for j := 0; j < concurrentTasks; j++ {
+		task := models.Task{
+			Name: fmt.Sprintf("writer-%d-%d", i, j),
+			Tags: []string{"concurrent", fmt.Sprintf("writer-%d", i)},
+		}
+
+		if err := s.CreateTask(task); err != nil {
+			t.Errorf("CreateTask(%s): %s", task.Name, err.Error())
+		}
+	}
+}
+
+// checkCreated checks that s has the Tasks of every writer, each with a GUID
+// of its own.
+func checkCreated(t *testing.T, s storage.Storage) {
+	if all := s.GetAllTasks(); len(all) != concurrentWriters*concurrentTasks {
+		t.Errorf("GetAllTasks returned %d Tasks, expected %d", len(all), concurrentWriters*concurrentTasks)
+	}
+
+	seen := map[uint64]string{}
+	for i := 0; i < concurrentWriters; i++ {
+		for j := 0; j < concurrentTasks; j++ {
+			name := fmt.Sprintf("writer-%d-%d", i, j)
+
+			guids := s.GetByName(name)
+			if len(guids) != 1 {
+				t.Errorf("GetByName(%s) = %v, expected a single Task", name, guids)
+				continue
+			}
+
+			if other, ok := seen[guids[0]]; ok {
+				t.Errorf("%s and %s both have GUID %d", name, other, guids[0])
+			}
+			seen[guids[0]] = name
+
+			if got := get(t, s, guids[0]); got.Name != name {
+				t.Errorf("GetTask(%d) = %s, expected %s", guids[0], got.Name, name)
+			}
+		}
+
+		tag := fmt.Sprintf("writer-%d", i)
+		if guids := s.GetByTag(tag); len(guids) != concurrentTasks {
+			t.Errorf("GetByTag(%s) returned %d Tasks, expected %d", tag, len(guids), concurrentTasks)
+		}
+	}
+}
+
+func testConcurrentEdit(t *testing.T, s storage.Storage) {
+	tasks := make([]models.Task, concurrentWriters)
+	for i := range tasks {
+		tasks[i] = create(t, s, models.Task{Name: fmt.Sprintf("writer-%d", i)})
+	}
+
+	whileReading(t, s, func(i int) {
+		current := tasks[i]
+
+		for j := 1; j <= concurrentTasks; j++ {
+			edited := current
+			edited.Priority = uint32(j)
+			edited.Tags = []string{"concurrent", fmt.Sprintf("edit-%d", j)}
+
+			if err := s.EditTask(current, edited); err != nil {
+				t.Errorf("EditTask(%s): %s", current.Name, err.Error())
+				return
+			}
+
+			// For its new revision
+			var err error
+			if current, err = s.GetTask(current.Guid); err != nil {
+				t.Errorf("GetTask(%d): %s", edited.Guid, err.Error())
+				return
+			}
+		}
+	})
+
+	for _, task := range tasks {
+		got := get(t, s, task.Guid)
+		if got.Priority != concurrentTasks {
+			t.Errorf("%s has priority %d, expected %d", got.Name, got.Priority, concurrentTasks)
+		}
+	}
+
+	last := fmt.Sprintf("edit-%d", concurrentTasks)
+	if guids := s.GetByTag(last); len(guids) != concurrentWriters {
+		t.Errorf("GetByTag(%s) returned %d Tasks, expected %d", last, len(guids), concurrentWriters)
+	}
+
+	if guids := s.GetByTag("edit-1"); len(guids) != 0 {
+		t.Errorf("GetByTag(edit-1) = %v, expected none", guids)
+	}
+}
+
+func testConcurrentDelete(t *testing.T, s storage.Storage) {
+	tasks := make([][]models.Task, concurrentWriters)
+	for i := range tasks {
+		for j := 0; j < concurrentTasks; j++ {
+			task := create(t, s, models.Task{
+				Name: fmt.Sprintf("writer-%d-%d", i, j),
+				Tags: []string{"concurrent"},
+			})
+
+			tasks[i] = append(tasks[i], task)
+		}
+	}
+
+	// Half of the writers delete their Tasks while the other half add more
+	whileReading(t, s, func(i int) {
+		for j, task := range tasks[i] {
+			if i%2 == 0 {
+				if err := s.DeleteTask(task.Guid); err != nil {
+					t.Errorf("DeleteTask(%d): %s", task.Guid, err.Error())
+				}
+
+				continue
+			}
+
+			added := models.Task{Name: fmt.Sprintf("added-%d-%d", i, j), Tags: []string{"concurrent"}}
+			if err := s.CreateTask(added); err != nil {
+				t.Errorf("CreateTask(%s): %s", added.Name, err.Error())
+			}
+		}
+	})
+
+	want := (concurrentWriters / 2) * concurrentTasks * 2
+	if all := s.GetAllTasks(); len(all) != want {
+		t.Errorf("GetAllTasks returned %d Tasks, expected %d", len(all), want)
+	}
+
+	if guids := s.GetByTag("concurrent"); len(guids) != want {
+		t.Errorf("GetByTag(concurrent) returned %d Tasks, expected %d", len(guids), want)
+	}
+
+	for i := range tasks {
+		for _, task := range tasks[i] {
+			_, err := s.GetTask(task.Guid)
+			if deleted := i%2 == 0; deleted != (err != nil) {
+				t.Errorf("GetTask(%d) after deleting = %v, expected deleted to be %t", task.Guid, err, deleted)
+			}
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package storagetest
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/oatmealraisin/tasker/pkg/models"
+	"github.com/oatmealraisin/tasker/pkg/storage"
+)
+
+// Opener opens the Storage kept in dir. It should fail t if the Storage can't
+// be opened.
+type Opener func(t *testing.T, dir string) storage.Storage
+
+// RunShared checks that two Storages opened on the same dir, like those of two
+// tasker processes, see each other's changes instead of overwriting them.
+func RunShared(t *testing.T, open Opener) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, open func() storage.Storage)
+	}{
+		{"SharedCreate", testSharedCreate},
+		{"SharedEdit", testSharedEdit},
+		{"SharedDelete", testSharedDelete},
+	}
+
+	for _, tt := range tests {
+		test := tt.test
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			test(t, func() storage.Storage {
+				s := open(t, dir)
+				if s == nil {
+					t.Fatal("Opener returned a nil Storage")
+				}
+
+				return s
+			})
+		})
+	}
+}
+
+func testSharedCreate(t *testing.T, open func() storage.Storage) {
+	a, b := open(), open()
+
+	whileReading(t, a, func(i int) {
+		if i%2 == 0 {
+			createAll(t, a, i)
+		} else {
+			createAll(t, b, i)
+		}
+	})
+
+	checkCreated(t, a)
+	checkCreated(t, b)
+	checkCreated(t, open())
+}
+
+func testSharedEdit(t *testing.T, open func() storage.Storage) {
+	a, b := open(), open()
+
+	task := create(t, a, models.Task{Name: "shared"})
+	stale := get(t, b, task.Guid)
+
+	edited := task
+	edited.Priority = 3
+	if err := a.EditTask(task, edited); err != nil {
+		t.Fatalf("EditTask: %s", err.Error())
+	}
+
+	if got := get(t, b, task.Guid); got.Priority != 3 {
+		t.Errorf("The other Storage has priority %d after the edit, expected 3", got.Priority)
+	}
+
+	overwrite := stale
+	overwrite.Size = 2
+	if err := b.EditTask(stale, overwrite); !storage.IsConflictError(err) {
+		t.Errorf("EditTask with the other Storage's old copy = %v, expected a ConflictError", err)
+	}
+
+	if got := get(t, open(), task.Guid); got.Priority != 3 || got.Size != 0 {
+		t.Errorf("Task has priority %d and size %d, expected 3 and 0", got.Priority, got.Size)
+	}
+}
+
+func testSharedDelete(t *testing.T, open func() storage.Storage) {
+	a, b := open(), open()
+
+	var tasks []models.Task
+	for i := 0; i < 2; i++ {
+		tasks = append(tasks, create(t, a, models.Task{Name: fmt.Sprintf("shared-%d", i)}))
+	}
+
+	if err := b.DeleteTask(tasks[1].Guid); err != nil {
+		t.Fatalf("DeleteTask: %s", err.Error())
+	}
+
+	if _, err := a.GetTask(tasks[1].Guid); err == nil {
+		t.Errorf("The other Storage still has the deleted Task")
+	}
+
+	added := create(t, a, models.Task{Name: "added"})
+	for _, task := range tasks {
+		if added.Guid == task.Guid {
+			t.Errorf("New Task got GUID %d, which %s had", added.Guid, task.Name)
+		}
+	}
+
+	if all := open().GetAllTasks(); len(all) != 2 {
+		t.Errorf("GetAllTasks = %v, expected 2 Tasks", all)
+	}
+}
@@ -0,0 +1,683 @@
+// Package storagetest checks that a storage.Storage behaves the way the rest of
+// tasker expects. Every backend, including the ones provided by plugins,
+// should pass it:
+//
+//	func TestMyStorage(t *testing.T) {
+//		storagetest.Run(t, func(t *testing.T) storage.Storage {
+//			return NewMyStorage(filepath.Join(t.TempDir(), "tasks"))
+//		})
+//	}
+package storagetest
+
+import (
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	tspb "github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/oatmealraisin/tasker/pkg/models"
+	"github.com/oatmealraisin/tasker/pkg/storage"
+)
+
+// Factory returns a new, empty Storage for a single test. It should fail t if
+// the Storage can't be opened.
+type Factory func(t *testing.T) storage.Storage
+
+// Run runs every conformance test against Storages made by newStorage.
+func Run(t *testing.T, newStorage Factory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, s storage.Storage)
+	}{
+		{"CreateAndGet", testCreateAndGet},
+		{"ZeroGuidIsReserved", testZeroGuidIsReserved},
+		{"ExplicitGuid", testExplicitGuid},
+		{"DuplicateGuid", testDuplicateGuid},
+		{"AddedDefaultsToNow", testAddedDefaultsToNow},
+		{"ParentIsLinked", testParentIsLinked},
+		{"MissingParent", testMissingParent},
+		{"EditTask", testEditTask},
+		{"EditCannotChangeGuid", testEditCannotChangeGuid},
+		{"EditCannotChangeAdded", testEditCannotChangeAdded},
+		{"EditMissingTask", testEditMissingTask},
+		{"EditBumpsRevision", testEditBumpsRevision},
+		{"EditConflict", testEditConflict},
+		{"ParentRevisionOnNewSubtask", testParentRevisionOnNewSubtask},
+		{"DeleteTask", testDeleteTask},
+		{"DeleteUnlinksTask", testDeleteUnlinksTask},
+		{"DeleteMissingTask", testDeleteMissingTask},
+		{"DeletedGuidIsNotReused", testDeletedGuidIsNotReused},
+		{"UndoDeleteRestoresLinks", testUndoDeleteRestoresLinks},
+		{"Tags", testTags},
+		{"CreateTasks", testCreateTasks},
+		{"CreateTasksIsAllOrNothing", testCreateTasksIsAllOrNothing},
+		{"CreateStored", testCreateStored},
+		{"DeleteUnlinked", testDeleteUnlinked},
+	}
+
+	for _, tt := range tests {
+		test := tt.test
+		t.Run(tt.name, func(t *testing.T) {
+			s := newStorage(t)
+			if s == nil {
+				t.Fatal("Factory returned a nil Storage")
+			}
+
+			test(t, s)
+		})
+	}
+}
+
+// create creates a Task and returns it as it was stored, so its GUID and
+// add date are filled in. The Task must have a unique name.
+func create(t *testing.T, s storage.Storage, task models.Task) models.Task {
+	t.Helper()
+
+	if err := s.CreateTask(task); err != nil {
+		t.Fatalf("CreateTask(%s): %s", task.Name, err.Error())
+	}
+
+	guids := s.GetByName(task.Name)
+	if len(guids) != 1 {
+		t.Fatalf("GetByName(%s) = %v, expected a single Task", task.Name, guids)
+	}
+
+	return get(t, s, guids[0])
+}
+
+func get(t *testing.T, s storage.Storage, guid uint64) models.Task {
+	t.Helper()
+
+	result, err := s.GetTask(guid)
+	if err != nil {
+		t.Fatalf("GetTask(%d): %s", guid, err.Error())
+	}
+
+	return result
+}
+
+func timestamp(t *testing.T, s string) *tspb.Timestamp {
+	t.Helper()
+
+	parsed, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := ptypes.TimestampProto(parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return result
+}
+
+func sorted(guids []uint64) []uint64 {
+	result := append([]uint64{}, guids...)
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+
+	return result
+}
+
+func sameGuids(a, b []uint64) bool {
+	a, b = sorted(a), sorted(b)
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func testCreateAndGet(t *testing.T, s storage.Storage) {
+	want := models.Task{
+		Name:     "write, \"tests\"",
+		Tags:     []string{"work", "code"},
+		Priority: 3,
+		Size:     5,
+		Added:    timestamp(t, "2019-03-01T10:00:00Z"),
+		Due:      timestamp(t, "2019-04-01T12:30:00Z"),
+		Url:      "https://example.com/tasks?id=1",
+	}
+
+	got := create(t, s, want)
+
+	if got.Guid == 0 {
+		t.Errorf("Task was given GUID 0")
+	}
+
+	if got.Name != want.Name || got.Priority != want.Priority || got.Size != want.Size || got.Url != want.Url {
+		t.Errorf("GetTask = %s, expected %s", got.String(), want.String())
+	}
+
+	if !proto.Equal(got.Added, want.Added) || !proto.Equal(got.Due, want.Due) {
+		t.Errorf("Timestamps were not kept: %s", got.String())
+	}
+
+	if len(got.Tags) != 2 || got.Tags[0] != "work" || got.Tags[1] != "code" {
+		t.Errorf("Tags = %v, expected %v", got.Tags, want.Tags)
+	}
+
+	if all := s.GetAllTasks(); len(all) != 1 || all[0] != got.Guid {
+		t.Errorf("GetAllTasks = %v, expected [%d]", all, got.Guid)
+	}
+}
+
+func testZeroGuidIsReserved(t *testing.T, s storage.Storage) {
+	create(t, s, models.Task{Name: "a"})
+
+	if _, err := s.GetTask(0); !storage.IsZeroGuidError(err) {
+		t.Errorf("GetTask(0) = %v, expected the zero GUID error", err)
+	}
+}
+
+func testExplicitGuid(t *testing.T, s storage.Storage) {
+	got := create(t, s, models.Task{Guid: 42, Name: "a"})
+	if got.Guid != 42 {
+		t.Errorf("Task was given GUID %d instead of 42", got.Guid)
+	}
+
+	next := create(t, s, models.Task{Name: "b"})
+	if next.Guid == 42 || next.Guid == 0 {
+		t.Errorf("Next Task was given GUID %d", next.Guid)
+	}
+}
+
+func testDuplicateGuid(t *testing.T, s storage.Storage) {
+	first := create(t, s, models.Task{Name: "a"})
+
+	if err := s.CreateTask(models.Task{Guid: first.Guid, Name: "b"}); err == nil {
+		t.Errorf("CreateTask with an existing GUID succeeded")
+	}
+
+	if got := get(t, s, first.Guid); got.Name != "a" {
+		t.Errorf("Task %d was replaced by %s", first.Guid, got.Name)
+	}
+}
+
+func testAddedDefaultsToNow(t *testing.T, s storage.Storage) {
+	before := time.Now().Add(-time.Second)
+	got := create(t, s, models.Task{Name: "a"})
+	after := time.Now().Add(time.Second)
+
+	added, err := ptypes.Timestamp(got.Added)
+	if err != nil {
+		t.Fatalf("Added was not set: %s", err.Error())
+	}
+
+	if added.Before(before) || added.After(after) {
+		t.Errorf("Added = %s, expected between %s and %s", added, before, after)
+	}
+}
+
+func testParentIsLinked(t *testing.T, s storage.Storage) {
+	parent := create(t, s, models.Task{Name: "parent"})
+	child := create(t, s, models.Task{Name: "child", Parent: parent.Guid})
+
+	if child.Parent != parent.Guid {
+		t.Errorf("Child has parent %d, expected %d", child.Parent, parent.Guid)
+	}
+
+	parent = get(t, s, parent.Guid)
+	if !sameGuids(parent.Subtasks, []uint64{child.Guid}) {
+		t.Errorf("Parent has subtasks %v, expected [%d]", parent.Subtasks, child.Guid)
+	}
+
+	// A parent that already lists the child isn't linked twice
+	listed := child.Guid + 100
+	old := parent
+	parent.Subtasks = append(parent.Subtasks[:len(parent.Subtasks):len(parent.Subtasks)], listed)
+	if err := s.EditTask(old, parent); err != nil {
+		t.Fatalf("EditTask: %s", err.Error())
+	}
+
+	create(t, s, models.Task{Guid: listed, Name: "listed", Parent: parent.Guid})
+	parent = get(t, s, parent.Guid)
+	if !sameGuids(parent.Subtasks, []uint64{child.Guid, listed}) {
+		t.Errorf("Parent has subtasks %v, expected [%d %d]", parent.Subtasks, child.Guid, listed)
+	}
+}
+
+func testMissingParent(t *testing.T, s storage.Storage) {
+	if err := s.CreateTask(models.Task{Name: "orphan", Parent: 999}); err == nil {
+		t.Errorf("CreateTask with a missing parent succeeded")
+	}
+
+	if guids := s.GetByName("orphan"); len(guids) != 0 {
+		t.Errorf("Task with a missing parent was created: %v", guids)
+	}
+}
+
+func testEditTask(t *testing.T, s storage.Storage) {
+	old := create(t, s, models.Task{Name: "before", Tags: []string{"a", "b"}})
+
+	edited := old
+	edited.Name = "after"
+	edited.Tags = []string{"b", "c"}
+	edited.Priority = 7
+	edited.Finished = timestamp(t, "2019-05-01T08:00:00Z")
+
+	if err := s.EditTask(old, edited); err != nil {
+		t.Fatalf("EditTask: %s", err.Error())
+	}
+
+	got := get(t, s, old.Guid)
+	if got.Name != "after" || got.Priority != 7 || !proto.Equal(got.Finished, edited.Finished) {
+		t.Errorf("GetTask = %s, expected %s", got.String(), edited.String())
+	}
+
+	if guids := s.GetByName("before"); len(guids) != 0 {
+		t.Errorf("GetByName(before) = %v after renaming", guids)
+	}
+
+	if guids := s.GetByName("after"); !sameGuids(guids, []uint64{old.Guid}) {
+		t.Errorf("GetByName(after) = %v, expected [%d]", guids, old.Guid)
+	}
+
+	if guids := s.GetByTag("a"); len(guids) != 0 {
+		t.Errorf("GetByTag(a) = %v after removing the tag", guids)
+	}
+
+	if guids := s.GetByTag("c"); !sameGuids(guids, []uint64{old.Guid}) {
+		t.Errorf("GetByTag(c) = %v, expected [%d]", guids, old.Guid)
+	}
+}
+
+func testEditCannotChangeGuid(t *testing.T, s storage.Storage) {
+	old := create(t, s, models.Task{Name: "a"})
+
+	edited := old
+	edited.Guid = old.Guid + 1
+	if err := s.EditTask(old, edited); err == nil {
+		t.Errorf("EditTask changed the GUID of a Task")
+	}
+
+	if _, err := s.GetTask(old.Guid + 1); err == nil {
+		t.Errorf("EditTask created Task %d", old.Guid+1)
+	}
+}
+
+func testEditCannotChangeAdded(t *testing.T, s storage.Storage) {
+	old := create(t, s, models.Task{Name: "a", Added: timestamp(t, "2019-01-01T00:00:00Z")})
+
+	edited := old
+	edited.Added = timestamp(t, "2019-02-01T00:00:00Z")
+	if err := s.EditTask(old, edited); err == nil {
+		t.Errorf("EditTask changed the add date of a Task")
+	}
+
+	// An equal timestamp is not a change
+	edited.Added = timestamp(t, "2019-01-01T00:00:00Z")
+	edited.Name = "b"
+	if err := s.EditTask(old, edited); err != nil {
+		t.Errorf("EditTask with the same add date failed: %s", err.Error())
+	}
+}
+
+func testEditMissingTask(t *testing.T, s storage.Storage) {
+	missing := models.Task{Guid: 999, Name: "missing", Added: timestamp(t, "2019-01-01T00:00:00Z")}
+
+	edited := missing
+	edited.Name = "still missing"
+	if err := s.EditTask(missing, edited); err == nil {
+		t.Errorf("EditTask of a missing Task succeeded")
+	}
+
+	if all := s.GetAllTasks(); len(all) != 0 {
+		t.Errorf("EditTask of a missing Task created %v", all)
+	}
+}
+
+func testEditBumpsRevision(t *testing.T, s storage.Storage) {
+	old := create(t, s, models.Task{Name: "a"})
+
+	edited := old
+	edited.Priority = 1
+	// Whatever the caller sets, the Storage picks the revision
+	edited.Revision = 100
+	if err := s.EditTask(old, edited); err != nil {
+		t.Fatalf("EditTask: %s", err.Error())
+	}
+
+	if got := get(t, s, old.Guid); got.Revision != old.Revision+1 {
+		t.Errorf("Task has revision %d after an edit, expected %d", got.Revision, old.Revision+1)
+	}
+}
+
+func testEditConflict(t *testing.T, s storage.Storage) {
+	old := create(t, s, models.Task{Name: "a"})
+
+	first := old
+	first.Priority = 1
+	if err := s.EditTask(old, first); err != nil {
+		t.Fatalf("EditTask: %s", err.Error())
+	}
+
+	// Made from the same copy, so it would undo the first edit
+	second := old
+	second.Name = "b"
+	err := s.EditTask(old, second)
+	if !storage.IsConflictError(err) {
+		t.Fatalf("EditTask from an out of date copy = %v, expected a conflict", err)
+	}
+
+	got := get(t, s, old.Guid)
+	if got.Name != "a" || got.Priority != 1 {
+		t.Errorf("GetTask = %s after a conflict, expected the first edit", got.String())
+	}
+
+	if guids := s.GetByName("b"); len(guids) != 0 {
+		t.Errorf("GetByName(b) = %v after a conflict", guids)
+	}
+
+	// Starting over from the stored Task works
+	second = got
+	second.Name = "b"
+	if err := s.EditTask(got, second); err != nil {
+		t.Errorf("EditTask after getting the Task again: %s", err.Error())
+	}
+}
+
+func testParentRevisionOnNewSubtask(t *testing.T, s storage.Storage) {
+	parent := create(t, s, models.Task{Name: "parent"})
+	create(t, s, models.Task{Name: "child", Parent: parent.Guid})
+
+	// Written back, it would drop the new subtask
+	edited := parent
+	edited.Priority = 1
+	if err := s.EditTask(parent, edited); !storage.IsConflictError(err) {
+		t.Errorf("EditTask of a parent from before it got a subtask = %v, expected a conflict", err)
+	}
+}
+
+func testDeleteTask(t *testing.T, s storage.Storage) {
+	a := create(t, s, models.Task{Name: "a", Tags: []string{"gone"}})
+	b := create(t, s, models.Task{Name: "b"})
+
+	if err := s.DeleteTask(a.Guid); err != nil {
+		t.Fatalf("DeleteTask: %s", err.Error())
+	}
+
+	if _, err := s.GetTask(a.Guid); err == nil {
+		t.Errorf("GetTask found a deleted Task")
+	}
+
+	if all := s.GetAllTasks(); !sameGuids(all, []uint64{b.Guid}) {
+		t.Errorf("GetAllTasks = %v, expected [%d]", all, b.Guid)
+	}
+
+	if guids := s.GetByName("a"); len(guids) != 0 {
+		t.Errorf("GetByName found a deleted Task: %v", guids)
+	}
+
+	if guids := s.GetByTag("gone"); len(guids) != 0 {
+		t.Errorf("GetByTag found a deleted Task: %v", guids)
+	}
+
+	for _, tag := range s.GetAllTags() {
+		if tag == "gone" {
+			t.Errorf("GetAllTags has the tag of a deleted Task")
+		}
+	}
+}
+
+func testDeleteUnlinksTask(t *testing.T, s storage.Storage) {
+	parent := create(t, s, models.Task{Name: "parent"})
+	sub := create(t, s, models.Task{Name: "sub", Parent: parent.Guid})
+	other := create(t, s, models.Task{Name: "other sub", Parent: parent.Guid})
+	dependency := create(t, s, models.Task{Name: "dependency"})
+	dependant := create(t, s, models.Task{Name: "dependant", Dependencies: []uint64{dependency.Guid, other.Guid}})
+	parent = get(t, s, parent.Guid)
+
+	for _, guid := range []uint64{sub.Guid, dependency.Guid} {
+		if err := s.DeleteTask(guid); err != nil {
+			t.Fatalf("DeleteTask(%d): %s", guid, err.Error())
+		}
+	}
+
+	after := get(t, s, parent.Guid)
+	if !sameGuids(after.Subtasks, []uint64{other.Guid}) {
+		t.Errorf("Subtasks of the parent = %v, expected [%d]", after.Subtasks, other.Guid)
+	}
+
+	if after.Revision <= parent.Revision {
+		t.Errorf("Revision of the parent is %d, expected it to go up from %d", after.Revision, parent.Revision)
+	}
+
+	after = get(t, s, dependant.Guid)
+	if !sameGuids(after.Dependencies, []uint64{other.Guid}) {
+		t.Errorf("Dependencies of the dependant = %v, expected [%d]", after.Dependencies, other.Guid)
+	}
+
+	if after.Revision <= dependant.Revision {
+		t.Errorf("Revision of the dependant is %d, expected it to go up from %d", after.Revision, dependant.Revision)
+	}
+}
+
+func testDeleteMissingTask(t *testing.T, s storage.Storage) {
+	if err := s.DeleteTask(999); err == nil {
+		t.Errorf("DeleteTask of a missing Task succeeded")
+	}
+}
+
+func testDeletedGuidIsNotReused(t *testing.T, s storage.Storage) {
+	a := create(t, s, models.Task{Name: "a"})
+	b := create(t, s, models.Task{Name: "b"})
+
+	if err := s.DeleteTask(b.Guid); err != nil {
+		t.Fatalf("DeleteTask: %s", err.Error())
+	}
+
+	c := create(t, s, models.Task{Name: "c"})
+	if c.Guid == a.Guid || c.Guid == b.Guid {
+		t.Errorf("New Task got GUID %d, which was used by a deleted Task", c.Guid)
+	}
+
+	if c.Guid < b.Guid {
+		t.Errorf("New Task got GUID %d, expected GUIDs to keep going up from %d", c.Guid, b.Guid)
+	}
+}
+
+// testUndoDeleteRestoresLinks checks that undoing a delete through a
+// HistoryStorage puts the Task back on the subtasks and dependencies the
+// Storage took it off.
+func testUndoDeleteRestoresLinks(t *testing.T, s storage.Storage) {
+	h := storage.NewHistoryStorage(s, filepath.Join(t.TempDir(), "history.jsonl"))
+
+	parent := create(t, h, models.Task{Name: "parent"})
+	first := create(t, h, models.Task{Name: "first", Parent: parent.Guid})
+	sub := create(t, h, models.Task{Name: "sub", Parent: parent.Guid})
+	last := create(t, h, models.Task{Name: "last", Parent: parent.Guid})
+	dependant := create(t, h, models.Task{Name: "dependant", Dependencies: []uint64{first.Guid, sub.Guid}})
+
+	if err := h.DeleteTask(sub.Guid); err != nil {
+		t.Fatalf("DeleteTask: %s", err.Error())
+	}
+
+	if _, err := h.Undo(1, false); err != nil {
+		t.Fatalf("Undo: %s", err.Error())
+	}
+
+	if got := get(t, h, sub.Guid); got.Name != "sub" || got.Parent != parent.Guid {
+		t.Errorf("After the undo, the Task is %s", got.String())
+	}
+
+	expected := []uint64{first.Guid, sub.Guid, last.Guid}
+	if got := get(t, h, parent.Guid); len(got.Subtasks) != 3 || got.Subtasks[0] != expected[0] || got.Subtasks[1] != expected[1] || got.Subtasks[2] != expected[2] {
+		t.Errorf("Subtasks of the parent = %v after the undo, expected %v", got.Subtasks, expected)
+	}
+
+	if got := get(t, h, dependant.Guid); !sameGuids(got.Dependencies, dependant.Dependencies) {
+		t.Errorf("Dependencies of the dependant = %v after the undo, expected %v", got.Dependencies, dependant.Dependencies)
+	}
+}
+
+func testTags(t *testing.T, s storage.Storage) {
+	a := create(t, s, models.Task{Name: "a", Tags: []string{"x", "y"}})
+	b := create(t, s, models.Task{Name: "b", Tags: []string{"y"}})
+	c := create(t, s, models.Task{Name: "c", Tags: []string{"z"}})
+
+	if guids := s.GetByTag("y"); !sameGuids(guids, []uint64{a.Guid, b.Guid}) {
+		t.Errorf("GetByTag(y) = %v, expected [%d %d]", guids, a.Guid, b.Guid)
+	}
+
+	if guids := s.GetByTag("none"); len(guids) != 0 {
+		t.Errorf("GetByTag(none) = %v", guids)
+	}
+
+	if guids := s.GetByTags([]string{"x", "z"}); !sameGuids(guids, []uint64{a.Guid, c.Guid}) {
+		t.Errorf("GetByTags(x, z) = %v, expected [%d %d]", guids, a.Guid, c.Guid)
+	}
+
+	tags := s.GetAllTags()
+	sort.Strings(tags)
+	if len(tags) != 3 || tags[0] != "x" || tags[1] != "y" || tags[2] != "z" {
+		t.Errorf("GetAllTags = %v, expected [x y z]", tags)
+	}
+}
+
+func testCreateTasks(t *testing.T, s storage.Storage) {
+	parent := create(t, s, models.Task{Name: "parent"})
+
+	errs := s.CreateTasks([]models.Task{
+		{Name: "a", Parent: parent.Guid},
+		{Name: "b", Parent: parent.Guid},
+		{Guid: 100, Name: "c"},
+	})
+	if len(errs) != 0 {
+		t.Fatalf("CreateTasks: %v", errs)
+	}
+
+	if all := s.GetAllTasks(); len(all) != 4 {
+		t.Errorf("GetAllTasks = %v, expected 4 Tasks", all)
+	}
+
+	a := s.GetByName("a")
+	b := s.GetByName("b")
+	if len(a) != 1 || len(b) != 1 || a[0] == b[0] {
+		t.Fatalf("CreateTasks gave GUIDs %v and %v", a, b)
+	}
+
+	parent = get(t, s, parent.Guid)
+	if !sameGuids(parent.Subtasks, []uint64{a[0], b[0]}) {
+		t.Errorf("Parent has subtasks %v, expected [%d %d]", parent.Subtasks, a[0], b[0])
+	}
+
+	if got := get(t, s, 100); got.Name != "c" {
+		t.Errorf("GetTask(100) = %s, expected c", got.Name)
+	}
+}
+
+func testCreateTasksIsAllOrNothing(t *testing.T, s storage.Storage) {
+	parent := create(t, s, models.Task{Name: "parent"})
+
+	errs := s.CreateTasks([]models.Task{
+		{Name: "a", Parent: parent.Guid},
+		{Name: "b", Parent: 999},
+		{Name: "c"},
+	})
+	if len(errs) == 0 {
+		t.Fatalf("CreateTasks with a missing parent succeeded")
+	}
+
+	if all := s.GetAllTasks(); !sameGuids(all, []uint64{parent.Guid}) {
+		t.Errorf("GetAllTasks = %v after a failed CreateTasks, expected [%d]", all, parent.Guid)
+	}
+
+	if got := get(t, s, parent.Guid); len(got.Subtasks) != 0 {
+		t.Errorf("Parent has subtasks %v after a failed CreateTasks", got.Subtasks)
+	}
+}
+
+// testCreateStored checks that a Creator returns the Tasks it created, not
+// just any Tasks that are new.
+func testCreateStored(t *testing.T, s storage.Storage) {
+	c, ok := s.(storage.Creator)
+	if !ok {
+		t.Skip("Not a Creator")
+	}
+
+	stored, err := c.CreateTaskStored(models.Task{Name: "a"})
+	if err != nil {
+		t.Fatalf("CreateTaskStored: %s", err.Error())
+	}
+
+	if got := get(t, s, stored.Guid); got.Name != "a" || got.Added == nil {
+		t.Errorf("CreateTaskStored returned GUID %d, which has %s", stored.Guid, got.String())
+	}
+
+	all, errs := c.CreateTasksStored([]models.Task{{Name: "b"}, {Guid: 100, Name: "c"}, {Name: "d"}})
+	if len(errs) != 0 {
+		t.Fatalf("CreateTasksStored: %v", errs)
+	}
+
+	if len(all) != 3 {
+		t.Fatalf("CreateTasksStored returned %d Tasks, expected 3", len(all))
+	}
+
+	for i, name := range []string{"b", "c", "d"} {
+		if guids := s.GetByName(name); len(guids) != 1 || guids[0] != all[i].Guid {
+			t.Errorf("CreateTasksStored gave %s GUID %d, but it has %v", name, all[i].Guid, guids)
+		}
+	}
+
+	if _, errs := c.CreateTasksStored([]models.Task{{Name: "e"}, {Name: "f", Parent: 999}}); len(errs) == 0 {
+		t.Errorf("CreateTasksStored with a missing parent succeeded")
+	}
+}
+
+func testDeleteUnlinked(t *testing.T, s storage.Storage) {
+	d, ok := s.(storage.Deleter)
+	if !ok {
+		t.Skip("Not a Deleter")
+	}
+
+	task := create(t, s, models.Task{Name: "task"})
+	parent := create(t, s, models.Task{Name: "parent"})
+	sub := create(t, s, models.Task{Name: "sub", Parent: parent.Guid})
+	dependant := create(t, s, models.Task{Name: "dependant", Dependencies: []uint64{sub.Guid}})
+	parent = get(t, s, parent.Guid)
+
+	unlinked, err := d.DeleteTaskUnlinked(task.Guid)
+	if err != nil {
+		t.Fatalf("DeleteTaskUnlinked(%d): %s", task.Guid, err.Error())
+	}
+
+	if len(unlinked) != 0 {
+		t.Errorf("DeleteTaskUnlinked of a Task nothing refers to returned %d Tasks", len(unlinked))
+	}
+
+	if unlinked, err = d.DeleteTaskUnlinked(sub.Guid); err != nil {
+		t.Fatalf("DeleteTaskUnlinked(%d): %s", sub.Guid, err.Error())
+	}
+
+	var guids []uint64
+	for _, ref := range unlinked {
+		guids = append(guids, ref.Guid)
+
+		expected := parent
+		if ref.Guid == dependant.Guid {
+			expected = dependant
+		}
+
+		if !proto.Equal(&ref, &expected) {
+			t.Errorf("DeleteTaskUnlinked returned %s, expected it as it was before: %s", ref.String(), expected.String())
+		}
+	}
+
+	if !sameGuids(guids, []uint64{parent.Guid, dependant.Guid}) {
+		t.Errorf("DeleteTaskUnlinked returned %v, expected [%d %d]", sorted(guids), parent.Guid, dependant.Guid)
+	}
+
+	if _, err := d.DeleteTaskUnlinked(sub.Guid); err == nil {
+		t.Errorf("DeleteTaskUnlinked of a missing Task succeeded")
+	}
+}
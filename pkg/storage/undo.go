@@ -0,0 +1,232 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/oatmealraisin/tasker/pkg/models"
+)
+
+// Undo reverts the last n changes made through h that haven't been undone yet,
+// newest first, and returns the entries it reverted. A change is everything a
+// single call did, so undoing an import removes every Task it added. With
+// dryRun, it only returns what it would revert.
+//
+// Undo stops at the first change it can't revert, such as an edit to a Task
+// that has been changed since without going through h. The changes before
+// that stay reverted, and so do the entries of that change it got through, so
+// undoing again carries on with the rest of it.
+func (h *HistoryStorage) Undo(n int, dryRun bool) ([]HistoryEntry, error) {
+	entries, err := h.entries()
+	if err != nil {
+		return nil, fmt.Errorf("HistoryStorage.Undo: %s", err.Error())
+	}
+
+	changes, err := undoableChanges(entries, n)
+	if err != nil {
+		return nil, fmt.Errorf("HistoryStorage.Undo: %s", err.Error())
+	}
+
+	var result []HistoryEntry
+
+	for _, change := range changes {
+		if dryRun {
+			result = append(result, change...)
+			continue
+		}
+
+		undo := h.newChange()
+		var markers []HistoryEntry
+
+		for _, entry := range change {
+			if err := h.undoEntry(entry); err != nil {
+				h.append(markers...)
+				return result, fmt.Errorf("Could not undo %s of Task %d: %s", entry.Op, entry.Guid, err.Error())
+			}
+
+			result = append(result, entry)
+			markers = append(markers, HistoryEntry{
+				Time:    time.Now(),
+				Change:  undo,
+				Guid:    entry.Guid,
+				Op:      HistoryUndo,
+				Undoes:  entry.Change,
+				Changes: reverseChanges(entry.Changes),
+				Before:  entry.After,
+				After:   entry.Before,
+			})
+		}
+
+		if err := h.append(markers...); err != nil {
+			return result, fmt.Errorf("HistoryStorage.Undo: could not record undo: %s", err.Error())
+		}
+	}
+
+	return result, nil
+}
+
+// undoableChanges returns the entries of the last n changes that haven't been
+// undone, newest first, with the entries of each change in reverse order.
+func undoableChanges(entries []HistoryEntry, n int) ([][]HistoryEntry, error) {
+	// A change has one entry per Task, so that's enough to tell which of
+	// its entries an undo got through
+	type undoneEntry struct {
+		change int64
+		guid   uint64
+	}
+
+	undone := map[undoneEntry]bool{}
+	for _, entry := range entries {
+		if entry.Op == HistoryUndo {
+			undone[undoneEntry{entry.Undoes, entry.Guid}] = true
+		}
+	}
+
+	var order []int64
+	byChange := map[int64][]HistoryEntry{}
+
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		if entry.Op == HistoryUndo || undone[undoneEntry{entry.Change, entry.Guid}] {
+			continue
+		}
+
+		if entry.Change == 0 {
+			// Recorded before tasker kept what it needs to undo
+			break
+		}
+
+		if _, ok := byChange[entry.Change]; !ok {
+			if len(order) == n {
+				// Keep looking for entries of the changes we have, in
+				// case another process wrote in between them
+				continue
+			}
+
+			order = append(order, entry.Change)
+		}
+
+		byChange[entry.Change] = append(byChange[entry.Change], entry)
+	}
+
+	result := make([][]HistoryEntry, len(order))
+	for i, change := range order {
+		result[i] = byChange[change]
+	}
+
+	if len(result) == 0 {
+		return nil, fmt.Errorf("nothing to undo")
+	}
+
+	return result, nil
+}
+
+// undoEntry puts a Task back the way it was before entry, as long as nobody
+// changed it since.
+func (h *HistoryStorage) undoEntry(entry HistoryEntry) error {
+	var before, after models.Task
+	var err error
+
+	if entry.Op != HistoryCreate {
+		if before, err = historyTask(entry.Before); err != nil {
+			return fmt.Errorf("the history has no earlier version: %s", err.Error())
+		}
+	}
+
+	if entry.Op != HistoryDelete {
+		if after, err = historyTask(entry.After); err != nil {
+			return fmt.Errorf("the history has no later version: %s", err.Error())
+		}
+	}
+
+	if entry.Op == HistoryDelete {
+		if _, err := h.Storage.GetTask(entry.Guid); err == nil {
+			return fmt.Errorf("a Task with GUID %d exists again", entry.Guid)
+		}
+
+		return h.Storage.CreateTask(before)
+	}
+
+	current, err := h.Storage.GetTask(entry.Guid)
+	if err != nil {
+		return err
+	}
+
+	if !sameTask(current, after) {
+		return fmt.Errorf("it was changed since")
+	}
+
+	if entry.Op == HistoryCreate {
+		if !entry.Created {
+			return fmt.Errorf("it may have been created by someone else")
+		}
+
+		// Deleting takes it off the subtasks of its parent too
+		return h.Storage.DeleteTask(entry.Guid)
+	}
+
+	restored := restoreTask(current, before)
+	if err := h.Storage.EditTask(current, restored); err != nil {
+		return err
+	}
+
+	return h.moveSubtask(entry.Guid, current.Parent, restored.Parent)
+}
+
+// sameTask reports whether a and b are the same version of a Task. Revisions
+// go up with changes to other Tasks too, such as adding a subtask and undoing
+// that again, and some Storages derive the dependants from other Tasks, so
+// those are left out.
+func sameTask(a, b models.Task) bool {
+	a.Revision, b.Revision = 0, 0
+	a.Dependants, b.Dependants = nil, nil
+
+	return proto.Equal(&a, &b)
+}
+
+// restoreTask returns before, as an edit of current.
+func restoreTask(current, before models.Task) models.Task {
+	result := before
+	result.Revision = current.Revision
+	result.Dependants = current.Dependants
+
+	return result
+}
+
+// moveSubtask takes guid off the subtasks of the parent it had, and adds it to
+// the subtasks of the one it has again.
+func (h *HistoryStorage) moveSubtask(guid, from, to uint64) error {
+	if from == to {
+		return nil
+	}
+
+	if parent, err := h.Storage.GetTask(from); err == nil && containsGuid(parent.Subtasks, guid) {
+		edited := parent
+		edited.Subtasks = withoutGuid(parent.Subtasks, guid)
+
+		if err := h.Storage.EditTask(parent, edited); err != nil {
+			return fmt.Errorf("could not take it off the subtasks of Task %d: %s", from, err.Error())
+		}
+	}
+
+	if parent, err := h.Storage.GetTask(to); err == nil && !containsGuid(parent.Subtasks, guid) {
+		edited := parent
+		edited.Subtasks = append(parent.Subtasks[:len(parent.Subtasks):len(parent.Subtasks)], guid)
+
+		if err := h.Storage.EditTask(parent, edited); err != nil {
+			return fmt.Errorf("could not add it to the subtasks of Task %d: %s", to, err.Error())
+		}
+	}
+
+	return nil
+}
+
+func reverseChanges(changes []FieldChange) []FieldChange {
+	result := make([]FieldChange, len(changes))
+	for i, change := range changes {
+		result[i] = FieldChange{Field: change.Field, Old: change.New, New: change.Old}
+	}
+
+	return result
+}
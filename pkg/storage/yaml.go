@@ -1,35 +1,208 @@
 package storage
 
 import (
+	"bytes"
+	"fmt"
+	"io"
 	"os"
+	"reflect"
+	"time"
 
+	"github.com/golang/protobuf/ptypes"
+	tspb "github.com/golang/protobuf/ptypes/timestamp"
 	"github.com/oatmealraisin/tasker/pkg/models"
+	"github.com/oatmealraisin/tasker/pkg/util"
+	yaml "gopkg.in/yaml.v2"
 )
 
+// YamlStorage keeps every Task as its own YAML document in a single file, in
+// GUID order. It is meant to be edited by hand, so dates can be written as
+// YYYY-MM-DD or YYYY-MM-DD HH:MM as well as RFC 3339, and empty fields are
+// left out.
 type YamlStorage struct {
-	f os.File
+	*fileStorage
 }
 
-func (y *YamlStorage) CreateTask(t *models.Task) error {
-	panic("not implemented")
+type yamlTask struct {
+	Guid         uint64   `yaml:"guid"`
+	Name         string   `yaml:"name"`
+	Tags         []string `yaml:"tags,flow,omitempty"`
+	Priority     uint32   `yaml:"priority,omitempty"`
+	Size         uint32   `yaml:"size,omitempty"`
+	Added        string   `yaml:"added,omitempty"`
+	Active       string   `yaml:"active,omitempty"`
+	Due          string   `yaml:"due,omitempty"`
+	Finished     string   `yaml:"finished,omitempty"`
+	Removed      bool     `yaml:"removed,omitempty"`
+	Repeats      bool     `yaml:"repeats,omitempty"`
+	GuidPrevious uint32   `yaml:"guid_previous,omitempty"`
+	Url          string   `yaml:"url,omitempty"`
+	Parent       uint64   `yaml:"parent,omitempty"`
+	Subtasks     []uint64 `yaml:"subtasks,flow,omitempty"`
+	Dependencies []uint64 `yaml:"dependencies,flow,omitempty"`
+	Dependants   []uint64 `yaml:"dependants,flow,omitempty"`
+	Revision     uint64   `yaml:"revision,omitempty"`
 }
 
-func (y *YamlStorage) CreateTasks(t []*models.Task) []error {
-	panic("not implemented")
+func NewYamlStorage(filename string) Storage {
+	var err error
+
+	err = setupStorageDir()
+	if err != nil {
+		return nil
+	}
+
+	result := new(YamlStorage)
+	result.fileStorage, err = newFileStorage("YamlStorage", filename, tasksToYaml, tasksFromYaml)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading YAML Storage: %s\n", err.Error())
+		return nil
+	}
+
+	return result
 }
 
-func (y *YamlStorage) GetTask(guid uint64) (models.Task, error) {
-	panic("not implemented")
+func tasksToYaml(tasks []models.Task) ([]byte, error) {
+	var b bytes.Buffer
+
+	e := yaml.NewEncoder(&b)
+	for _, task := range tasks {
+		if err := e.Encode(taskToYaml(task)); err != nil {
+			return nil, fmt.Errorf("Could not encode Task %d: %s", task.Guid, err.Error())
+		}
+	}
+
+	if err := e.Close(); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
 }
 
-func (y *YamlStorage) GetByTag(tag string) ([]models.Task, error) {
-	panic("not implemented")
+// tasksFromYaml reads every document in b. Since the file is edited by hand,
+// a document without a GUID, or with one another document has, is an error
+// rather than a Task that would be lost on the next write.
+func tasksFromYaml(b []byte) ([]models.Task, error) {
+	result := []models.Task{}
+	documents := map[uint64]int{}
+
+	d := yaml.NewDecoder(bytes.NewReader(b))
+	for i := 0; ; i++ {
+		var y yamlTask
+		if err := d.Decode(&y); err == io.EOF {
+			return result, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("Document %d: %s", i, err.Error())
+		}
+
+		// Such as after a trailing "---"
+		if reflect.DeepEqual(y, yamlTask{}) {
+			continue
+		}
+
+		if y.Guid == 0 {
+			return nil, fmt.Errorf("Document %d (%s): has no guid", i, y.Name)
+		}
+
+		if other, ok := documents[y.Guid]; ok {
+			return nil, fmt.Errorf("Document %d (%s): guid %d is already used by document %d", i, y.Name, y.Guid, other)
+		}
+		documents[y.Guid] = i
+
+		task, err := taskFromYaml(y)
+		if err != nil {
+			return nil, fmt.Errorf("Document %d: %s", i, err.Error())
+		}
+
+		result = append(result, task)
+	}
 }
 
-func (y *YamlStorage) GetByName(name string) ([]models.Task, error) {
-	panic("not implemented")
+func taskToYaml(task models.Task) yamlTask {
+	return yamlTask{
+		Guid:         task.Guid,
+		Name:         task.Name,
+		Tags:         task.Tags,
+		Priority:     task.Priority,
+		Size:         task.Size,
+		Added:        yamlTimestamp(task.Added),
+		Active:       yamlTimestamp(task.Active),
+		Due:          yamlTimestamp(task.Due),
+		Finished:     yamlTimestamp(task.Finished),
+		Removed:      task.Removed,
+		Repeats:      task.Repeats,
+		GuidPrevious: task.GuidPrevious,
+		Url:          task.Url,
+		Parent:       task.Parent,
+		Subtasks:     task.Subtasks,
+		Dependencies: task.Dependencies,
+		Dependants:   task.Dependants,
+		Revision:     task.Revision,
+	}
 }
 
-func (y *YamlStorage) GetAllTasks() ([]models.Task, error) {
-	panic("not implemented")
+func taskFromYaml(y yamlTask) (models.Task, error) {
+	result := models.Task{
+		Guid:         y.Guid,
+		Name:         y.Name,
+		Tags:         y.Tags,
+		Priority:     y.Priority,
+		Size:         y.Size,
+		Removed:      y.Removed,
+		Repeats:      y.Repeats,
+		GuidPrevious: y.GuidPrevious,
+		Url:          y.Url,
+		Parent:       y.Parent,
+		Subtasks:     y.Subtasks,
+		Dependencies: y.Dependencies,
+		Dependants:   y.Dependants,
+		Revision:     y.Revision,
+	}
+
+	var err error
+	for _, f := range []struct {
+		name  string
+		value string
+		dst   **tspb.Timestamp
+	}{
+		{"added", y.Added, &result.Added},
+		{"active", y.Active, &result.Active},
+		{"due", y.Due, &result.Due},
+		{"finished", y.Finished, &result.Finished},
+	} {
+		if *f.dst, err = parseYamlTimestamp(f.value); err != nil {
+			return result, fmt.Errorf("Task %d: Could not read %s: %s", y.Guid, f.name, err.Error())
+		}
+	}
+
+	return result, nil
+}
+
+func yamlTimestamp(t *tspb.Timestamp) string {
+	if t == nil {
+		return ""
+	}
+
+	result, err := ptypes.Timestamp(t)
+	if err != nil {
+		return ""
+	}
+
+	return result.In(time.Now().Location()).Format(time.RFC3339Nano)
+}
+
+func parseYamlTimestamp(s string) (*tspb.Timestamp, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return ptypes.TimestampProto(t)
+	}
+
+	if result := util.StringToTimestamp(s); result != nil {
+		return result, nil
+	}
+
+	return nil, fmt.Errorf("Unable to parse timestamp: %s", s)
 }
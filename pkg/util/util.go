@@ -23,8 +23,8 @@ import (
 	tspb "github.com/golang/protobuf/ptypes/timestamp"
 )
 
-var YYYY_MM_DD *regexp.Regexp = regexp.MustCompile("[0-9]{4}-[0-9]{2}-[0-9]{2}")
-var YYYY_MM_DD_HH_MM *regexp.Regexp = regexp.MustCompile("[0-9]{4}-[0-9]{2}-[0-9]{2} [0-9]{2}:[0-9]{2}")
+var YYYY_MM_DD *regexp.Regexp = regexp.MustCompile("^[0-9]{4}-[0-9]{2}-[0-9]{2}$")
+var YYYY_MM_DD_HH_MM *regexp.Regexp = regexp.MustCompile("^[0-9]{4}-[0-9]{2}-[0-9]{2} [0-9]{2}:[0-9]{2}$")
 
 // StringToTimestamp takes a string either formatted in YYYY-MM-DD or in RFC3339
 // and returns a protobuf Timestamp. If there is any issue, it will return nil
@@ -0,0 +1,55 @@
+package util
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+)
+
+func TestStringToTimestamp(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected time.Time
+	}{
+		{"2024-01-01", time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local)},
+		{"2024-01-01 09:30", time.Date(2024, 1, 1, 9, 30, 0, 0, time.Local)},
+		// Starts like YYYY-MM-DD, so the formats have to match the whole
+		// string for this to be read as RFC3339
+		{"2024-01-01T09:30:00Z", time.Date(2024, 1, 1, 9, 30, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		ts := StringToTimestamp(tt.in)
+		if ts == nil {
+			t.Errorf("StringToTimestamp(%q) = nil, expected %s", tt.in, tt.expected)
+			continue
+		}
+
+		if result, err := ptypes.Timestamp(ts); err != nil || !result.Equal(tt.expected) {
+			t.Errorf("StringToTimestamp(%q) = %s, expected %s", tt.in, result, tt.expected)
+		}
+	}
+}
+
+func TestDateFormatsMatchWholeString(t *testing.T) {
+	for _, in := range []string{"2024-01-01x", "x2024-01-01", "2024-01-01 09:30", "2024-01-01T09:30:00Z"} {
+		if YYYY_MM_DD.MatchString(in) {
+			t.Errorf("YYYY_MM_DD matches %q", in)
+		}
+	}
+
+	for _, in := range []string{"2024-01-01 09:30x", "x2024-01-01 09:30", "2024-01-01 09:30:00"} {
+		if YYYY_MM_DD_HH_MM.MatchString(in) {
+			t.Errorf("YYYY_MM_DD_HH_MM matches %q", in)
+		}
+	}
+}
+
+func TestStringToTimestampRejectsTrailing(t *testing.T) {
+	for _, in := range []string{"2024-01-01x", "2024-01-01 09:30x", "x2024-01-01", "2024-01-01 9:30"} {
+		if ts := StringToTimestamp(in); ts != nil {
+			t.Errorf("StringToTimestamp(%q) = %v, expected nil", in, ts)
+		}
+	}
+}
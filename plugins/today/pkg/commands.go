@@ -20,7 +20,6 @@ import (
 	"fmt"
 	"log"
 	"sort"
-	"strconv"
 	"time"
 
 	"github.com/spf13/cobra"
@@ -49,17 +48,16 @@ func (t *Today) add(cmd *cobra.Command, args []string) error {
 
 	add_date := t.Now
 	for _, x := range args {
-		uuid, err := strconv.ParseUint(x, 10, 64)
-		if err != nil {
-			_, err = time.Parse("2006-1-2", x)
-			if err != nil {
-				return err
-			}
-
+		if _, err := time.Parse("2006-1-2", x); err == nil {
 			add_date = x
 			continue
 		}
 
+		uuid, err := t.resolve(x)
+		if err != nil {
+			return err
+		}
+
 		if _, ok := t.Tasks[add_date]; ok {
 			t.Tasks[add_date] = append(t.Tasks[add_date], uuid)
 		} else {
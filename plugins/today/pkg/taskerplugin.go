@@ -117,3 +117,7 @@ func (t *Today) Version() string {
 func (t *Today) SetGetFunc(get storage.GetFunc) {
 	t.Get = get
 }
+
+func (t *Today) SetResolveFunc(resolve storage.ResolveFunc) {
+	t.Resolve = resolve
+}
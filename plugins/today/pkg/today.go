@@ -18,6 +18,8 @@ package today
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/oatmealraisin/tasker/pkg/models"
@@ -26,12 +28,23 @@ import (
 
 type Today struct {
 	Tasks       map[string][]uint64
-	Today       []uint64 `json: "-"`
-	Now         string   `json: "-"`
-	Yesterday   string   `json: "-"`
-	Initialized bool     `json: "-"`
+	Today       []uint64 `json:"-"`
+	Now         string   `json:"-"`
+	Yesterday   string   `json:"-"`
+	Initialized bool     `json:"-"`
 
-	Get storage.GetFunc `json: "-"`
+	Get     storage.GetFunc     `json:"-"`
+	Resolve storage.ResolveFunc `json:"-"`
+}
+
+// resolve finds the Task arg names, falling back on plain GUIDs when tasker
+// didn't give us a ResolveFunc.
+func (t *Today) resolve(arg string) (uint64, error) {
+	if t.Resolve != nil {
+		return t.Resolve(arg)
+	}
+
+	return strconv.ParseUint(strings.TrimPrefix(arg, "#"), 10, 64)
 }
 
 // A utility function for standard today usage. Will either print the content of